@@ -0,0 +1,447 @@
+// Package asm6502 assembles 6502 machine code from ca65-style source lines.
+//
+// Each call to Ins assembles one instruction:
+//
+//	a := asm6502.New(0x0D00)
+//	a.Equ("zp_out_lo", 0x05)
+//	a.Label("copy")
+//	a.Ins("sta (zp_out_lo),y")
+//	a.Ins("inc zp_out_lo")
+//	a.Ins("bne @done")
+//	a.Ins("cmp #$%02X", hi) // printf-style operands
+//	a.Label("@done")
+//	code, labels, err := a.Assemble()
+//
+// Operands take numbers ($hex, %binary, decimal), equates and labels, added
+// or subtracted, with < and > selecting the low and high byte. Labels may be
+// used before they are defined. A label starting with @ is local to the
+// label before it. An operand known to be below $100 when the instruction is
+// assembled uses zero page addressing; one that refers to a label not yet
+// defined is assembled as absolute. OperandLabel names a byte of the last
+// instruction's operand, for self-modifying code. SetCPU(CPU65C02) adds the
+// 65C02 instructions and addressing modes. Branches out of range, operands
+// that do not fit their mode and undefined symbols are reported by Assemble.
+package asm6502
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Assembler collects the code of one routine assembled for origin.
+type Assembler struct {
+	origin  int
+	cpu     CPU
+	code    []byte
+	equates map[string]int
+	labels  map[string]int // offsets; local labels keyed by scope + name
+	globals []string       // labels not local, in definition order
+	scope   string         // last label not local
+	last    int            // offset of the last instruction
+	fixups  []fixup
+	errs    []error
+	source  []string // labels as "name:", and instructions
+}
+
+// fixup is an operand whose value was not known when it was assembled.
+type fixup struct {
+	at    int // offset of the operand
+	mode  Mode
+	expr  expr
+	scope string
+	line  string
+}
+
+// New returns an assembler for code loaded at origin.
+func New(origin int) *Assembler {
+	return &Assembler{origin: origin, equates: make(map[string]int), labels: make(map[string]int)}
+}
+
+// Origin returns the address the code is assembled for.
+func (a *Assembler) Origin() int {
+	return a.origin
+}
+
+// SetCPU selects the instruction set accepted from the next instruction on.
+func (a *Assembler) SetCPU(cpu CPU) {
+	a.cpu = cpu
+}
+
+// Offset returns the offset of the next byte from the origin.
+func (a *Assembler) Offset() int {
+	return len(a.code)
+}
+
+// Equ defines a symbol, usually a zero page address.
+func (a *Assembler) Equ(name string, value int) {
+	if _, ok := a.equates[name]; ok {
+		a.errorf("%s defined twice", name)
+	}
+	a.equates[name] = value
+}
+
+// Label defines name at the current offset and returns the offset.
+func (a *Assembler) Label(name string) int {
+	key := name
+	if strings.HasPrefix(name, "@") {
+		key = a.scope + name
+	} else {
+		a.scope = name
+		a.globals = append(a.globals, name)
+	}
+	if _, ok := a.labels[key]; ok {
+		a.errorf("label %s defined twice", name)
+	}
+	if _, ok := a.equates[name]; ok {
+		a.errorf("label %s is also an equate", name)
+	}
+	a.labels[key] = len(a.code)
+	a.source = append(a.source, name+":")
+	return len(a.code)
+}
+
+// OperandLabel defines name at byte i of the operand of the instruction
+// assembled last, for code that rewrites its own operands. Unlike Label it
+// does not start a scope for local labels.
+func (a *Assembler) OperandLabel(name string, i int) {
+	if i < 0 || a.last+1+i >= len(a.code) {
+		a.errorf("label %s outside the operand", name)
+		return
+	}
+	if _, ok := a.labels[name]; ok {
+		a.errorf("label %s defined twice", name)
+	}
+	if _, ok := a.equates[name]; ok {
+		a.errorf("label %s is also an equate", name)
+	}
+	a.labels[name] = a.last + 1 + i
+	a.globals = append(a.globals, name)
+}
+
+// Lookup returns the offset of a label defined so far.
+func (a *Assembler) Lookup(name string) (int, bool) {
+	key := name
+	if strings.HasPrefix(name, "@") {
+		key = a.scope + name
+	}
+	offset, ok := a.labels[key]
+	return offset, ok
+}
+
+// Source returns the labels and instructions given so far, a label as
+// "name:", so that the code can be rewritten and assembled again. Bytes
+// appended with Byte and operand labels are not in it.
+func (a *Assembler) Source() []string {
+	return append([]string(nil), a.source...)
+}
+
+// Byte appends raw bytes.
+func (a *Assembler) Byte(b ...byte) {
+	a.code = append(a.code, b...)
+}
+
+// Ins assembles one instruction, formatting the line with args if there are
+// any, and returns its offset.
+func (a *Assembler) Ins(format string, args ...any) int {
+	line := format
+	if len(args) > 0 {
+		line = fmt.Sprintf(format, args...)
+	}
+	at := len(a.code)
+	a.last = at
+	text, _, _ := strings.Cut(line, ";")
+	a.source = append(a.source, strings.TrimSpace(text))
+	if err := a.ins(line); err != nil {
+		a.errs = append(a.errs, fmt.Errorf("%q: %w", strings.TrimSpace(line), err))
+	}
+	return at
+}
+
+func (a *Assembler) ins(line string) error {
+	line, _, _ = strings.Cut(line, ";")
+	mnemonic, operand, _ := strings.Cut(strings.TrimSpace(line), " ")
+	mnemonic = strings.ToLower(mnemonic)
+	operand = strings.TrimSpace(operand)
+	modes, ok := a.cpu.modes(mnemonic)
+	if !ok {
+		return fmt.Errorf("unknown instruction %s", mnemonic)
+	}
+
+	// Operand syntax: the mode family, and the expression inside it
+	var mode Mode
+	lower := strings.ToLower(operand)
+	text := operand
+	switch {
+	case operand == "":
+		mode = Implied
+		if _, ok := modes[Implied]; !ok {
+			mode = Accumulator
+		}
+	case lower == "a":
+		mode = Accumulator
+	case strings.HasPrefix(operand, "#"):
+		mode, text = Immediate, operand[1:]
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(lower, ",x)"):
+		mode, text = IndirectX, operand[1:len(operand)-3]
+		if _, ok := modes[AbsoluteIndirectX]; ok {
+			mode = AbsoluteIndirectX
+		}
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(lower, "),y"):
+		mode, text = IndirectY, operand[1:len(operand)-3]
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, ")"):
+		mode, text = Indirect, operand[1:len(operand)-1]
+		if _, ok := modes[ZeroPageIndirect]; ok {
+			mode = ZeroPageIndirect
+		}
+	case strings.HasSuffix(lower, ",x"):
+		mode, text = AbsoluteX, operand[:len(operand)-2]
+	case strings.HasSuffix(lower, ",y"):
+		mode, text = AbsoluteY, operand[:len(operand)-2]
+	default:
+		mode = Absolute
+		if _, ok := modes[Relative]; ok {
+			mode = Relative
+		}
+	}
+
+	var e expr
+	value, known := 0, true
+	if mode != Implied && mode != Accumulator {
+		var err error
+		if e, err = parseExpr(text); err != nil {
+			return err
+		}
+		value, known = a.eval(e, a.scope)
+	}
+
+	// Zero page when the address is known to fit it
+	zp := map[Mode]Mode{Absolute: ZeroPage, AbsoluteX: ZeroPageX, AbsoluteY: ZeroPageY}
+	if z, ok := zp[mode]; ok && known && value >= 0 && value < 0x100 {
+		if _, ok := modes[z]; ok {
+			mode = z
+		}
+	}
+	op, ok := modes[mode]
+	if !ok {
+		return fmt.Errorf("%s has no %s addressing", mnemonic, modeNames[mode])
+	}
+	if (mode == IndirectX || mode == IndirectY || mode == ZeroPageIndirect) && !known {
+		return fmt.Errorf("%s needs a zero page address defined before use", modeNames[mode])
+	}
+
+	a.code = append(a.code, op)
+	switch mode.Size() {
+	case 2:
+		a.code = append(a.code, 0)
+	case 3:
+		a.code = append(a.code, 0, 0)
+	}
+	if mode == Implied || mode == Accumulator {
+		return nil
+	}
+	f := fixup{at: len(a.code) - mode.Size() + 1, mode: mode, expr: e, scope: a.scope, line: strings.TrimSpace(line)}
+	if !known {
+		a.fixups = append(a.fixups, f)
+		return nil
+	}
+	return a.patch(f, value)
+}
+
+// patch stores a fixup's operand.
+func (a *Assembler) patch(f fixup, value int) error {
+	switch f.mode {
+	case Relative:
+		offset := value - (a.origin + f.at + 1)
+		if offset < -128 || offset > 127 {
+			return fmt.Errorf("branch to $%04X out of range (offset %d)", value, offset)
+		}
+		a.code[f.at] = byte(offset)
+	case Absolute, AbsoluteX, AbsoluteY, Indirect, AbsoluteIndirectX:
+		if value < 0 || value > 0xFFFF {
+			return fmt.Errorf("address $%X out of range", value)
+		}
+		a.code[f.at], a.code[f.at+1] = byte(value), byte(value>>8)
+	default:
+		if value < 0 || value > 0xFF {
+			return fmt.Errorf("value $%X does not fit a byte", value)
+		}
+		a.code[f.at] = byte(value)
+	}
+	return nil
+}
+
+// Assemble resolves the forward references and returns the code and the
+// offsets of the labels that are not local.
+func (a *Assembler) Assemble() ([]byte, map[string]int, error) {
+	for _, f := range a.fixups {
+		value, known := a.eval(f.expr, f.scope)
+		err := fmt.Errorf("undefined symbol in %s", f.expr)
+		if known {
+			err = a.patch(f, value)
+		}
+		if err != nil {
+			a.errs = append(a.errs, fmt.Errorf("%q: %w", f.line, err))
+		}
+	}
+	a.fixups = nil
+	labels := make(map[string]int, len(a.globals))
+	for _, name := range a.globals {
+		labels[name] = a.labels[name]
+	}
+	return a.code, labels, errors.Join(a.errs...)
+}
+
+// MustAssemble is Assemble for generators whose source is fixed, where an
+// error is a bug in the generator.
+func (a *Assembler) MustAssemble() ([]byte, map[string]int) {
+	code, labels, err := a.Assemble()
+	if err != nil {
+		panic("asm6502: " + err.Error())
+	}
+	return code, labels
+}
+
+func (a *Assembler) errorf(format string, args ...any) {
+	a.errs = append(a.errs, fmt.Errorf(format, args...))
+}
+
+// expr is an operand expression: terms added up, then optionally reduced to
+// their low (<) or high (>) byte.
+type expr struct {
+	sel   byte
+	terms []term
+}
+
+type term struct {
+	neg   bool
+	value int
+	name  string // symbol, or "" for a number
+}
+
+func (e expr) String() string {
+	var sb strings.Builder
+	if e.sel != 0 {
+		sb.WriteByte(e.sel)
+	}
+	for i, t := range e.terms {
+		if t.neg {
+			sb.WriteByte('-')
+		} else if i > 0 {
+			sb.WriteByte('+')
+		}
+		if t.name != "" {
+			sb.WriteString(t.name)
+		} else {
+			sb.WriteString(strconv.Itoa(t.value))
+		}
+	}
+	return sb.String()
+}
+
+// parseExpr parses [<|>] term {(+|-) term}.
+func parseExpr(s string) (expr, error) {
+	var e expr
+	s = strings.TrimSpace(s)
+	if s != "" && (s[0] == '<' || s[0] == '>') {
+		e.sel, s = s[0], strings.TrimSpace(s[1:])
+	}
+	neg := false
+	if strings.HasPrefix(s, "-") {
+		neg, s = true, s[1:]
+	}
+	for {
+		end := strings.IndexAny(s, "+-")
+		if end < 0 {
+			end = len(s)
+		}
+		t, err := parseTerm(strings.TrimSpace(s[:end]))
+		if err != nil {
+			return e, err
+		}
+		t.neg = neg
+		e.terms = append(e.terms, t)
+		if end == len(s) {
+			return e, nil
+		}
+		neg, s = s[end] == '-', s[end+1:]
+	}
+}
+
+func parseTerm(s string) (term, error) {
+	var v uint64
+	var err error
+	switch {
+	case s == "":
+		return term{}, errors.New("missing operand")
+	case s[0] == '$':
+		v, err = strconv.ParseUint(s[1:], 16, 32)
+	case s[0] == '%':
+		v, err = strconv.ParseUint(s[1:], 2, 32)
+	case s[0] >= '0' && s[0] <= '9':
+		v, err = strconv.ParseUint(s, 10, 32)
+	default:
+		for i, c := range s {
+			if !(c == '_' || c == '@' && i == 0 || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+				return term{}, fmt.Errorf("bad symbol %q", s)
+			}
+		}
+		return term{name: s}, nil
+	}
+	if err != nil {
+		return term{}, fmt.Errorf("bad number %q", s)
+	}
+	return term{value: int(v)}, nil
+}
+
+// eval returns the value of e, and false if a label in it is not defined yet.
+func (a *Assembler) eval(e expr, scope string) (int, bool) {
+	value := 0
+	for _, t := range e.terms {
+		v := t.value
+		if t.name != "" {
+			key := t.name
+			if strings.HasPrefix(key, "@") {
+				key = scope + key
+			}
+			if eq, ok := a.equates[t.name]; ok {
+				v = eq
+			} else if off, ok := a.labels[key]; ok {
+				v = a.origin + off
+			} else {
+				return 0, false
+			}
+		}
+		if t.neg {
+			v = -v
+		}
+		value += v
+	}
+	switch e.sel {
+	case '<':
+		value &= 0xFF
+	case '>':
+		value = value >> 8 & 0xFF
+	}
+	return value, true
+}
+
+var modeNames = [numModes]string{
+	Implied:     "implied",
+	Accumulator: "accumulator",
+	Immediate:   "immediate",
+	ZeroPage:    "zero page",
+	ZeroPageX:   "zero page,x",
+	ZeroPageY:   "zero page,y",
+	Absolute:    "absolute",
+	AbsoluteX:   "absolute,x",
+	AbsoluteY:   "absolute,y",
+	Indirect:    "indirect",
+	IndirectX:   "(indirect,x)",
+	IndirectY:   "(indirect),y",
+	Relative:    "relative",
+
+	ZeroPageIndirect:  "(zero page)",
+	AbsoluteIndirectX: "(absolute,x)",
+}
@@ -0,0 +1,232 @@
+package asm6502
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestAssembleErrors checks that the errors Assemble reports name the
+// failing line and the reason.
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  func(a *Assembler)
+		want string
+	}{
+		{"branch back out of range", func(a *Assembler) {
+			a.Label("top")
+			for i := 0; i < 64; i++ {
+				a.Ins("nop")
+				a.Ins("nop")
+			}
+			a.Ins("bne top")
+		}, "out of range (offset -130)"},
+		{"branch forward out of range", func(a *Assembler) {
+			a.Ins("beq done")
+			for i := 0; i < 128; i++ {
+				a.Ins("nop")
+			}
+			a.Label("done")
+			a.Ins("rts")
+		}, "out of range (offset 128)"},
+		{"immediate too large", func(a *Assembler) {
+			a.Ins("lda #$100")
+		}, "value $100 does not fit a byte"},
+		{"indirect operand past zero page", func(a *Assembler) {
+			a.Equ("ptr", 0x1234)
+			a.Ins("lda (ptr),y")
+		}, "value $1234 does not fit a byte"},
+		{"indirect operand defined late", func(a *Assembler) {
+			a.Ins("sta (ptr),y")
+			a.Equ("ptr", 0x10)
+		}, "needs a zero page address defined before use"},
+		{"zero page only mode", func(a *Assembler) {
+			a.Ins("stx $1234,y")
+		}, "stx has no absolute,y addressing"},
+		{"undefined label", func(a *Assembler) {
+			a.Ins("jmp nowhere")
+		}, "undefined symbol in nowhere"},
+		{"undefined local label", func(a *Assembler) {
+			a.Label("one")
+			a.Label("@loop")
+			a.Label("two")
+			a.Ins("bne @loop")
+		}, "undefined symbol in @loop"},
+		{"label defined twice", func(a *Assembler) {
+			a.Label("twice")
+			a.Ins("nop")
+			a.Label("twice")
+		}, "label twice defined twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(0x1000)
+			tt.src(a)
+			_, _, err := a.Assemble()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestZeroPageSelection checks that an operand known to fit the zero page
+// uses zero page addressing and one defined later does not.
+func TestZeroPageSelection(t *testing.T) {
+	tests := []struct {
+		line string
+		want []byte
+	}{
+		{"lda $12", []byte{0xA5, 0x12}},
+		{"lda $0012+$100", []byte{0xAD, 0x12, 0x01}},
+		{"lda zp,x", []byte{0xB5, 0x80}},
+		{"ldx zp,y", []byte{0xB6, 0x80}},
+		{"lda zp,y", []byte{0xB9, 0x80, 0x00}}, // no zero page,y for lda
+		{"lda late", []byte{0xAD, 0x20, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			a := New(0x1000)
+			a.Equ("zp", 0x80)
+			a.Ins("%s", tt.line)
+			a.Equ("late", 0x20)
+			code, _, err := a.Assemble()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(code, tt.want) {
+				t.Fatalf("got % X, want % X", code, tt.want)
+			}
+		})
+	}
+}
+
+// TestRoundTrip checks that the listing of assembled code assembles back to
+// the same bytes, for both instruction sets.
+func TestRoundTrip(t *testing.T) {
+	for _, cpu := range []CPU{CPU6502, CPU65C02} {
+		a := New(0x0D00)
+		a.SetCPU(cpu)
+		a.Equ("zp_ptr", 0x02)
+		a.Label("start")
+		a.Ins("ldy #$00")
+		a.Label("loop")
+		a.Ins("lda (zp_ptr),y")
+		a.Ins("beq @done")
+		a.Ins("sta $0400,y")
+		a.Ins("iny")
+		a.Ins("bne loop")
+		a.Ins("inc zp_ptr+1")
+		a.Ins("jmp loop")
+		a.Label("@done")
+		a.Ins("asl a")
+		a.Ins("jsr start")
+		if cpu == CPU65C02 {
+			a.Ins("stz zp_ptr")
+			a.Ins("bra loop")
+		}
+		a.Ins("rts")
+		code, labels, err := a.Assemble()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l := &Listing{Origin: 0x0D00, CPU: cpu, Labels: make(map[int]string), ZeroPage: map[int]string{0x02: "zp_ptr"}, AutoLabel: "L%04X", LabelJumps: true}
+		for name, off := range labels {
+			l.Labels[0x0D00+off] = name
+		}
+		text := l.Write(code)
+
+		b := New(0x0D00)
+		b.SetCPU(cpu)
+		b.Equ("zp_ptr", 0x02)
+		for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			if name, ok := strings.CutSuffix(line, ":"); ok {
+				b.Label(name)
+			} else if strings.HasPrefix(line, " ") {
+				b.Ins("%s", line)
+			} else {
+				t.Fatalf("cpu %d: unexpected line %q in\n%s", cpu, line, text)
+			}
+		}
+		again, _, err := b.Assemble()
+		if err != nil {
+			t.Fatalf("cpu %d: %v in\n%s", cpu, err, text)
+		}
+		if !bytes.Equal(again, code) {
+			t.Fatalf("cpu %d: got % X, want % X from\n%s", cpu, again, code, text)
+		}
+	}
+}
+
+// TestDecodeDocumented decodes every documented opcode of each instruction
+// set in every addressing mode, and checks that its listing line assembles
+// back to the same bytes.
+func TestDecodeDocumented(t *testing.T) {
+	const origin = 0x0D00
+	for cpu, want := range map[CPU]int{CPU6502: 151, CPU65C02: 178} {
+		seen := 0
+		for mnemonic := range cmos {
+			if _, ok := opcodes[mnemonic]; !ok && cpu == CPU65C02 {
+				seen += checkDecode(t, cpu, mnemonic, origin)
+			}
+		}
+		for mnemonic := range opcodes {
+			seen += checkDecode(t, cpu, mnemonic, origin)
+		}
+		if seen != want {
+			t.Errorf("cpu %d: decoded %d documented opcodes, want %d", cpu, seen, want)
+		}
+		for op := 0; op < 256; op++ {
+			if in, ok := cpu.Decode([]byte{byte(op), 0, 0}, 0, origin, false); ok && in.Undocumented {
+				t.Errorf("cpu %d: opcode $%02X: undocumented %s decoded without undocumented set", cpu, op, in.Mnemonic)
+			}
+		}
+	}
+}
+
+// checkDecode decodes each addressing mode of mnemonic on cpu, lists it and
+// assembles the listing again. It returns the number of modes checked.
+func checkDecode(t *testing.T, cpu CPU, mnemonic string, origin int) int {
+	t.Helper()
+	modes, _ := cpu.modes(mnemonic)
+	for mode, op := range modes {
+		code := []byte{op, 0x12, 0x34}[:mode.Size()]
+		want := Instruction{Mnemonic: mnemonic, Mode: mode, Size: mode.Size()}
+		switch mode.Size() {
+		case 2:
+			want.Operand = 0x12
+		case 3:
+			want.Operand = 0x3412
+		}
+		if mode == Relative {
+			want.Operand = origin + 2 + 0x12
+		}
+		got, ok := cpu.Decode(code, 0, origin, false)
+		if !ok || got != want {
+			t.Errorf("cpu %d: opcode $%02X: got %+v %v, want %+v", cpu, op, got, ok, want)
+			continue
+		}
+
+		text := (&Listing{Origin: origin, CPU: cpu, AutoLabel: "L%04X"}).Write(code)
+		b := New(origin)
+		b.SetCPU(cpu)
+		for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			if name, value, ok := strings.Cut(line, " = $"); ok {
+				addr, _ := strconv.ParseInt(value, 16, 0)
+				b.Equ(strings.TrimSpace(name), int(addr))
+			} else {
+				b.Ins("%s", line)
+			}
+		}
+		again, _, err := b.Assemble()
+		if err != nil {
+			t.Errorf("cpu %d: opcode $%02X: %v in %q", cpu, op, err, text)
+		} else if !bytes.Equal(again, code) {
+			t.Errorf("cpu %d: opcode $%02X: %q assembles to % X", cpu, op, text, again)
+		}
+	}
+	return len(modes)
+}
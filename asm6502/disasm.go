@@ -0,0 +1,307 @@
+package asm6502
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Instruction is one decoded instruction.
+type Instruction struct {
+	Mnemonic     string
+	Mode         Mode
+	Operand      int // byte or address; the target address for a branch
+	Size         int
+	Undocumented bool
+}
+
+// Decode decodes the NMOS instruction at code[off], for code loaded at
+// origin. It reports false for an undocumented opcode unless undocumented is
+// set, and for an instruction cut off by the end of code.
+func Decode(code []byte, off, origin int, undocumented bool) (Instruction, bool) {
+	return CPU6502.Decode(code, off, origin, undocumented)
+}
+
+// Decode is Decode for cpu. The 65C02 has no undocumented opcodes; it
+// reports false for the opcodes it leaves undefined.
+func (c CPU) Decode(code []byte, off, origin int, undocumented bool) (Instruction, bool) {
+	info := decodeTable[code[off]]
+	if c == CPU65C02 {
+		info, undocumented = decodeTable65C02[code[off]], false
+	}
+	in := Instruction{Mnemonic: info.mnemonic, Mode: info.mode, Size: info.mode.Size(), Undocumented: info.undocumented}
+	if info.mnemonic == "" || info.undocumented && !undocumented || off+in.Size > len(code) {
+		return in, false
+	}
+	switch in.Size {
+	case 2:
+		in.Operand = int(code[off+1])
+	case 3:
+		in.Operand = int(code[off+1]) | int(code[off+2])<<8
+	}
+	if in.Mode == Relative {
+		in.Operand = origin + off + 2 + int(int8(code[off+1]))
+	}
+	return in, true
+}
+
+// Region is a stretch of data between the code.
+type Region struct {
+	Start, End int    // addresses, End exclusive
+	Type       string // "bytes", "words", "text" or "basic"
+	Name       string
+}
+
+// Listing lays code out as ca65 source.
+type Listing struct {
+	Origin       int
+	CPU          CPU
+	Labels       map[int]string // names of addresses
+	ZeroPage     map[int]string // names of zero page operands
+	Regions      []Region       // data; everything else is decoded as code
+	Entries      []int          // addresses labelled although nothing branches there
+	Undocumented bool           // decode undocumented opcodes instead of .byte
+	LabelJumps   bool           // also label JSR and JMP targets within the code
+	AutoLabel    string         // label format of an unnamed target, e.g. "L%04X"
+	LabelRule    string         // lines written before each code label
+}
+
+// region returns the data region holding addr, or nil.
+func (l *Listing) region(addr int) *Region {
+	for i := range l.Regions {
+		if addr >= l.Regions[i].Start && addr < l.Regions[i].End {
+			return &l.Regions[i]
+		}
+	}
+	return nil
+}
+
+// targets returns the addresses that get a label: branch targets, JSR and
+// JMP targets within the code if LabelJumps is set, and the entries.
+func (l *Listing) targets(code []byte) map[int]bool {
+	targets := make(map[int]bool)
+	for _, addr := range l.Entries {
+		targets[addr] = true
+	}
+	end := l.Origin + len(code)
+	for addr := l.Origin; addr < end; {
+		if r := l.region(addr); r != nil {
+			addr = r.End
+			continue
+		}
+		in, ok := l.CPU.Decode(code, addr-l.Origin, l.Origin, l.Undocumented)
+		if !ok {
+			addr++
+			continue
+		}
+		switch {
+		case in.Mode == Relative:
+			targets[in.Operand] = true
+		case l.LabelJumps && (in.Mnemonic == "jsr" || in.Mnemonic == "jmp" && in.Mode == Absolute):
+			if in.Operand >= l.Origin && in.Operand < end {
+				targets[in.Operand] = true
+			}
+		}
+		addr += in.Size
+	}
+	return targets
+}
+
+// Write returns the listing of code: a label line at every target, then
+// instructions, and the data regions as .byte, .word and string lines. A
+// BIT absolute whose operand is branched into is written as .byte $2C. Labels
+// used as operands but falling inside an instruction or a data line are
+// defined as equates at the end, relative to the label line before them so
+// that the listing still assembles anywhere.
+func (l *Listing) Write(code []byte) string {
+	targets := l.targets(code)
+	written, used := make(map[int]bool), make(map[int]bool)
+	name := func(addr int) (string, bool) {
+		if n, ok := l.Labels[addr]; ok {
+			return n, true
+		}
+		if targets[addr] {
+			return fmt.Sprintf(l.AutoLabel, addr), true
+		}
+		return "", false
+	}
+	address := func(addr int) string {
+		if n, ok := name(addr); ok {
+			used[addr] = true
+			return n
+		}
+		return fmt.Sprintf("$%04X", addr)
+	}
+	zp := func(addr int) string {
+		if n, ok := l.ZeroPage[addr]; ok {
+			return n
+		}
+		return fmt.Sprintf("$%02X", addr)
+	}
+
+	var sb strings.Builder
+	end := l.Origin + len(code)
+	for addr := l.Origin; addr < end; {
+		if r := l.region(addr); r != nil {
+			l.writeRegion(&sb, code, *r, name, written)
+			addr = r.End
+			continue
+		}
+		if targets[addr] {
+			n, _ := name(addr)
+			sb.WriteString(l.LabelRule)
+			sb.WriteString(n + ":\n")
+			written[addr] = true
+		}
+		in, ok := l.CPU.Decode(code, addr-l.Origin, l.Origin, l.Undocumented)
+		if in.Mnemonic == "bit" && in.Mode == Absolute && targets[addr+1] {
+			ok, in.Size = false, 1
+		}
+		if !ok {
+			comment := ""
+			if in.Mnemonic == "bit" {
+				comment = "     ; BIT abs opcode - skip next 2 bytes"
+			}
+			fmt.Fprintf(&sb, "        .byte   $%02X%s\n", code[addr-l.Origin], comment)
+			addr++
+			continue
+		}
+		var operand string
+		switch in.Mode {
+		case Accumulator:
+			operand = "a"
+		case Immediate:
+			operand = fmt.Sprintf("#$%02X", in.Operand)
+		case ZeroPage:
+			operand = zp(in.Operand)
+		case ZeroPageX:
+			operand = zp(in.Operand) + ",x"
+		case ZeroPageY:
+			operand = zp(in.Operand) + ",y"
+		case Absolute, Relative:
+			operand = address(in.Operand)
+		case AbsoluteX:
+			operand = address(in.Operand) + ",x"
+		case AbsoluteY:
+			operand = address(in.Operand) + ",y"
+		case Indirect:
+			operand = fmt.Sprintf("($%04X)", in.Operand)
+		case IndirectX:
+			operand = "(" + zp(in.Operand) + ",x)"
+		case IndirectY:
+			operand = "(" + zp(in.Operand) + "),y"
+		case ZeroPageIndirect:
+			operand = "(" + zp(in.Operand) + ")"
+		case AbsoluteIndirectX:
+			operand = "(" + address(in.Operand) + ",x)"
+		}
+		if operand == "" {
+			fmt.Fprintf(&sb, "        %s\n", in.Mnemonic)
+		} else {
+			fmt.Fprintf(&sb, "        %-8s%s\n", in.Mnemonic, operand)
+		}
+		addr += in.Size
+	}
+
+	// Operands pointing into an instruction or a data line get an equate
+	var missing []int
+	for addr := range used {
+		if !written[addr] {
+			missing = append(missing, addr)
+		}
+	}
+	sort.Ints(missing)
+	for _, addr := range missing {
+		n, _ := name(addr)
+		base := -1
+		for w := range written {
+			if w < addr && w > base {
+				base = w
+			}
+		}
+		if base < 0 {
+			fmt.Fprintf(&sb, "%-16s= $%04X\n", n, addr)
+			continue
+		}
+		b, _ := name(base)
+		fmt.Fprintf(&sb, "%-16s= %s+%d\n", n, b, addr-base)
+	}
+	return sb.String()
+}
+
+// writeRegion writes a data region under a header comment. Labels are
+// written where a line starts.
+func (l *Listing) writeRegion(sb *strings.Builder, code []byte, r Region, name func(int) (string, bool), written map[int]bool) {
+	rule := "; " + strings.Repeat("-", 70) + "\n"
+	fmt.Fprintf(sb, "\n%s; %s\n%s", rule, r.Name, rule)
+	data := code[r.Start-l.Origin : r.End-l.Origin]
+	label := func(i int) {
+		if n, ok := name(r.Start + i); ok {
+			sb.WriteString(n + ":\n")
+			written[r.Start+i] = true
+		}
+	}
+	hexBytes := func(b []byte) string {
+		s := make([]string, len(b))
+		for i, v := range b {
+			s[i] = fmt.Sprintf("$%02X", v)
+		}
+		return strings.Join(s, ", ")
+	}
+	printable := func(c byte) bool { return c >= 0x20 && c < 0x80 && c != '"' }
+
+	switch r.Type {
+	case "basic":
+		// One line: link, line number, token and its text, then the end link
+		label(0)
+		text := data[5 : len(data)-3]
+		token := "SYS token"
+		if data[4] != 0x9E {
+			token = "BASIC token"
+		}
+		fmt.Fprintf(sb, "        %-8s%-20s; %s\n", ".word", fmt.Sprintf("$%04X", int(data[0])|int(data[1])<<8), "Pointer to next BASIC line")
+		fmt.Fprintf(sb, "        %-8s%-20d; %s\n", ".word", int(data[2])|int(data[3])<<8, "Line number")
+		fmt.Fprintf(sb, "        %-8s%-20s; %s\n", ".byte", fmt.Sprintf("$%02X", data[4]), token)
+		fmt.Fprintf(sb, "        %-8s%-20s; %s\n", ".byte", `"`+string(text)+`"`, "SYS address + decoration")
+		fmt.Fprintf(sb, "        %-8s%-20s; %s\n", ".byte", fmt.Sprintf("$%02X", data[len(data)-3]), "End of line")
+		fmt.Fprintf(sb, "        %-8s%-20s; %s\n", ".word", fmt.Sprintf("$%04X", int(data[len(data)-2])|int(data[len(data)-1])<<8), "End of BASIC program")
+	case "text":
+		// Strings of more than three printable characters, hex otherwise,
+		// with CR and the terminating zero commented
+		for i := 0; i < len(data); {
+			label(i)
+			j := i
+			for j < len(data) && printable(data[j]) {
+				j++
+			}
+			if j-i > 3 {
+				fmt.Fprintf(sb, "        .byte   \"%s\"\n", data[i:j])
+				i = j
+			} else {
+				j = min(i+16, len(data))
+				fmt.Fprintf(sb, "        .byte   %s\n", hexBytes(data[i:j]))
+				i = j
+			}
+			for ; i < len(data) && (data[i] < 0x20 || data[i] >= 0x80); i++ {
+				switch data[i] {
+				case 0x0D:
+					sb.WriteString("        .byte   $0D                     ; CR\n")
+				case 0x00:
+					sb.WriteString("        .byte   $00                     ; End of string\n")
+				default:
+					fmt.Fprintf(sb, "        .byte   $%02X\n", data[i])
+				}
+			}
+		}
+	case "words":
+		for i := 0; i+1 < len(data); i += 2 {
+			label(i)
+			fmt.Fprintf(sb, "        .word   $%04X\n", int(data[i])|int(data[i+1])<<8)
+		}
+	default:
+		for i := 0; i < len(data); i += 16 {
+			label(i)
+			fmt.Fprintf(sb, "        .byte   %s\n", hexBytes(data[i:min(i+16, len(data))]))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package asm6502
+
+// Mode is a 6502 addressing mode.
+type Mode int
+
+const (
+	Implied           Mode = iota // rts
+	Accumulator                   // rol a
+	Immediate                     // lda #$80
+	ZeroPage                      // lda $02
+	ZeroPageX                     // lda $02,x
+	ZeroPageY                     // ldx $02,y
+	Absolute                      // lda $1000
+	AbsoluteX                     // lda $1000,x
+	AbsoluteY                     // lda $1000,y
+	Indirect                      // jmp ($FFFE)
+	IndirectX                     // lda ($02,x)
+	IndirectY                     // lda ($02),y
+	Relative                      // bne label
+	ZeroPageIndirect              // lda ($02), 65C02
+	AbsoluteIndirectX             // jmp ($1000,x), 65C02
+	numModes
+)
+
+// CPU selects the instruction set.
+type CPU int
+
+const (
+	CPU6502  CPU = iota // NMOS 6502
+	CPU65C02            // CMOS 65C02, without the Rockwell bit instructions
+)
+
+// Size returns the length in bytes of an instruction in mode m.
+func (m Mode) Size() int {
+	switch m {
+	case Implied, Accumulator:
+		return 1
+	case Absolute, AbsoluteX, AbsoluteY, Indirect, AbsoluteIndirectX:
+		return 3
+	}
+	return 2
+}
+
+// opcodes lists the documented NMOS 6502 instructions by mnemonic, with the
+// opcode of each addressing mode the instruction has.
+var opcodes = map[string]map[Mode]byte{
+	"adc": {Immediate: 0x69, ZeroPage: 0x65, ZeroPageX: 0x75, Absolute: 0x6D, AbsoluteX: 0x7D, AbsoluteY: 0x79, IndirectX: 0x61, IndirectY: 0x71},
+	"and": {Immediate: 0x29, ZeroPage: 0x25, ZeroPageX: 0x35, Absolute: 0x2D, AbsoluteX: 0x3D, AbsoluteY: 0x39, IndirectX: 0x21, IndirectY: 0x31},
+	"asl": {Accumulator: 0x0A, ZeroPage: 0x06, ZeroPageX: 0x16, Absolute: 0x0E, AbsoluteX: 0x1E},
+	"bcc": {Relative: 0x90},
+	"bcs": {Relative: 0xB0},
+	"beq": {Relative: 0xF0},
+	"bit": {ZeroPage: 0x24, Absolute: 0x2C},
+	"bmi": {Relative: 0x30},
+	"bne": {Relative: 0xD0},
+	"bpl": {Relative: 0x10},
+	"brk": {Implied: 0x00},
+	"bvc": {Relative: 0x50},
+	"bvs": {Relative: 0x70},
+	"clc": {Implied: 0x18},
+	"cld": {Implied: 0xD8},
+	"cli": {Implied: 0x58},
+	"clv": {Implied: 0xB8},
+	"cmp": {Immediate: 0xC9, ZeroPage: 0xC5, ZeroPageX: 0xD5, Absolute: 0xCD, AbsoluteX: 0xDD, AbsoluteY: 0xD9, IndirectX: 0xC1, IndirectY: 0xD1},
+	"cpx": {Immediate: 0xE0, ZeroPage: 0xE4, Absolute: 0xEC},
+	"cpy": {Immediate: 0xC0, ZeroPage: 0xC4, Absolute: 0xCC},
+	"dec": {ZeroPage: 0xC6, ZeroPageX: 0xD6, Absolute: 0xCE, AbsoluteX: 0xDE},
+	"dex": {Implied: 0xCA},
+	"dey": {Implied: 0x88},
+	"eor": {Immediate: 0x49, ZeroPage: 0x45, ZeroPageX: 0x55, Absolute: 0x4D, AbsoluteX: 0x5D, AbsoluteY: 0x59, IndirectX: 0x41, IndirectY: 0x51},
+	"inc": {ZeroPage: 0xE6, ZeroPageX: 0xF6, Absolute: 0xEE, AbsoluteX: 0xFE},
+	"inx": {Implied: 0xE8},
+	"iny": {Implied: 0xC8},
+	"jmp": {Absolute: 0x4C, Indirect: 0x6C},
+	"jsr": {Absolute: 0x20},
+	"lda": {Immediate: 0xA9, ZeroPage: 0xA5, ZeroPageX: 0xB5, Absolute: 0xAD, AbsoluteX: 0xBD, AbsoluteY: 0xB9, IndirectX: 0xA1, IndirectY: 0xB1},
+	"ldx": {Immediate: 0xA2, ZeroPage: 0xA6, ZeroPageY: 0xB6, Absolute: 0xAE, AbsoluteY: 0xBE},
+	"ldy": {Immediate: 0xA0, ZeroPage: 0xA4, ZeroPageX: 0xB4, Absolute: 0xAC, AbsoluteX: 0xBC},
+	"lsr": {Accumulator: 0x4A, ZeroPage: 0x46, ZeroPageX: 0x56, Absolute: 0x4E, AbsoluteX: 0x5E},
+	"nop": {Implied: 0xEA},
+	"ora": {Immediate: 0x09, ZeroPage: 0x05, ZeroPageX: 0x15, Absolute: 0x0D, AbsoluteX: 0x1D, AbsoluteY: 0x19, IndirectX: 0x01, IndirectY: 0x11},
+	"pha": {Implied: 0x48},
+	"php": {Implied: 0x08},
+	"pla": {Implied: 0x68},
+	"plp": {Implied: 0x28},
+	"rol": {Accumulator: 0x2A, ZeroPage: 0x26, ZeroPageX: 0x36, Absolute: 0x2E, AbsoluteX: 0x3E},
+	"ror": {Accumulator: 0x6A, ZeroPage: 0x66, ZeroPageX: 0x76, Absolute: 0x6E, AbsoluteX: 0x7E},
+	"rti": {Implied: 0x40},
+	"rts": {Implied: 0x60},
+	"sbc": {Immediate: 0xE9, ZeroPage: 0xE5, ZeroPageX: 0xF5, Absolute: 0xED, AbsoluteX: 0xFD, AbsoluteY: 0xF9, IndirectX: 0xE1, IndirectY: 0xF1},
+	"sec": {Implied: 0x38},
+	"sed": {Implied: 0xF8},
+	"sei": {Implied: 0x78},
+	"sta": {ZeroPage: 0x85, ZeroPageX: 0x95, Absolute: 0x8D, AbsoluteX: 0x9D, AbsoluteY: 0x99, IndirectX: 0x81, IndirectY: 0x91},
+	"stx": {ZeroPage: 0x86, ZeroPageY: 0x96, Absolute: 0x8E},
+	"sty": {ZeroPage: 0x84, ZeroPageX: 0x94, Absolute: 0x8C},
+	"tax": {Implied: 0xAA},
+	"tay": {Implied: 0xA8},
+	"tsx": {Implied: 0xBA},
+	"txa": {Implied: 0x8A},
+	"txs": {Implied: 0x9A},
+	"tya": {Implied: 0x98},
+}
+
+// undocumented lists the stable and unstable undocumented NMOS opcodes under
+// their ca65 6502X names. Several have more than one opcode per mode; the
+// disassembler decodes them all and the assembler does not accept them.
+var undocumented = map[string]map[Mode][]byte{
+	"alr": {Immediate: {0x4B}},
+	"anc": {Immediate: {0x0B, 0x2B}},
+	"ane": {Immediate: {0x8B}},
+	"arr": {Immediate: {0x6B}},
+	"axs": {Immediate: {0xCB}},
+	"dcp": {ZeroPage: {0xC7}, ZeroPageX: {0xD7}, Absolute: {0xCF}, AbsoluteX: {0xDF}, AbsoluteY: {0xDB}, IndirectX: {0xC3}, IndirectY: {0xD3}},
+	"isc": {ZeroPage: {0xE7}, ZeroPageX: {0xF7}, Absolute: {0xEF}, AbsoluteX: {0xFF}, AbsoluteY: {0xFB}, IndirectX: {0xE3}, IndirectY: {0xF3}},
+	"jam": {Implied: {0x02, 0x12, 0x22, 0x32, 0x42, 0x52, 0x62, 0x72, 0x92, 0xB2, 0xD2, 0xF2}},
+	"las": {AbsoluteY: {0xBB}},
+	"lax": {Immediate: {0xAB}, ZeroPage: {0xA7}, ZeroPageY: {0xB7}, Absolute: {0xAF}, AbsoluteY: {0xBF}, IndirectX: {0xA3}, IndirectY: {0xB3}},
+	"nop": {Implied: {0x1A, 0x3A, 0x5A, 0x7A, 0xDA, 0xFA}, Immediate: {0x80, 0x82, 0x89, 0xC2, 0xE2}, ZeroPage: {0x04, 0x44, 0x64}, ZeroPageX: {0x14, 0x34, 0x54, 0x74, 0xD4, 0xF4}, Absolute: {0x0C}, AbsoluteX: {0x1C, 0x3C, 0x5C, 0x7C, 0xDC, 0xFC}},
+	"rla": {ZeroPage: {0x27}, ZeroPageX: {0x37}, Absolute: {0x2F}, AbsoluteX: {0x3F}, AbsoluteY: {0x3B}, IndirectX: {0x23}, IndirectY: {0x33}},
+	"rra": {ZeroPage: {0x67}, ZeroPageX: {0x77}, Absolute: {0x6F}, AbsoluteX: {0x7F}, AbsoluteY: {0x7B}, IndirectX: {0x63}, IndirectY: {0x73}},
+	"sax": {ZeroPage: {0x87}, ZeroPageY: {0x97}, Absolute: {0x8F}, IndirectX: {0x83}},
+	"sbc": {Immediate: {0xEB}},
+	"sha": {AbsoluteY: {0x9F}, IndirectY: {0x93}},
+	"shx": {AbsoluteY: {0x9E}},
+	"shy": {AbsoluteX: {0x9C}},
+	"slo": {ZeroPage: {0x07}, ZeroPageX: {0x17}, Absolute: {0x0F}, AbsoluteX: {0x1F}, AbsoluteY: {0x1B}, IndirectX: {0x03}, IndirectY: {0x13}},
+	"sre": {ZeroPage: {0x47}, ZeroPageX: {0x57}, Absolute: {0x4F}, AbsoluteX: {0x5F}, AbsoluteY: {0x5B}, IndirectX: {0x43}, IndirectY: {0x53}},
+	"tas": {AbsoluteY: {0x9B}},
+}
+
+// cmos lists what the 65C02 adds to the documented instructions: new
+// instructions and new addressing modes of old ones. It reuses opcodes that
+// are undocumented on the NMOS 6502.
+var cmos = map[string]map[Mode]byte{
+	"adc": {ZeroPageIndirect: 0x72},
+	"and": {ZeroPageIndirect: 0x32},
+	"bit": {Immediate: 0x89, ZeroPageX: 0x34, AbsoluteX: 0x3C},
+	"bra": {Relative: 0x80},
+	"cmp": {ZeroPageIndirect: 0xD2},
+	"dec": {Accumulator: 0x3A},
+	"eor": {ZeroPageIndirect: 0x52},
+	"inc": {Accumulator: 0x1A},
+	"jmp": {AbsoluteIndirectX: 0x7C},
+	"lda": {ZeroPageIndirect: 0xB2},
+	"ora": {ZeroPageIndirect: 0x12},
+	"phx": {Implied: 0xDA},
+	"phy": {Implied: 0x5A},
+	"plx": {Implied: 0xFA},
+	"ply": {Implied: 0x7A},
+	"sbc": {ZeroPageIndirect: 0xF2},
+	"sta": {ZeroPageIndirect: 0x92},
+	"stz": {ZeroPage: 0x64, ZeroPageX: 0x74, Absolute: 0x9C, AbsoluteX: 0x9E},
+	"trb": {ZeroPage: 0x14, Absolute: 0x1C},
+	"tsb": {ZeroPage: 0x04, Absolute: 0x0C},
+}
+
+// modes returns the addressing modes of mnemonic on cpu with their opcodes.
+func (c CPU) modes(mnemonic string) (map[Mode]byte, bool) {
+	modes, ok := opcodes[mnemonic]
+	extra, isCMOS := cmos[mnemonic]
+	if c != CPU65C02 || !isCMOS {
+		return modes, ok
+	}
+	all := make(map[Mode]byte, len(modes)+len(extra))
+	for mode, op := range modes {
+		all[mode] = op
+	}
+	for mode, op := range extra {
+		all[mode] = op
+	}
+	return all, true
+}
+
+// opcodeInfo is what an opcode decodes to.
+type opcodeInfo struct {
+	mnemonic     string
+	mode         Mode
+	undocumented bool
+}
+
+// decodeTable maps every opcode to its instruction; all 256 are filled.
+var decodeTable = func() (t [256]opcodeInfo) {
+	for mnemonic, modes := range opcodes {
+		for mode, op := range modes {
+			t[op] = opcodeInfo{mnemonic, mode, false}
+		}
+	}
+	for mnemonic, modes := range undocumented {
+		for mode, ops := range modes {
+			for _, op := range ops {
+				t[op] = opcodeInfo{mnemonic, mode, true}
+			}
+		}
+	}
+	return t
+}()
+
+// decodeTable65C02 maps the opcodes the 65C02 defines to their instructions.
+// The others are NOPs of various lengths there and are left empty.
+var decodeTable65C02 = func() (t [256]opcodeInfo) {
+	for _, set := range []map[string]map[Mode]byte{opcodes, cmos} {
+		for mnemonic, modes := range set {
+			for mode, op := range modes {
+				t[op] = opcodeInfo{mnemonic, mode, false}
+			}
+		}
+	}
+	return t
+}()
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"compress/asm6502"
+)
+
+// asmSyntax is an assembler the decoder include can be written for. Every
+// syntax is written from the same ca65 listing, so the labels and the code
+// are the same in all of them; only the scoping and the spelling differ.
+type asmSyntax struct {
+	name    string
+	comment string // starts a comment running to the end of the line
+	cpu     string // selects the 65C02
+	open    string // opens the scope of decompress and labels its first byte
+	close   string // closes it
+	local   string // prefix of the labels inside the scope
+	colon   string // follows a label definition
+	equate  string // starts an equate
+	data    string // the byte directive
+	acc     string // operand of accumulator mode
+}
+
+// asmSyntaxes are the syntaxes -asm -syntax writes, ca65 first. The
+// labels the caller uses stay global in ACME, whose zone hides the dotted
+// labels; the others reach them through the scope, e.g.
+// decompress::crc_verify in ca65 and decompress.crc_verify in KickAssembler
+// and 64tass.
+var asmSyntaxes = []*asmSyntax{
+	{name: "ca65", comment: ";", cpu: `.setcpu "65C02"`, open: ".proc decompress", close: ".endproc", colon: ":", data: ".byte", acc: "a"},
+	{name: "acme", comment: ";", cpu: "!cpu 65c02", open: "!zone decompress {\ndecompress", close: "}", local: ".", data: "!byte"},
+	{name: "kick", comment: "//", cpu: ".cpu _65c02", open: "decompress: {", close: "}", colon: ":", equate: ".label ", data: ".byte"},
+	{name: "64tass", comment: ";", cpu: `.cpu "65c02"`, open: "decompress .block", close: ".bend", data: ".byte", acc: "a"},
+}
+
+// findSyntax returns the syntax called name, or nil.
+func findSyntax(name string) *asmSyntax {
+	for _, s := range asmSyntaxes {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// decoderEntries are the labels the caller uses: the entries, and the
+// pointers of the self-modifying profile.
+var decoderEntries = []string{"decompress_slice", "crc_verify", "src_lo", "src_hi", "out_lo", "out_hi"}
+
+var symbolRE = regexp.MustCompile(`\b[A-Za-z_]\w*`)
+
+// decoderInclude returns the decoder placed as in p as an include in syntax
+// s: its size, the zero page it uses and the routine. The bytes the caller
+// sets up are commented out, to be defined by the caller.
+func decoderInclude(p decoderProfile, s *asmSyntax) string {
+	p = p.placed()
+	code, labelMap := genDecompressor(p)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s Size: %d bytes\n", s.comment, len(code))
+	fmt.Fprintf(&sb, "%s External zero page variables (must be defined by caller)\n", s.comment)
+	slots, external := p.zpSlots()
+	for i, z := range slots {
+		if i == external {
+			fmt.Fprintf(&sb, "\n%s Internal zero page variables\n", s.comment)
+		}
+		line := fmt.Sprintf("%s%-16s= $%02X", s.equate, z.name, z.addr)
+		if i < external {
+			line = s.comment + " " + line
+		}
+		if z.comment != "" {
+			line += "   " + s.comment + " " + z.comment
+		}
+		sb.WriteString(line + "\n")
+	}
+	if p.smc {
+		fmt.Fprintf(&sb, "%s src_lo/src_hi and out_lo/out_hi are operands in decompress\n", s.comment)
+	}
+	sb.WriteString("\n")
+	if p.cmos {
+		sb.WriteString(s.cpu + "\n")
+	}
+	sb.WriteString(decoderRoutine(p, code, labelMap, s))
+	return sb.String()
+}
+
+// decoderRoutine returns the decoder's code in syntax s, scoped as the
+// routine decompress.
+func decoderRoutine(p decoderProfile, code []byte, labelMap map[string]int, s *asmSyntax) string {
+	lines := strings.Split(strings.TrimSuffix(decoderListing(p, labelMap).Write(code), "\n"), "\n")
+
+	// The labels of the listing: label lines, and the equates at the end
+	// for operands pointing into an instruction
+	local := make(map[string]bool)
+	for _, line := range lines {
+		if name, ok := strings.CutSuffix(line, ":"); ok {
+			local[name] = true
+		} else if name, _, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(line, " ") {
+			local[strings.TrimSpace(name)] = true
+		}
+	}
+	for _, name := range decoderEntries {
+		delete(local, name)
+	}
+	symbol := func(name string) string {
+		if local[name] {
+			return s.local + name
+		}
+		return name
+	}
+
+	var sb strings.Builder
+	sb.WriteString(s.open + "\n")
+	for _, line := range lines {
+		if name, ok := strings.CutSuffix(line, ":"); ok {
+			sb.WriteString(symbol(name) + s.colon + "\n")
+			continue
+		}
+		if name, value, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(line, " ") {
+			value = symbolRE.ReplaceAllStringFunc(value, symbol)
+			fmt.Fprintf(&sb, "%s%-16s=%s\n", s.equate, symbol(strings.TrimSpace(name)), value)
+			continue
+		}
+		ins, comment, _ := strings.Cut(strings.TrimSpace(line), ";")
+		fields := strings.Fields(ins)
+		mnemonic, operand := fields[0], strings.Join(fields[1:], " ")
+		switch {
+		case mnemonic == ".byte":
+			mnemonic = s.data
+		case operand == "a":
+			operand = s.acc
+		default:
+			operand = symbolRE.ReplaceAllStringFunc(operand, symbol)
+		}
+		out := "        " + mnemonic
+		if operand != "" {
+			out = fmt.Sprintf("        %-8s%s", mnemonic, operand)
+		}
+		if comment != "" {
+			out = fmt.Sprintf("%-24s%s%s", out, s.comment, comment)
+		}
+		sb.WriteString(out + "\n")
+	}
+	sb.WriteString(s.close + "\n")
+	return sb.String()
+}
+
+// assembleInclude reads an include written by decoderInclude in syntax s
+// back into the built-in assembler and returns the code, with the zero page
+// bytes the caller defines taken from p. It checks the include's structure:
+// the scope, the label spelling and the directives must all be the ones s
+// writes, or the line is reported.
+func assembleInclude(src string, p decoderProfile, s *asmSyntax) ([]byte, error) {
+	p = p.placed()
+	a := asm6502.New(p.origin)
+	slots, external := p.zpSlots()
+	for _, z := range slots[:external] {
+		a.Equ(z.name, z.addr)
+	}
+	local := `(?:` + regexp.QuoteMeta(s.local) + `)?`
+	name := `([A-Za-z_]\w*)`
+	labelRE := regexp.MustCompile(`^` + local + name + regexp.QuoteMeta(s.colon) + `$`)
+	equateRE := regexp.MustCompile(`^` + regexp.QuoteMeta(s.equate) + local + name + ` *= \$([0-9A-F]+)$`)
+	aliasRE := regexp.MustCompile(`^` + regexp.QuoteMeta(s.equate) + local + name + ` *= ` + local + name + `\+([0-9]+)$`)
+	open := strings.Split(s.open, "\n")
+	opened, closed := 0, false
+
+	lines := strings.Split(src, "\n")
+	for i, line := range lines {
+		if j := strings.Index(line, s.comment); j >= 0 {
+			line = line[:j]
+		}
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	// Equates relative to a label, e.g. for an operand inside an
+	// instruction, are replaced by their expression where they are used
+	alias := make(map[string]string)
+	for _, line := range lines {
+		if m := aliasRE.FindStringSubmatch(line); m != nil {
+			alias[m[1]] = m[2] + "+" + m[3]
+		}
+	}
+
+	for n, line := range lines {
+		if line == "" || aliasRE.MatchString(line) {
+			continue
+		}
+		if closed {
+			return nil, fmt.Errorf("line %d: %q after the end of the routine", n+1, line)
+		}
+		switch {
+		case line == s.cpu:
+			a.SetCPU(asm6502.CPU65C02)
+		case equateRE.MatchString(line):
+			m := equateRE.FindStringSubmatch(line)
+			v, _ := strconv.ParseUint(m[2], 16, 16)
+			a.Equ(m[1], int(v))
+		case opened < len(open):
+			if line != open[opened] {
+				return nil, fmt.Errorf("line %d: %q instead of %q", n+1, line, open[opened])
+			}
+			if opened++; opened == len(open) {
+				a.Label("decompress")
+			}
+		case line == s.close:
+			closed = true
+		case strings.HasPrefix(line, " "):
+			fields := strings.Fields(line)
+			operand := strings.Join(fields[1:], "")
+			if fields[0] == s.data {
+				for _, v := range strings.Split(operand, ",") {
+					b, err := strconv.ParseUint(strings.TrimPrefix(v, "$"), 16, 8)
+					if err != nil || !strings.HasPrefix(v, "$") {
+						return nil, fmt.Errorf("line %d: bad byte %q", n+1, v)
+					}
+					a.Byte(byte(b))
+				}
+				continue
+			}
+			if s.local != "" {
+				operand = strings.ReplaceAll(operand, s.local, "")
+			}
+			operand = symbolRE.ReplaceAllStringFunc(operand, func(name string) string {
+				if expr, ok := alias[name]; ok {
+					return expr
+				}
+				return name
+			})
+			a.Ins("%s", strings.TrimSpace(fields[0]+" "+operand))
+		case labelRE.MatchString(line):
+			a.Label(labelRE.FindStringSubmatch(line)[1])
+		default:
+			return nil, fmt.Errorf("line %d: %q is not %s", n+1, line, s.name)
+		}
+	}
+	if !closed {
+		return nil, fmt.Errorf("the routine is not closed with %q", s.close)
+	}
+	code, _, err := a.Assemble()
+	return code, err
+}
+
+// syntaxNames lists the syntaxes for usage messages.
+func syntaxNames() string {
+	names := make([]string, len(asmSyntaxes))
+	for i, s := range asmSyntaxes {
+		names[i] = s.name
+	}
+	return strings.Join(names, "|")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"compress/codec"
+)
+
+// Backward (end-to-start) variant
+//
+// Each song is compressed on its own and decoded from its last byte down to its
+// first, reading the byte-reversed stream from high to low addresses. The stream
+// can then sit at the bottom of the song's own buffer (the end the decoder reaches
+// last), starting inPlaceGap bytes below the buffer base: the write pointer never
+// catches up with an unread stream byte.
+
+type backwardResult struct {
+	song     int
+	stream   []byte // in memory order (byte-reversed), load at base-gap
+	bitCount int
+	gap      int
+	verified bool
+	err      error
+}
+
+// maxBackwardRounds bounds the compressions compressSongBackward tries.
+const maxBackwardRounds = 16
+
+// compressSongBackward compresses one song, growing the reserved stream region
+// until the compressed data and its safety gap fit inside it. It gives up when
+// the region outgrows the buffer or after maxBackwardRounds compressions.
+func compressSongBackward(target []byte, opts codec.Options) ([]byte, int, int, error) {
+	reserved := len(target)/8 + 64
+	gapReserved := 8
+	for round := 0; round < maxBackwardRounds; round++ {
+		compressed, bitCount, stats := codec.CompressBackward(target, opts, reserved, gapReserved)
+		gap := codec.InPlaceGap(len(compressed), len(target), stats)
+		if gap <= gapReserved && len(compressed)-gap <= reserved-gapReserved {
+			return compressed, bitCount, gap, nil
+		}
+		gapReserved = max(gapReserved, gap)
+		reserved = len(compressed) + gapReserved + 64
+		if reserved > opts.BufferSize {
+			return nil, 0, 0, fmt.Errorf("stream and gap need %d bytes, more than the buffer", reserved)
+		}
+	}
+	return nil, 0, 0, fmt.Errorf("no stream region fits after %d rounds (gap %d)", maxBackwardRounds, gapReserved)
+}
+
+func backwardMain() {
+	// Past the output buffer the backward decoder wraps around the ring,
+	// which reaches the previous song's buffer only with two buffers
+	if n := len(project.Buffers.Bases); n != 2 {
+		fmt.Fprintf(os.Stderr, "Error: the backward decoder needs two buffers, the manifest has %d\n", n)
+		os.Exit(1)
+	}
+	songs, err := loadSongs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	states := computeBufferStates(songs)
+	scratch, err := discoverScratchMap(songs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("V23 Backward Delta Compression (Go)")
+	fmt.Println("===================================")
+
+	var wg sync.WaitGroup
+	results := make(chan backwardResult, len(project.Songs.Playlist))
+	for _, song := range project.Songs.Playlist {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			target := songs[s]
+			selfDict, otherDict := songDicts(s, states)
+			opts := songOptions(s, scratch, selfDict, otherDict)
+			compressed, bitCount, gap, err := compressSongBackward(target, opts)
+			if err != nil {
+				results <- backwardResult{song: s, err: err}
+				return
+			}
+			decompressed, err := codec.DecompressBackward(compressed, opts, len(target))
+			verified := err == nil && bytes.Equal(decompressed, target)
+			results <- backwardResult{s, codec.Reversed(compressed), bitCount, gap, verified, nil}
+		}(song)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Songs finish out of order; each is reported as it does
+	start := time.Now()
+	resultMap := make(map[int]backwardResult)
+	failed := false
+	for r := range results {
+		resultMap[r.song] = r
+		elapsed := time.Since(start).Round(time.Second)
+		if r.err != nil {
+			fmt.Printf("  song %d: %v (%v)\n", r.song, r.err, elapsed)
+			failed = true
+			continue
+		}
+		fmt.Printf("  song %d: %d bytes, gap %d (%v)\n", r.song, len(r.stream), r.gap, elapsed)
+	}
+	if failed {
+		fmt.Fprintln(os.Stderr, "Error: some songs did not compress")
+		os.Exit(1)
+	}
+	fmt.Println()
+
+	os.MkdirAll(project.Outputs.Build, 0755)
+	allVerified := true
+	total := 0
+	for _, song := range project.Songs.Playlist {
+		r := resultMap[song]
+		base := songBase(song)
+		status := "OK"
+		if !r.verified {
+			status = "FAIL"
+			allVerified = false
+		}
+		total += len(r.stream)
+		fmt.Printf("Song %d -> $%04X: %d -> %d bytes, gap %d, stream $%04X-$%04X [%s]\n",
+			song, base, len(songs[song]), len(r.stream), r.gap,
+			base-r.gap, base-r.gap+len(r.stream)-1, status)
+		os.WriteFile(filepath.Join(project.Outputs.Build, fmt.Sprintf("d%d_backward.bin", song)), r.stream, 0644)
+	}
+	fmt.Printf("\nTotal: %d bytes\n", total)
+
+	asmPath := filepath.Join(project.Outputs.Build, "decompress_backward.asm")
+	content := fmt.Sprintf("; Size: %d bytes\n%s", len(GetBackwardDecompressorCode()), GetBackwardDecompressorAsm())
+	os.WriteFile(asmPath, []byte(content), 0644)
+	fmt.Printf("Backward decompressor: %d bytes -> %s\n\n", len(GetBackwardDecompressorCode()), asmPath)
+
+	if !allVerified {
+		fmt.Println("Verification: FAILED")
+		os.Exit(1)
+	}
+	if err := testBackwardDecompressor(songs, scratch, resultMap); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// testBackwardDecompressor decodes the whole chain in the VM, each song from its
+// stream placed at the bottom of its own buffer, and checks that no write ever
+// lands on a stream byte the decoder has not loaded yet.
+func testBackwardDecompressor(songs map[int][]byte, scratch scratchMap, results map[int]backwardResult) error {
+	fmt.Println("6502 Backward Decompressor Test (in-place)")
+	fmt.Println("-------------------------------------------")
+
+	cpu := NewCPU6502()
+	cpu.LoadAt(decoderOrigin, GetBackwardDecompressorCode())
+
+	validator := NewMemoryValidator(scratch)
+	var streamLo, streamHi uint16
+	var overruns []string
+	cpu.OnRead = func(addr uint16) {
+		validator.ValidateRead(addr)
+	}
+	cpu.OnWrite = func(addr uint16) {
+		validator.MarkWritten(addr)
+		// Bytes from the stream bottom up to zp_src have not been loaded yet
+		src := uint16(cpu.Mem[zpSrcLo]) | uint16(cpu.Mem[zpSrcHi])<<8
+		if addr >= streamLo && addr <= src && addr <= streamHi {
+			overruns = append(overruns, fmt.Sprintf("Song %d: write to $%04X overtakes unread stream (zp_src=$%04X)",
+				validator.currentSong, addr, src))
+		}
+	}
+
+	allPassed := true
+	var totalViolations []string
+	for _, song := range project.Songs.Playlist {
+		r := results[song]
+		target := songs[song]
+		base := songBase(song)
+
+		validator.InitForSong(song, songs)
+		streamLo = uint16(base - r.gap)
+		streamHi = streamLo + uint16(len(r.stream)) - 1
+		cpu.LoadAt(streamLo, r.stream)
+		validator.ProtectRange(streamLo, streamHi)
+
+		last := uint16(base + len(target) - 1)
+		cpu.Mem[zpSrcLo] = byte(streamHi)
+		cpu.Mem[zpSrcHi] = byte(streamHi >> 8)
+		cpu.Mem[zpBitBuf] = 0x80
+		cpu.Mem[zpOutLo] = byte(last)
+		cpu.Mem[zpOutHi] = byte(last >> 8)
+
+		pushReturn(cpu, decoderOrigin)
+		if err := cpu.Run(4000000); err != nil {
+			fmt.Printf("Song %d: RUNTIME ERROR: %v\n", song, err)
+			allPassed = false
+			continue
+		}
+		if !cpu.Halted {
+			fmt.Printf("Song %d: TIMEOUT\n", song)
+			allPassed = false
+			continue
+		}
+		totalViolations = append(totalViolations, validator.Violations()...)
+
+		output := cpu.Mem[base : base+len(target)]
+		if bytes.Equal(output, target) {
+			fmt.Printf("Song %d: PASS (%d bytes, %d cycles, gap %d)\n", song, len(target), cpu.Cycles, r.gap)
+		} else {
+			firstDiff := 0
+			for output[firstDiff] == target[firstDiff] {
+				firstDiff++
+			}
+			fmt.Printf("Song %d: FAIL at offset %d (got $%02X, want $%02X)\n",
+				song, firstDiff, output[firstDiff], target[firstDiff])
+			allPassed = false
+		}
+	}
+
+	totalViolations = append(totalViolations, overruns...)
+	if len(totalViolations) > 0 {
+		fmt.Printf("\nMemory access violations: %d\n", len(totalViolations))
+		for i, v := range totalViolations {
+			fmt.Printf("  %s\n", v)
+			if i >= 9 {
+				fmt.Printf("  ... and %d more\n", len(totalViolations)-10)
+				break
+			}
+		}
+		allPassed = false
+	} else {
+		fmt.Println("\nMemory access and in-place gap validation: PASSED")
+	}
+
+	if !allPassed {
+		return fmt.Errorf("some tests failed")
+	}
+	fmt.Println("\nAll tests PASSED!")
+	return nil
+}
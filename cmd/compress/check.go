@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Memory budget check: every region the program occupies while the streams
+// decode, derived from the manifest, the generated streams and seek tables,
+// the decoder generator and the loader's source, config and build. -check
+// fails on any overlap or overflow and prints the free memory at each step.
+
+// memRegion is the address range [Start, End) and what occupies it.
+type memRegion struct {
+	Start, End int
+	Name       string
+}
+
+func (r memRegion) String() string {
+	return fmt.Sprintf("$%04X-$%04X", r.Start, r.End-1)
+}
+
+func (r memRegion) size() int {
+	return r.End - r.Start
+}
+
+// intersect returns the bytes two regions share.
+func (r memRegion) intersect(o memRegion) (memRegion, bool) {
+	x := memRegion{Start: max(r.Start, o.Start), End: min(r.End, o.End)}
+	return x, x.Start < x.End
+}
+
+// gap returns the bytes between two disjoint regions.
+func (r memRegion) gap(o memRegion) int {
+	if o.Start >= r.End {
+		return o.Start - r.End
+	}
+	return r.Start - o.End
+}
+
+// zpDefinition matches a zero page equate of the loader source.
+var zpDefinition = regexp.MustCompile(`^(zp_\w+)\s*=\s*\$([0-9A-Fa-f]{2})\b`)
+
+// loaderZeroPage returns the zero page the loader source defines, in ranges
+// of consecutive addresses. The slots of the decoder zero page z are left
+// out: the loader names them to pass the decoder its arguments.
+func loaderZeroPage(path string, z decoderZP) ([]memRegion, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	decoder := make(map[int]bool)
+	for _, s := range z.slots(false, false) {
+		decoder[s.addr] = true
+	}
+	var used [0x100]bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := zpDefinition.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		addr, _ := strconv.ParseUint(m[2], 16, 8)
+		if !decoder[int(addr)] {
+			used[addr] = true
+		}
+	}
+	return zpRanges(used, "zero page (loader)"), scanner.Err()
+}
+
+// zpRanges returns the used zero page bytes as ranges of consecutive
+// addresses.
+func zpRanges(used [0x100]bool, name string) []memRegion {
+	var regions []memRegion
+	for addr := 0; addr < len(used); addr++ {
+		if !used[addr] {
+			continue
+		}
+		r := memRegion{addr, addr, name}
+		for r.End < len(used) && used[r.End] {
+			r.End++
+		}
+		regions = append(regions, r)
+		addr = r.End
+	}
+	return regions
+}
+
+// configRAM matches the RAM area of an ld65 config.
+var configRAM = regexp.MustCompile(`RAM:\s*start\s*=\s*\$([0-9A-Fa-f]+),\s*size\s*=\s*\$([0-9A-Fa-f]+)`)
+
+// loadArea returns the RAM area the ld65 config links the program into.
+func loadArea(path string) (memRegion, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return memRegion{}, err
+	}
+	m := configRAM.FindSubmatch(data)
+	if m == nil {
+		return memRegion{}, fmt.Errorf("%s: no RAM area", path)
+	}
+	start, _ := strconv.ParseUint(string(m[1]), 16, 32)
+	size, _ := strconv.ParseUint(string(m[2]), 16, 32)
+	return memRegion{int(start), int(start + size), "RAM area"}, nil
+}
+
+// budgetCheck collects the findings of -check.
+type budgetCheck struct {
+	errors  []string
+	notes   []string
+	streams int // program address of the stream pieces, 0 if not built
+}
+
+func (c *budgetCheck) fail(format string, args ...any) {
+	c.errors = append(c.errors, fmt.Sprintf(format, args...))
+}
+
+// overlaps fails for every byte range two lists of regions share.
+func (c *budgetCheck) overlaps(a, b []memRegion, what string) {
+	for _, r := range a {
+		for _, o := range b {
+			if x, ok := r.intersect(o); ok {
+				c.fail("%s %s overlaps %s %s at %s%s", r.Name, r, o.Name, o, x, what)
+			}
+		}
+	}
+}
+
+// sourceRegions returns what stays occupied through every step as the
+// sources place it: zero page, stack, screen, the load area up to the
+// decoder as code, the decoder and the IRQ vector. The decoder's zero page
+// and load address are those of the one the player links. The compressor
+// plans the stream layout around these, so its output does not depend on a
+// build.
+func sourceRegions() ([]memRegion, error) {
+	p := decoderProfile{}.placed()
+	var slots [0x100]bool
+	for _, s := range p.zp.slots(false, false) {
+		slots[s.addr] = true
+	}
+	regions := append([]memRegion{{0x00, 0x02, "processor port"}}, zpRanges(slots, "zero page (decoder)")...)
+	zp, err := loaderZeroPage(project.Program.Source, p.zp)
+	if err != nil {
+		return nil, err
+	}
+	regions = append(regions, zp...)
+	regions = append(regions, memRegion{0x0100, 0x0200, "stack"}, memRegion{0x0400, 0x0800, "screen"})
+
+	area, err := loadArea(project.Program.Config)
+	if err != nil {
+		return nil, err
+	}
+	code, _ := genDecompressor(p)
+	regions = append(regions, memRegion{area.Start, p.origin, "code"},
+		memRegion{p.origin, p.origin + len(code), "decoder"})
+	return append(regions, memRegion{0xFFFE, 0x10000, "IRQ vector"}), nil
+}
+
+// fixedRegions returns the regions -check holds the streams against. Once
+// built, the code and the decoder linked into it come from the program, whose
+// last streamBytes are the stream pieces stream.inc appends; without a build
+// they are the source regions.
+func (c *budgetCheck) fixedRegions(streamBytes int) ([]memRegion, error) {
+	regions, err := sourceRegions()
+	if err != nil {
+		return nil, err
+	}
+	const vectors = "NMI and reset vectors ($FFFA-$FFFD) are not reserved: the loader installs only the IRQ vector"
+	prg, err := os.ReadFile(project.Program.PRG)
+	if err != nil || len(prg) <= 2 {
+		for _, r := range regions {
+			if r.Name == "code" {
+				c.notes = append(c.notes, fmt.Sprintf("%s not built: code taken as %s, the load area up to the decoder", project.Program.PRG, r))
+			}
+		}
+		c.notes = append(c.notes, vectors)
+		return regions, nil
+	}
+
+	area, err := loadArea(project.Program.Config)
+	if err != nil {
+		return nil, err
+	}
+	load := int(prg[0]) | int(prg[1])<<8
+	image := memRegion{load, load + len(prg) - 2, "program"}
+	code := memRegion{load, image.End - streamBytes, "code"}
+	c.notes = append(c.notes, fmt.Sprintf("decoder: %d bytes, linked into the code", len(GetDecompressorCode())))
+	if image.Start < area.Start || image.End > area.End {
+		c.fail("program %s does not fit the %s %s of %s", image, area.Name, area, project.Program.Config)
+	}
+	c.streams = code.End
+	built := regions[:0]
+	for _, r := range regions {
+		switch r.Name {
+		case "code":
+			built = append(built, code)
+		case "decoder":
+		default:
+			built = append(built, r)
+		}
+	}
+	c.notes = append(c.notes, vectors)
+	return built, nil
+}
+
+// checkCopies checks the moves copy_streams makes at startup: the main piece
+// first, then the tail, each copied from the top down.
+func (c *budgetCheck) checkCopies(streams int, main, tail []byte) {
+	tailSrc := memRegion{streams, streams + len(tail), "tail stream in the program"}
+	mainSrc := memRegion{tailSrc.End, tailSrc.End + len(main), "main stream in the program"}
+	mainDst := memRegion{mainStreamDest(len(main)), int(project.Stream.MainEnd) + 1, "main stream"}
+	tailDst := memRegion{int(project.Stream.TailAddr), int(project.Stream.TailAddr) + len(tail), "tail stream"}
+	if _, ok := mainSrc.intersect(mainDst); ok && mainDst.Start < mainSrc.Start {
+		c.fail("copying the main stream down from %s to %s overwrites it: copy_bytes_bwd copies from the top", mainSrc, mainDst)
+	}
+	if x, ok := mainDst.intersect(tailSrc); ok {
+		c.fail("the main stream %s overwrites the tail stream in the program at %s before it is copied", mainDst, x)
+	}
+	if _, ok := tailSrc.intersect(tailDst); ok && tailDst.Start < tailSrc.Start {
+		c.fail("copying the tail stream down from %s to %s overwrites it: copy_bytes_bwd copies from the top", tailSrc, tailDst)
+	}
+}
+
+// coverage counts the distinct bytes a set of regions occupies.
+func coverage(regions []memRegion) int {
+	var used [0x10000]bool
+	n := 0
+	for _, r := range regions {
+		for addr := max(r.Start, 0); addr < min(r.End, len(used)); addr++ {
+			if !used[addr] {
+				used[addr] = true
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// checkMain runs the memory budget check.
+func checkMain() {
+	c := &budgetCheck{}
+	if err := c.run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(c.notes) > 0 {
+		fmt.Println("\nNotes:")
+		for _, note := range c.notes {
+			fmt.Printf("  %s\n", note)
+		}
+	}
+	if len(c.errors) > 0 {
+		fmt.Println("\nCheck: FAILED")
+		for _, e := range c.errors {
+			fmt.Printf("  %s\n", e)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("\nCheck: PASSED")
+}
+
+func (c *budgetCheck) run() error {
+	songs, err := loadSongs()
+	if err != nil {
+		return err
+	}
+	main, err := os.ReadFile(project.Outputs.StreamMain)
+	if err != nil {
+		return fmt.Errorf("loading main stream: %w\n(run compressor first: go run ./cmd/compress)", err)
+	}
+	tail, err := os.ReadFile(project.Outputs.StreamTail)
+	if err != nil {
+		return fmt.Errorf("loading stream tail: %w\n(run compressor first: go run ./cmd/compress)", err)
+	}
+	tables, err := loadSeekInc(project.Outputs.SeekInc)
+	if err != nil {
+		return fmt.Errorf("loading seek tables: %w\n(run compressor first: go run ./cmd/compress)", err)
+	}
+	playlist := project.Songs.Playlist
+	starts := tables["seek_offset"]
+	if len(starts) != len(playlist) {
+		return fmt.Errorf("%s: %d part starts for %d parts (stale, rerun the compressor)", project.Outputs.SeekInc, len(starts), len(playlist))
+	}
+
+	fmt.Println("Memory Budget Check")
+	fmt.Println("===================")
+	fixed, err := c.fixedRegions(len(main) + len(tail))
+	if err != nil {
+		return err
+	}
+	if c.streams > 0 {
+		c.checkCopies(c.streams, main, tail)
+	}
+	var buffers []memRegion
+	for i, base := range project.Buffers.Bases {
+		buffers = append(buffers, memRegion{int(base), int(base) + project.Buffers.Size, fmt.Sprintf("buffer %d", i)})
+	}
+	mainRegion := memRegion{mainStreamDest(len(main)), int(project.Stream.MainEnd) + 1, "main stream"}
+	tailRegion := memRegion{int(project.Stream.TailAddr), int(project.Stream.TailAddr) + len(tail), "tail stream"}
+	streams := []memRegion{mainRegion, tailRegion}
+
+	fmt.Println("Fixed regions:")
+	for _, r := range fixed {
+		fmt.Printf("  %s %6d  %s\n", r, r.size(), r.Name)
+	}
+	fmt.Println("Buffers and streams:")
+	for _, r := range append(buffers, streams...) {
+		fmt.Printf("  %s %6d  %s\n", r, r.size(), r.Name)
+	}
+
+	for i, r := range fixed {
+		c.overlaps([]memRegion{r}, fixed[i+1:], "")
+	}
+	c.overlaps(fixed, buffers, "")
+	c.overlaps(fixed, streams, "")
+	c.overlaps([]memRegion{mainRegion}, []memRegion{tailRegion}, "")
+	if mainRegion.Start < 0 {
+		c.fail("main stream of %d bytes does not fit below $%04X", len(main), int(project.Stream.MainEnd)+1)
+	}
+
+	// unread returns the stream still needed once part (1-based) starts
+	unread := func(part int) []memRegion {
+		if part > len(playlist) {
+			return nil
+		}
+		return []memRegion{{mainRegion.Start + starts[part-1], mainRegion.End, "unread stream"}, tailRegion}
+	}
+
+	fmt.Println("\nSteps (decoding each part while the one before it plays):")
+	fmt.Println("Part  Song  Output       Stream needed later       Gap    Free")
+	for part, song := range playlist {
+		base := songBase(song)
+		output := memRegion{base, base + len(songs[song]), fmt.Sprintf("part %d (song %d) output", part+1, song)}
+		if len(songs[song]) > project.Buffers.Size {
+			c.fail("part %d (song %d): %d bytes do not fit the %d-byte buffer at $%04X",
+				part+1, song, len(songs[song]), project.Buffers.Size, base)
+		}
+		later := unread(part + 2)
+		c.overlaps([]memRegion{output}, later, fmt.Sprintf(" (parts %d-%d not decoded yet)", part+2, len(playlist)))
+
+		// Live: the fixed regions, the output, what the other buffers hold
+		// since the last keyframe (the part that plays and the dictionaries)
+		// and the stream from this part on
+		live := append(append([]memRegion{}, fixed...), output)
+		hwm := make(map[int]int)
+		for _, s := range playedBefore(song) {
+			hwm[songBase(s)] = max(hwm[songBase(s)], len(songs[s]))
+		}
+		for b, n := range hwm {
+			if b != base {
+				live = append(live, memRegion{b, b + n, "buffer"})
+			}
+		}
+		live = append(live, unread(part+1)...)
+		free := 0x10000 - coverage(live)
+
+		// Gap: the closest the output comes to stream still needed later
+		// above it; the decoder writes upwards, so stream below is safe
+		gap := -1
+		var pieces []string
+		for _, r := range later {
+			pieces = append(pieces, r.String())
+			if r.Start >= output.End && (gap < 0 || output.gap(r) < gap) {
+				gap = output.gap(r)
+			}
+		}
+		gapText := "-"
+		if gap >= 0 {
+			gapText = strconv.Itoa(gap)
+		}
+		if len(pieces) == 0 {
+			pieces = []string{"none"}
+		}
+		fmt.Printf("%4d  %4d  %s  %-24s %5s  %6d\n", part+1, song, output, strings.Join(pieces, " + "), gapText, free)
+	}
+	return nil
+}
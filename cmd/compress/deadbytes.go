@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"compress/codec"
+)
+
+// Dead-byte detection: bytes of a song whose loaded value never reaches the
+// player (never executed, never read before the player writes them) are
+// candidates for normalization. A candidate is only accepted if inverting it
+// leaves the SID register writes of the whole part unchanged; accepted bytes
+// may then hold any value.
+
+// First access to a song byte while its player runs
+const (
+	accessNone  = iota
+	accessRead  // executed or read: the loaded value matters
+	accessWrite // overwritten before any read
+)
+
+// sidWrite is one write to a SID register.
+type sidWrite struct {
+	frame int
+	reg   byte
+	value byte
+}
+
+// playerTrace is what a song's player did over a run.
+type playerTrace struct {
+	sid    []sidWrite
+	access []byte // first access per song offset
+}
+
+// Instructions whose operand address is written (STA/STX/STY) or read and
+// written (INC/DEC and the memory shifts)
+var (
+	storeOps = []byte{0x85, 0x95, 0x8D, 0x9D, 0x99, 0x81, 0x91, 0x86, 0x96, 0x8E, 0x84, 0x94, 0x8C}
+	rmwOps   = []byte{0xE6, 0xF6, 0xEE, 0xFE, 0xC6, 0xD6, 0xCE, 0xDE, 0x06, 0x16, 0x0E, 0x1E,
+		0x46, 0x56, 0x4E, 0x5E, 0x26, 0x36, 0x2E, 0x3E, 0x66, 0x76, 0x6E, 0x7E}
+)
+
+// tracePlayer loads a song at base, calls init and then play once per frame,
+// and records the SID writes and the first access to every song byte.
+func tracePlayer(data []byte, base uint16, frames int) (*playerTrace, error) {
+	cpu := NewCPU6502()
+	cpu.LoadAt(base, data)
+	t := &playerTrace{access: make([]byte, len(data))}
+	frame := 0
+
+	mark := func(addr uint16, kind byte) {
+		if addr >= base && int(addr-base) < len(data) && t.access[addr-base] == accessNone {
+			t.access[addr-base] = kind
+		}
+	}
+	call := func(addr uint16, maxSteps uint64) error {
+		pushReturn(cpu, addr)
+		for !cpu.Halted {
+			if cpu.Cycles >= maxSteps {
+				return fmt.Errorf("timeout at $%04X", cpu.PC)
+			}
+			pc := cpu.PC
+			op := cpu.Mem[pc]
+			if err := cpu.Step(); err != nil {
+				return err
+			}
+
+			// Instruction bytes (operands included) count as read
+			size := int(cpu.PC - pc)
+			switch {
+			case op == 0x4C || op == 0x6C || op == 0x20:
+				size = 3
+			case op&0x1F == 0x10: // branches
+				size = 2
+			case op == 0x60 || op == 0x40 || op == 0x00:
+				size = 1
+			}
+			for i := 0; i < size; i++ {
+				mark(pc+uint16(i), accessRead)
+			}
+
+			if !cpu.HasEffectiveAddr || op == 0x4C || op == 0x20 {
+				continue
+			}
+			ea := cpu.EffectiveAddr
+			switch {
+			case op == 0x6C:
+				mark(ea, accessRead)
+				mark(ea&0xFF00|(ea+1)&0xFF, accessRead)
+			case slices.Contains(storeOps, op):
+				mark(ea, accessWrite)
+			default:
+				mark(ea, accessRead)
+			}
+			if ea >= 0xD400 && ea < 0xD800 && (slices.Contains(storeOps, op) || slices.Contains(rmwOps, op)) {
+				t.sid = append(t.sid, sidWrite{frame, byte(ea & 0x1F), cpu.Mem[ea]})
+			}
+		}
+		return nil
+	}
+
+	cpu.A = 0
+	if err := call(base+uint16(project.Player.Init), 10000000); err != nil {
+		return nil, fmt.Errorf("init: %w", err)
+	}
+	for frame = 1; frame <= frames; frame++ {
+		if err := call(base+uint16(project.Player.Play), 1000000); err != nil {
+			return nil, fmt.Errorf("play frame %d: %w", frame, err)
+		}
+	}
+	return t, nil
+}
+
+// deadCandidates returns the runs of song bytes whose loaded value the player
+// never uses.
+func (t *playerTrace) deadCandidates() []codec.Region {
+	var runs []codec.Region
+	for offset, kind := range t.access {
+		if kind != accessRead {
+			runs = addRegion(runs, codec.Region{Start: offset, End: offset + 1})
+		}
+	}
+	return runs
+}
+
+// proveDead returns the runs whose bytes can be inverted without changing the
+// SID writes of the reference trace. Runs are tried together first and split
+// in halves when the combination fails. Accepted runs stay inverted while the
+// rest are tried, so the last accepted trace covers the whole returned set.
+func proveDead(data []byte, base uint16, frames int, ref []sidWrite, runs []codec.Region) []codec.Region {
+	return proveInverted(slices.Clone(data), base, frames, ref, runs)
+}
+
+// proveInverted is proveDead on data that already has the runs accepted so
+// far inverted. It leaves the runs it accepts inverted in data.
+func proveInverted(data []byte, base uint16, frames int, ref []sidWrite, runs []codec.Region) []codec.Region {
+	if len(runs) == 0 {
+		return nil
+	}
+	invert := func() {
+		for _, r := range runs {
+			for i := r.Start; i < r.End; i++ {
+				data[i] ^= 0xFF
+			}
+		}
+	}
+	invert()
+	if t, err := tracePlayer(data, base, frames); err == nil && slices.Equal(t.sid, ref) {
+		return runs
+	}
+	invert()
+	if len(runs) == 1 {
+		return nil
+	}
+	half := len(runs) / 2
+	accepted := proveInverted(data, base, frames, ref, runs[:half])
+	return append(accepted, proveInverted(data, base, frames, ref, runs[half:])...)
+}
+
+// applyDead fills the dead bytes of every song, in song order, as the songs
+// are loaded for compression.
+func applyDead(songs map[int][]byte, dead deadBytes) {
+	for song := 1; song <= project.Songs.Count; song++ {
+		fillDead(songs[song], dead[song], songs[prevInBuffer(song)])
+	}
+}
+
+// fillDead gives the dead bytes of a song the value the previous song left at
+// the same buffer offset, so they decode as part of a forward reference.
+// Bytes past the end of prev (or of a song with no predecessor) are kept.
+func fillDead(data []byte, regions []codec.Region, prev []byte) {
+	for _, r := range regions {
+		for i := r.Start; i < r.End && i < len(data) && i < len(prev); i++ {
+			data[i] = prev[i]
+		}
+	}
+}
+
+// loadPartFrames reads the frame count of each part from the manifest's
+// part times include.
+func loadPartFrames() (map[int]int, error) {
+	f, err := os.Open(project.Songs.PartTimes)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	frames := make(map[int]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), ";")
+		value, ok := strings.CutPrefix(strings.TrimSpace(line), ".word")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(value), "$"), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", project.Songs.PartTimes, err)
+		}
+		frames[len(frames)+1] = int(n)
+	}
+	return frames, scanner.Err()
+}
+
+// deadBytes maps songs to their accepted don't-care regions.
+type deadBytes map[int][]codec.Region
+
+// loadDeadBytes reads the accepted regions written by -deadbytes. A missing
+// file means no regions.
+func loadDeadBytes() (deadBytes, error) {
+	f, err := os.Open(project.Songs.DeadBytes)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dead := make(deadBytes)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), ";")
+		var song, start, end int
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if _, err := fmt.Sscanf(line, "%d $%x-$%x", &song, &start, &end); err != nil {
+			return nil, fmt.Errorf("%s: %q: %w", project.Songs.DeadBytes, line, err)
+		}
+		dead[song] = append(dead[song], codec.Region{Start: start, End: end + 1})
+	}
+	return dead, scanner.Err()
+}
+
+// writeDeadBytes writes the accepted regions, one per line.
+func writeDeadBytes(dead deadBytes) error {
+	var sb strings.Builder
+	sb.WriteString("; Don't-care song bytes, proven by ./compress -deadbytes\n")
+	sb.WriteString("; <song> $<first>-$<last> (buffer offsets), filled from the buffer's previous song on load\n")
+	for song := 1; song <= project.Songs.Count; song++ {
+		for _, r := range dead[song] {
+			fmt.Fprintf(&sb, "%d $%04X-$%04X\n", song, r.Start, r.End-1)
+		}
+	}
+	return os.WriteFile(project.Songs.DeadBytes, []byte(sb.String()), 0644)
+}
+
+// deadBytesMain traces every song for its full part length, proves the
+// candidates and writes the accepted regions for loadSongs to apply.
+func deadBytesMain() {
+	songs, err := readSongs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	partFrames, err := loadPartFrames()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	type result struct {
+		candidates, accepted []codec.Region
+		sid                  []sidWrite
+		err                  error
+	}
+	results := make([]result, project.Songs.Count+1)
+	var wg sync.WaitGroup
+	for song := 1; song <= project.Songs.Count; song++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			base := uint16(songBase(s))
+			ref, err := tracePlayer(songs[s], base, partFrames[s])
+			if err != nil {
+				results[s].err = err
+				return
+			}
+			candidates := ref.deadCandidates()
+			results[s] = result{
+				candidates: candidates,
+				accepted:   proveDead(songs[s], base, partFrames[s], ref.sid, candidates),
+				sid:        ref.sid,
+			}
+		}(song)
+	}
+	wg.Wait()
+
+	fmt.Println("Dead-byte detection (full part length, SID write equivalence)")
+	fmt.Println("==============================================================")
+	dead := make(deadBytes)
+	total := 0
+	for song := 1; song <= project.Songs.Count; song++ {
+		r := results[song]
+		if r.err != nil {
+			fmt.Fprintf(os.Stderr, "Error: song %d: %v\n", song, r.err)
+			os.Exit(1)
+		}
+		dead[song] = r.accepted
+		fmt.Printf("Song %d: %5d frames, %6d SID writes, %5d candidate bytes in %3d runs, %5d accepted\n",
+			song, partFrames[song], len(r.sid), regionBytes(r.candidates), len(r.candidates), regionBytes(r.accepted))
+		total += regionBytes(r.accepted)
+	}
+
+	// The proof inverted the bytes; the songs are compressed with them filled
+	// from the previous song, so the filled songs must play the same too
+	filled := make(map[int][]byte)
+	for song, data := range songs {
+		filled[song] = slices.Clone(data)
+	}
+	applyDead(filled, dead)
+	for song := 1; song <= project.Songs.Count; song++ {
+		t, err := tracePlayer(filled[song], uint16(songBase(song)), partFrames[song])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: song %d with dead bytes filled: %v\n", song, err)
+			os.Exit(1)
+		}
+		if !slices.Equal(t.sid, results[song].sid) {
+			fmt.Fprintf(os.Stderr, "Error: song %d with dead bytes filled changes its SID writes\n", song)
+			os.Exit(1)
+		}
+	}
+	fmt.Println("Filled songs: SID writes unchanged")
+	if err := writeDeadBytes(dead); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("\nTotal: %d bytes -> %s\n", total, project.Songs.DeadBytes)
+}
+
+func regionBytes(regions []codec.Region) int {
+	n := 0
+	for _, r := range regions {
+		n += r.End - r.Start
+	}
+	return n
+}
@@ -3,7 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+
+	"compress/asm6502"
+	"compress/codec"
 )
 
 // 6502 Decompressor for V23 encoding
@@ -20,284 +24,271 @@ const (
 	zpValHi      = 0x08
 	zpRefLo      = 0x09 // Reference pointer (copy source)
 	zpRefHi      = 0x0A
-	zpOtherDelta = 0x0B // Delta to reach other buffer: (otherBase - selfBase) >> 8
+	zpOtherDelta = 0x0B // Delta to reach other buffer: (otherBase - selfBase) >> 8; with more than two buffers the page after the output buffer
 	zpCallerX    = 0x0C // Caller's X saved by read_expgol (backref uses for adj 1/2/3)
+	zpCrcLo      = 0x0D // CRC-16 accumulator (crc_verify only)
+	zpCrcHi      = 0x0E
+	zpBudget     = 0x0F // Output bytes left in this slice (sliced variant only)
 )
 
 // Terminator detection: must be > max gamma zeros in compressed data
 // X counts down from 1: after N zeros, X = 1-(N+1) = -N (mod 256)
 // Threshold = 256 - terminatorZeros detects exactly terminatorZeros consecutive zeros
 const (
-	TerminatorZeros     = 12   // number of zero bits that signal terminator
-	terminatorThreshold = 256 - TerminatorZeros // $F4 for 12 zeros
+	TerminatorZeros     = codec.DefaultTerminatorZeros // number of zero bits that signal terminator
+	terminatorThreshold = 256 - TerminatorZeros        // $F4 for 12 zeros
 )
 
-// zpName returns the symbolic name for a zero page address
-func zpName(addr byte) string {
-	names := map[byte]string{
-		0x02: "zp_src_lo", 0x03: "zp_src_hi",
-		0x04: "zp_bitbuf",
-		0x05: "zp_out_lo", 0x06: "zp_out_hi",
-		0x07: "zp_val_lo", 0x08: "zp_val_hi",
-		0x09: "zp_ref_lo", 0x0A: "zp_ref_hi",
-		0x0B: "zp_other_delta", 0x0C: "zp_caller_x",
+// decoderOrigin is the load address the player links the decoder at.
+const decoderOrigin = 0x0D00
+
+// decoderZP assigns the decoder's zero page. Pointers take two bytes, low
+// byte first; crc is only used by the CRC variant and budget by the sliced
+// one.
+type decoderZP struct {
+	src, bitbuf, out, val, ref, otherDelta, callerX, crc, budget byte
+}
+
+// defaultZP is the zero page the player links the decoder with.
+var defaultZP = decoderZP{zpSrcLo, zpBitBuf, zpOutLo, zpValLo, zpRefLo, zpOtherDelta, zpCallerX, zpCrcLo, zpBudget}
+
+// zpFrom packs the zero page of a decoder with the given crc and sliced
+// options into consecutive bytes from first, in the order of defaultZP. It
+// fails if a byte the decoder uses would pass $FF or land on $00-$01.
+func zpFrom(first int, crc, sliced bool) (decoderZP, error) {
+	d := first - zpSrcLo
+	for _, s := range defaultZP.slots(crc, sliced) {
+		if s.addr+d > 0xFF {
+			return decoderZP{}, fmt.Errorf("%s would be at $%X, past the zero page", s.name, s.addr+d)
+		}
+	}
+	z := defaultZP
+	for _, b := range []*byte{&z.src, &z.bitbuf, &z.out, &z.val, &z.ref, &z.otherDelta, &z.callerX, &z.crc, &z.budget} {
+		*b = byte(int(*b) + d) // the bytes this decoder does not use may wrap
+	}
+	return z, z.check(crc, sliced)
+}
+
+// zpSlot is one named zero page byte of the decoder.
+type zpSlot struct {
+	name    string
+	addr    int
+	comment string
+}
+
+// slots lists the decoder's zero page bytes: the ones the caller sets up
+// first, then the internal ones, then the CRC accumulator if crc is set and
+// the slice budget if sliced is.
+func (z decoderZP) slots(crc, sliced bool) []zpSlot {
+	s := []zpSlot{
+		{"zp_src_lo", int(z.src), "Source pointer (compressed data)"},
+		{"zp_src_hi", int(z.src) + 1, ""},
+		{"zp_bitbuf", int(z.bitbuf), "Bit buffer (set to $80 for first call)"},
+		{"zp_out_lo", int(z.out), "Output pointer ($1000 or $7000)"},
+		{"zp_out_hi", int(z.out) + 1, ""},
+		{"zp_val_lo", int(z.val), ""},
+		{"zp_val_hi", int(z.val) + 1, ""},
+		{"zp_ref_lo", int(z.ref), ""},
+		{"zp_ref_hi", int(z.ref) + 1, ""},
+		{"zp_other_delta", int(z.otherDelta), ""},
+		{"zp_caller_x", int(z.callerX), ""},
+	}
+	if crc {
+		s = append(s, zpSlot{"zp_crc_lo", int(z.crc), ""}, zpSlot{"zp_crc_hi", int(z.crc) + 1, ""})
 	}
-	if name, ok := names[addr]; ok {
-		return name
+	if sliced {
+		s = append(s, zpSlot{"zp_budget", int(z.budget), "Output bytes to decode in this call"})
 	}
-	return fmt.Sprintf("$%02X", addr)
+	return s
+}
+
+// check reports a pointer running past $FF, a byte on the processor port
+// ($00-$01) and bytes used twice.
+func (z decoderZP) check(crc, sliced bool) error {
+	owner := make(map[int]string)
+	for _, s := range z.slots(crc, sliced) {
+		if s.addr > 0xFF {
+			return fmt.Errorf("%s at $%X is outside the zero page", s.name, s.addr)
+		}
+		if s.addr < 2 {
+			return fmt.Errorf("%s at $%02X is the processor port", s.name, s.addr)
+		}
+		if other, ok := owner[s.addr]; ok {
+			return fmt.Errorf("%s and %s both at $%02X", other, s.name, s.addr)
+		}
+		owner[s.addr] = s.name
+	}
+	return nil
 }
 
 // GetDecompressorAsm returns the decompressor as ca65 assembly source code
 // Generated by disassembling GetDecompressorCode()
 func GetDecompressorAsm() string {
-	code, labelMap := GetDecompressorCodeWithLabels()
-	base := uint16(0x0D00)
+	return decoderAsm(decoderProfile{})
+}
 
-	// Create reverse map: address -> label name
-	labelNames := make(map[uint16]string)
-	for name, offset := range labelMap {
-		labelNames[base+uint16(offset)] = name
+// GetBackwardDecompressorAsm returns the backward decompressor as ca65 assembly
+func GetBackwardDecompressorAsm() string {
+	return decoderAsm(decoderProfile{backward: true})
+}
+
+// GetCRCDecompressorAsm returns the CRC-checking decompressor as ca65 assembly
+func GetCRCDecompressorAsm() string {
+	return decoderAsm(decoderProfile{crc: true})
+}
+
+// decoderAsm returns a decompressor variant as ca65 assembly, with the setup
+// it needs in the header.
+func decoderAsm(p decoderProfile) string {
+	p = p.placed()
+	code, labelMap := genDecompressor(p)
+	z := p.zp
+	var setup string
+	switch {
+	case p.backward:
+		setup = fmt.Sprintf(`; Backward variant: stream and output are processed from high to low addresses.
+;
+; Setup required before calling:
+;   $%02X-$%02X (zp_src)    - Highest byte of the (byte-reversed) compressed song
+;   $%02X     (zp_bitbuf) - Bit buffer (set to $80)
+;   $%02X-$%02X (zp_out)    - Address of the song's last byte
+`, z.src, z.src+1, z.bitbuf, z.out, z.out+1)
+	case p.crc:
+		setup = fmt.Sprintf(`; CRC variant: streams compressed with codec.Options.CRC carry a CRC-16 after
+; the end of each song, left in zp_val by decompress.
+;
+; Setup required before calling decompress: as for the plain decompressor.
+;
+; To verify a song, call crc_verify after decompress with:
+;   $%02X-$%02X (zp_ref)    - First byte of the song ($1000 or $7000)
+; On return C=0 if the song's CRC-16/CCITT matches, C=1 if not.
+`, z.ref, z.ref+1)
+	case p.sliced:
+		setup = fmt.Sprintf(`; Sliced variant: each call decodes at most zp_budget output bytes, so a song
+; can be decoded a slice per frame, e.g. from the music IRQ.
+;
+; Setup required before calling decompress: as for the plain decompressor,
+; and for every call:
+;   $%02X     (zp_budget) - Output bytes to decode in this call (1-255)
+;
+; Call decompress_slice until it returns C=0 (song done). C=1 means the
+; budget ran out. All state is in zero page: A, X, Y, the flags and the
+; decimal mode need not be kept between calls.
+`, z.budget)
+	case p.smc:
+		setup = fmt.Sprintf(`; Self-modifying variant: the pointers and the working bytes are operands in
+; the code, which must be in RAM. Only zp_bitbuf is in the zero page.
+;
+; Setup required before calling:
+;   src_lo/src_hi       - Source pointer to compressed data (in the code)
+;   $%02X     (zp_bitbuf) - Bit buffer (set to $80 for first call)
+;   out_lo/out_hi       - Output pointer ($1000 or $7000) (in the code)
+;
+; On return src_lo/src_hi and zp_bitbuf are updated for the next call.
+`, z.bitbuf)
+	default:
+		setup = fmt.Sprintf(`; Setup required before calling:
+;   $%02X-$%02X (zp_src)    - Source pointer to compressed data
+;   $%02X     (zp_bitbuf) - Bit buffer (set to $80 for first call)
+;   $%02X-$%02X (zp_out)    - Output pointer ($1000 or $7000)
+;
+; On return:
+;   $%02X-$%02X (zp_src)    - Updated source pointer
+;   $%02X     (zp_bitbuf) - Updated bit buffer (pass to next call)
+;
+; Jump commands in the stream re-point zp_src (and reset zp_bitbuf), so a
+; stream split across memory regions decodes in a single call.
+`, z.src, z.src+1, z.bitbuf, z.out, z.out+1, z.src, z.src+1, z.bitbuf)
 	}
+	if p.cmos {
+		setup = "; 65C02 profile: needs a 65C02 or later (STZ, BRA and (zp) addressing).\n;\n" + setup
+	}
+	return disassembleDecompressor(p, code, labelMap, setup)
+}
 
-	// Helper to get label name for an address
-	labelFor := func(addr uint16) string {
-		if name, ok := labelNames[addr]; ok {
-			return name
-		}
-		return fmt.Sprintf("L%04X", addr)
+// disassembleDecompressor turns generated decompressor code into ca65 source
+func disassembleDecompressor(p decoderProfile, code []byte, labelMap map[string]int, setup string) string {
+	base := p.origin
+	cpu := "6502"
+	if p.cmos {
+		cpu = "65C02"
 	}
 
-	var sb strings.Builder
-	sb.WriteString(`; ============================================================================
+	return fmt.Sprintf(`; ============================================================================
 ; V23 Decompressor for 6502 - Generated from machine code
 ; ============================================================================
 ;
-; Load address: $0D00
+; Load address: $%04X
 ; Entry point:  decompress
 ;
-; Setup required before calling:
-;   $02-$03 (zp_src)    - Source pointer to compressed data
-;   $04     (zp_bitbuf) - Bit buffer (set to $80 for first call)
-;   $05-$06 (zp_out)    - Output pointer ($1000 or $7000)
-;
-; On return:
-;   $02-$03 (zp_src)    - Updated source pointer
-;   $04     (zp_bitbuf) - Updated bit buffer (pass to next call)
-; ============================================================================
+`, base) + setup + fmt.Sprintf(`; ============================================================================
 
-.setcpu "6502"
+.setcpu "%s"
 
 .segment "LOADADDR"
-        .word   $0D00
+        .word   $%04X
 
 .segment "CODE"
 
 .proc decompress
-`)
+`, cpu, base) + decoderListing(p, labelMap).Write(code) + ".endproc\n"
+}
 
-	// Collect branch targets for labels
-	targets := make(map[uint16]bool)
-	for i := 0; i < len(code); {
-		op := code[i]
-		size := opcodeSize(op)
-		if size == 2 && isBranch(op) {
-			offset := int8(code[i+1])
-			target := uint16(int(base) + i + 2 + int(offset))
-			targets[target] = true
-		}
-		if size == 3 && (op == 0x4C || op == 0x20) { // JMP/JSR
-			target := uint16(code[i+1]) | uint16(code[i+2])<<8
-			if target >= base && target < base+uint16(len(code)) {
-				targets[target] = true
-			}
-		}
-		i += size
+// decoderListing returns the listing of a decoder placed as in p, labelled
+// with the generator's names.
+func decoderListing(p decoderProfile, labelMap map[string]int) *asm6502.Listing {
+	base := p.origin
+	l := &asm6502.Listing{
+		Origin:     base,
+		Labels:     make(map[int]string),
+		ZeroPage:   make(map[int]string),
+		LabelJumps: true,
+		AutoLabel:  "L%04X",
 	}
-
-	// Disassemble
-	for i := 0; i < len(code); {
-		addr := base + uint16(i)
-
-		// Label if this is a branch target
-		if targets[addr] {
-			sb.WriteString(fmt.Sprintf("%s:\n", labelFor(addr)))
-		}
-
-		op := code[i]
-		size := opcodeSize(op)
-
-		// Detect BIT abs skip trick: $2C followed by branch target at +1
-		isBitSkip := op == 0x2C && i+1 < len(code) && targets[base+uint16(i+1)]
-		if isBitSkip {
-			size = 1 // Treat as single byte so hidden instruction is decoded
-		}
-
-		sb.WriteString(fmt.Sprintf("        "))
-
-		switch op {
-		// Implied
-		case 0x00:
-			sb.WriteString("brk")
-		case 0x08:
-			sb.WriteString("php")
-		case 0x18:
-			sb.WriteString("clc")
-		case 0x38:
-			sb.WriteString("sec")
-		case 0x48:
-			sb.WriteString("pha")
-		case 0x28:
-			sb.WriteString("plp")
-		case 0x68:
-			sb.WriteString("pla")
-		case 0x8A:
-			sb.WriteString("txa")
-		case 0xCA:
-			sb.WriteString("dex")
-		case 0xE8:
-			sb.WriteString("inx")
-		case 0x98:
-			sb.WriteString("tya")
-		case 0xAA:
-			sb.WriteString("tax")
-		case 0xA8:
-			sb.WriteString("tay")
-		case 0x0A:
-			sb.WriteString("asl a")
-		case 0x4A:
-			sb.WriteString("lsr a")
-		case 0x2A:
-			sb.WriteString("rol a")
-		case 0x6A:
-			sb.WriteString("ror a")
-		case 0x60:
-			sb.WriteString("rts")
-
-		// Zero page
-		case 0x05:
-			sb.WriteString(fmt.Sprintf("ora     %s", zpName(code[i+1])))
-		case 0x06:
-			sb.WriteString(fmt.Sprintf("asl     %s", zpName(code[i+1])))
-		case 0x26:
-			sb.WriteString(fmt.Sprintf("rol     %s", zpName(code[i+1])))
-		case 0x65:
-			sb.WriteString(fmt.Sprintf("adc     %s", zpName(code[i+1])))
-		case 0x84:
-			sb.WriteString(fmt.Sprintf("sty     %s", zpName(code[i+1])))
-		case 0x85:
-			sb.WriteString(fmt.Sprintf("sta     %s", zpName(code[i+1])))
-		case 0x86:
-			sb.WriteString(fmt.Sprintf("stx     %s", zpName(code[i+1])))
-		case 0xA5:
-			sb.WriteString(fmt.Sprintf("lda     %s", zpName(code[i+1])))
-		case 0xA6:
-			sb.WriteString(fmt.Sprintf("ldx     %s", zpName(code[i+1])))
-		case 0xC5:
-			sb.WriteString(fmt.Sprintf("cmp     %s", zpName(code[i+1])))
-		case 0xC6:
-			sb.WriteString(fmt.Sprintf("dec     %s", zpName(code[i+1])))
-		case 0xE5:
-			sb.WriteString(fmt.Sprintf("sbc     %s", zpName(code[i+1])))
-		case 0xE6:
-			sb.WriteString(fmt.Sprintf("inc     %s", zpName(code[i+1])))
-
-		// Immediate
-		case 0x09:
-			sb.WriteString(fmt.Sprintf("ora     #$%02X", code[i+1]))
-		case 0x49:
-			sb.WriteString(fmt.Sprintf("eor     #$%02X", code[i+1]))
-		case 0x69:
-			sb.WriteString(fmt.Sprintf("adc     #$%02X", code[i+1]))
-		case 0xA0:
-			sb.WriteString(fmt.Sprintf("ldy     #$%02X", code[i+1]))
-		case 0xA2:
-			sb.WriteString(fmt.Sprintf("ldx     #$%02X", code[i+1]))
-		case 0xA9:
-			sb.WriteString(fmt.Sprintf("lda     #$%02X", code[i+1]))
-		case 0xC9:
-			sb.WriteString(fmt.Sprintf("cmp     #$%02X", code[i+1]))
-		case 0xE0:
-			sb.WriteString(fmt.Sprintf("cpx     #$%02X", code[i+1]))
-		case 0xE9:
-			sb.WriteString(fmt.Sprintf("sbc     #$%02X", code[i+1]))
-
-		// Indirect Y
-		case 0xB1:
-			sb.WriteString(fmt.Sprintf("lda     (%s),y", zpName(code[i+1])))
-		case 0x91:
-			sb.WriteString(fmt.Sprintf("sta     (%s),y", zpName(code[i+1])))
-
-		// Branches
-		case 0x10:
-			target := uint16(int(addr) + 2 + int(int8(code[i+1])))
-			sb.WriteString(fmt.Sprintf("bpl     %s", labelFor(target)))
-		case 0x30:
-			target := uint16(int(addr) + 2 + int(int8(code[i+1])))
-			sb.WriteString(fmt.Sprintf("bmi     %s", labelFor(target)))
-		case 0x50:
-			target := uint16(int(addr) + 2 + int(int8(code[i+1])))
-			sb.WriteString(fmt.Sprintf("bvc     %s", labelFor(target)))
-		case 0x70:
-			target := uint16(int(addr) + 2 + int(int8(code[i+1])))
-			sb.WriteString(fmt.Sprintf("bvs     %s", labelFor(target)))
-		case 0x90:
-			target := uint16(int(addr) + 2 + int(int8(code[i+1])))
-			sb.WriteString(fmt.Sprintf("bcc     %s", labelFor(target)))
-		case 0xB0:
-			target := uint16(int(addr) + 2 + int(int8(code[i+1])))
-			sb.WriteString(fmt.Sprintf("bcs     %s", labelFor(target)))
-		case 0xD0:
-			target := uint16(int(addr) + 2 + int(int8(code[i+1])))
-			sb.WriteString(fmt.Sprintf("bne     %s", labelFor(target)))
-		case 0xF0:
-			target := uint16(int(addr) + 2 + int(int8(code[i+1])))
-			sb.WriteString(fmt.Sprintf("beq     %s", labelFor(target)))
-
-		// Absolute
-		case 0x20:
-			target := uint16(code[i+1]) | uint16(code[i+2])<<8
-			sb.WriteString(fmt.Sprintf("jsr     %s", labelFor(target)))
-		case 0x2C:
-			if isBitSkip {
-				sb.WriteString(".byte   $2C     ; BIT abs opcode - skip next 2 bytes")
-			} else {
-				target := uint16(code[i+1]) | uint16(code[i+2])<<8
-				sb.WriteString(fmt.Sprintf("bit     $%04X", target))
-			}
-		case 0x4C:
-			target := uint16(code[i+1]) | uint16(code[i+2])<<8
-			sb.WriteString(fmt.Sprintf("jmp     %s", labelFor(target)))
-
-		default:
-			sb.WriteString(fmt.Sprintf(".byte   $%02X", op))
+	slots := p.zp.slots(true, true)
+	if p.smc {
+		slots, _ = p.zpSlots()
+	}
+	for name, offset := range labelMap {
+		if p.smc && strings.HasPrefix(name, "zp_") {
+			// An operand in the code, not in the zero page
+			name = strings.TrimPrefix(name, "zp_")
 		}
-
-		sb.WriteString("\n")
-		i += size
+		l.Labels[base+offset] = name
 	}
-
-	sb.WriteString(".endproc\n")
-	return sb.String()
-}
-
-func opcodeSize(op byte) int {
-	// Implied/accumulator
-	if op == 0x00 || op == 0x08 || op == 0x18 || op == 0x28 || op == 0x38 || op == 0x48 || op == 0x68 ||
-		op == 0x8A || op == 0x98 || op == 0xAA || op == 0xA8 || op == 0xCA || op == 0xE8 || op == 0x0A || op == 0x4A || op == 0x2A || op == 0x6A || op == 0x60 {
-		return 1
+	if p.cmos {
+		l.CPU = asm6502.CPU65C02
 	}
-	// Absolute (JMP, JSR, BIT abs)
-	if op == 0x20 || op == 0x4C || op == 0x2C {
-		return 3
+	for _, s := range slots {
+		l.ZeroPage[s.addr] = s.name
 	}
-	// Everything else is 2 bytes
-	return 2
+	// Secondary entry points are called from outside
+	for _, entry := range []string{"decompress_slice", "crc_verify"} {
+		if offset, ok := labelMap[entry]; ok {
+			l.Entries = append(l.Entries, base+offset)
+		}
+	}
+	return l
 }
 
-func isBranch(op byte) bool {
-	return op == 0x10 || op == 0x30 || op == 0x50 || op == 0x70 || // BPL, BMI, BVC, BVS
-		op == 0x90 || op == 0xB0 || op == 0xD0 || op == 0xF0 // BCC, BCS, BNE, BEQ
+// relocTableAsm returns the relocation table of a decoder as ca65 source.
+func relocTableAsm(relocs []int) string {
+	var sb strings.Builder
+	sb.WriteString(`
+; Relocation table: offsets from decompress of the high bytes of its absolute
+; addresses. To run the decoder n pages above its load address, copy it there
+; and add n to each of these bytes.
+decompress_relocs:
+`)
+	for i := 0; i < len(relocs); i += 8 {
+		words := make([]string, 0, 8)
+		for _, r := range relocs[i:min(i+8, len(relocs))] {
+			words = append(words, fmt.Sprintf("$%04X", r))
+		}
+		fmt.Fprintf(&sb, "        .word   %s\n", strings.Join(words, ", "))
+	}
+	fmt.Fprintf(&sb, "decompress_reloc_count = %d\n", len(relocs))
+	return sb.String()
 }
 
 // GetDecompressorCodeSize returns the size of the machine code
@@ -305,10 +296,101 @@ func GetDecompressorCodeSize() int {
 	return len(GetDecompressorCode())
 }
 
-// PrintDecompressorAsm prints the assembly source to stdout
-func PrintDecompressorAsm() {
-	fmt.Printf("; Size: %d bytes\n", GetDecompressorCodeSize())
-	fmt.Print(GetDecompressorAsm())
+// PrintDecompressorAsm prints the assembly source of the decoder placed as
+// in p to stdout, followed by its relocation table if relocs is set
+func PrintDecompressorAsm(p decoderProfile, relocs bool) {
+	code, _ := genDecompressor(p)
+	fmt.Printf("; Size: %d bytes\n", len(code))
+	fmt.Print(decoderAsm(p))
+	if relocs {
+		fmt.Print(relocTableAsm(decoderRelocs(p)))
+	}
+}
+
+// asmMain prints the decoder for the load address and zero page given:
+// -asm [-origin $C000] [-zp $F0] [-reloc] [-speed|-sliced|-smc] [-65c02]
+// [-syntax acme]. The zero page is packed from the byte given, in the default
+// order; -speed selects the speed profile, -sliced the sliced variant, -smc
+// the self-modifying profile, whose bit buffer goes to the byte given, and
+// -65c02 the 65C02 profile. -syntax prints the include instead of the
+// standalone source, in the syntax named.
+func asmMain(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: -asm [-origin addr] [-zp addr] [-reloc] [-speed|-sliced|-smc] [-65c02] [-syntax %s]\n", syntaxNames())
+		os.Exit(1)
+	}
+	var p decoderProfile
+	var syntax *asmSyntax
+	relocs, zpFirst := false, -1
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-syntax":
+			if i+1 == len(args) || findSyntax(args[i+1]) == nil {
+				usage()
+			}
+			syntax = findSyntax(args[i+1])
+			i++
+			continue
+		case "-reloc":
+			relocs = true
+			continue
+		case "-speed":
+			p.speed = true
+			continue
+		case "-sliced":
+			p.sliced = true
+			continue
+		case "-65c02":
+			p.cmos = true
+			continue
+		case "-smc":
+			p.smc = true
+			continue
+		}
+		var value hexInt
+		if i+1 == len(args) || value.UnmarshalJSON([]byte(strconv.Quote(args[i+1]))) != nil {
+			usage()
+		}
+		switch args[i] {
+		case "-origin":
+			if value < 0x100 || int(value)+GetDecompressorCodeSize() > 0x10000 {
+				fmt.Fprintf(os.Stderr, "Error: the decoder does not fit at $%04X\n", int(value))
+				os.Exit(1)
+			}
+			p.origin = int(value)
+		case "-zp":
+			if value > 0xFF {
+				fmt.Fprintf(os.Stderr, "Error: $%X is not in the zero page\n", int(value))
+				os.Exit(1)
+			}
+			zpFirst = int(value)
+		default:
+			usage()
+		}
+		i++
+	}
+	if p.speed && (p.sliced || p.cmos) || p.smc && (p.speed || p.sliced) || syntax != nil && relocs {
+		usage()
+	}
+	var err error
+	switch {
+	case p.smc && zpFirst >= 0 && zpFirst < 2:
+		err = fmt.Errorf("zp_bitbuf at $%02X is the processor port", zpFirst)
+	case p.smc && zpFirst >= 0:
+		p.zp = defaultZP
+		p.zp.bitbuf = byte(zpFirst) // its only zero page byte
+	case zpFirst >= 0:
+		p.zp, err = zpFrom(zpFirst, false, p.sliced)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: zero page: %v\n", err)
+		os.Exit(1)
+	}
+	if syntax != nil {
+		fmt.Print(decoderInclude(p, syntax))
+		return
+	}
+	PrintDecompressorAsm(p, relocs)
 }
 
 // WriteDecompressorBin writes the decompressor machine code to a file
@@ -318,35 +400,13 @@ func WriteDecompressorBin(path string) error {
 
 // WriteDecompressorAsm writes the decompressor assembly source to a file
 func WriteDecompressorAsm(path string) error {
-	zpDefs := `; External zero page variables (must be defined by caller)
-; zp_src_lo       = $02   ; Source pointer (compressed data)
-; zp_src_hi       = $03
-; zp_bitbuf       = $04   ; Bit buffer (set to $80 for first call)
-; zp_out_lo       = $05   ; Output pointer ($1000 or $7000)
-; zp_out_hi       = $06
-
-; Internal zero page variables
-zp_val_lo       = $07
-zp_val_hi       = $08
-zp_ref_lo       = $09
-zp_ref_hi       = $0A
-zp_other_delta  = $0B
-zp_caller_x     = $0C
-
-`
-	content := fmt.Sprintf("; Size: %d bytes\n%s%s", GetDecompressorCodeSize(), zpDefs, GetDecompressorAsmInclude())
-	return os.WriteFile(path, []byte(content), 0644)
+	return os.WriteFile(path, []byte(GetDecompressorAsmFile()), 0644)
 }
 
-// GetDecompressorAsmInclude returns the decompressor as includable assembly (no segment directives)
-func GetDecompressorAsmInclude() string {
-	full := GetDecompressorAsm()
-	// Strip the standalone header (segments, load address) - find ".proc decompress"
-	idx := strings.Index(full, ".proc decompress")
-	if idx == -1 {
-		return full
-	}
-	return full[idx:]
+// GetDecompressorAsmFile returns the contents of the generated decompressor
+// include: the zero page it uses and the routine
+func GetDecompressorAsmFile() string {
+	return decoderInclude(decoderProfile{}, asmSyntaxes[0])
 }
 
 // GetDecompressorCode returns the assembled decompressor (optimized version)
@@ -359,340 +419,836 @@ func GetDecompressorCode() []byte {
 
 // GetDecompressorCodeWithLabels returns the code and a map of label names to offsets
 func GetDecompressorCodeWithLabels() ([]byte, map[string]int) {
-	code := make([]byte, 0, 350)
-	labels := make(map[string]int)
+	return genDecompressor(decoderProfile{})
+}
+
+// GetBackwardDecompressorCode returns the backward (end-to-start) decompressor.
+// zp_out points at the song's last byte and zp_src at the highest stream byte;
+// both pointers move down.
+func GetBackwardDecompressorCode() []byte {
+	code, _ := genDecompressor(decoderProfile{backward: true})
+	return code
+}
 
-	emit := func(bytes ...byte) int {
-		start := len(code)
-		code = append(code, bytes...)
-		return start
+// GetCRCDecompressorCode returns the forward decompressor for streams with a
+// CRC-16 trailer, followed by the crc_verify routine.
+func GetCRCDecompressorCode() ([]byte, map[string]int) {
+	return genDecompressor(decoderProfile{crc: true})
+}
+
+// decoderGeometry is the buffer ring the decoder addresses: count buffers of
+// size bytes from start, all page aligned. A song's other buffer is the one
+// below its own, wrapping from the first buffer to the last.
+type decoderGeometry struct {
+	start, size, count int
+}
+
+func (g decoderGeometry) baseHi(i int) byte { return byte((g.start + i*g.size) >> 8) }
+func (g decoderGeometry) startHi() byte     { return g.baseHi(0) }
+func (g decoderGeometry) endHi() byte       { return g.baseHi(g.count) }
+func (g decoderGeometry) sizeHi() byte      { return byte(g.size >> 8) }
+func (g decoderGeometry) ringHi() byte      { return byte(g.count * g.size >> 8) }
+
+// decoderProfile selects a decompressor variant.
+type decoderProfile struct {
+	backward bool      // stream and output run high to low
+	crc      bool      // read the CRC-16 after the end escape and append crc_verify
+	speed    bool      // inline bit reads and unroll literals and page copies (forward only)
+	sliced   bool      // return after zp_budget output bytes, resumable (forward only)
+	cmos     bool      // 65C02: (zp) addressing without Y, STZ and BRA (not with speed)
+	smc      bool      // pointers and working bytes in the code's operands (forward size profile only)
+	origin   int       // load address; 0 for decoderOrigin
+	zp       decoderZP // zero page; the zero value for defaultZP
+}
+
+// placed returns p with the default load address and zero page filled in.
+func (p decoderProfile) placed() decoderProfile {
+	if p.origin == 0 {
+		p.origin = decoderOrigin
 	}
+	if p.zp == (decoderZP{}) {
+		p.zp = defaultZP
+	}
+	return p
+}
 
-	emitAt := func(pos int, bytes ...byte) {
-		for i, b := range bytes {
-			code[pos+i] = b
-		}
+// zpSlots returns the zero page bytes p uses, and how many of them, from the
+// first, the caller sets up. The self-modifying profile keeps all but the bit
+// buffer in its code.
+func (p decoderProfile) zpSlots() ([]zpSlot, int) {
+	slots := p.zp.slots(p.crc, p.sliced)
+	if p.smc {
+		return slots[2:3], 1
+	}
+	return slots, 5
+}
+
+// indirect returns the operand of an access through the pointer at zp:
+// (zp),y with Y kept 0, or (zp) on the 65C02.
+func (p decoderProfile) indirect(zp string) string {
+	if p.cmos {
+		return "(" + zp + ")"
 	}
+	return "(" + zp + "),y"
+}
+
+// access appends ins through the pointer at zp, e.g. zp_src_lo. In the
+// self-modifying profile the pointer is the instruction's absolute operand,
+// which zp and its _hi partner then name.
+func (p decoderProfile) access(a *asm6502.Assembler, ins, zp string) {
+	if !p.smc {
+		a.Ins("%s %s", ins, p.indirect(zp))
+		return
+	}
+	a.Ins("%s $FFFF", ins) // rewritten before use
+	a.OperandLabel(zp, 0)
+	a.OperandLabel(strings.TrimSuffix(zp, "_lo")+"_hi", 1)
+}
+
+// readByte appends ins reading the byte at zp. In the self-modifying profile
+// the byte is the operand of ins #$00, which zp then names.
+func (p decoderProfile) readByte(a *asm6502.Assembler, ins, zp string) {
+	if !p.smc {
+		a.Ins("%s %s", ins, zp)
+		return
+	}
+	a.Ins("%s #$00", ins)
+	a.OperandLabel(zp, 0)
+}
+
+// adjInY reports whether the backref adjustment is counted in Y, which the
+// 65C02's (zp) addressing leaves free and read_expgol does not touch, instead
+// of X saved to zp_caller_x. The self-modifying profile keeps X: its literal
+// is stored as a one byte copy with X=1.
+func (p decoderProfile) adjInY() bool {
+	return p.cmos && !p.smc
+}
+
+// storeZero clears a zero page byte: STY with Y kept 0, or STZ on the 65C02.
+func (p decoderProfile) storeZero(a *asm6502.Assembler, zp string) {
+	if p.cmos {
+		a.Ins("stz %s", zp)
+	} else {
+		a.Ins("sty %s", zp)
+	}
+}
 
-	pos := func() int { return len(code) }
+// branchAlways appends a branch to target that the flags always take: branch
+// on the 65C02, where it is BRA.
+func (p decoderProfile) branchAlways(a *asm6502.Assembler, branch, target string) {
+	if p.cmos {
+		branch = "bra"
+	}
+	a.Ins("%s %s", branch, target)
+}
 
-	placeholder := func() int {
-		p := pos()
-		emit(0x00, 0x00)
-		return p
+// toMainLoop appends the jump back to main_loop: the instruction given, or on
+// the 65C02 a BRA to main_loop or to an earlier such BRA in range, hopping
+// from BRA to BRA. Where none is in range it is a JMP.
+func (p decoderProfile) toMainLoop(a *asm6502.Assembler, ins string) {
+	if !p.cmos {
+		a.Ins("%s", ins)
+		return
+	}
+	hops := []string{"main_loop"}
+	for {
+		name := fmt.Sprintf("to_main_loop%d", len(hops))
+		if _, ok := a.Lookup(name); !ok {
+			break
+		}
+		hops = append(hops, name)
+	}
+	for _, hop := range hops {
+		if at, _ := a.Lookup(hop); at-(a.Offset()+2) >= -128 {
+			a.Label(fmt.Sprintf("to_main_loop%d", len(hops)))
+			a.Ins("bra %s", hop)
+			return
+		}
 	}
+	a.Ins("jmp main_loop")
+}
 
-	patch16 := func(at int, addr uint16) {
-		emitAt(at, byte(addr), byte(addr>>8))
+// decoderRelocs returns the offsets of the high bytes of the absolute
+// addresses in the decoder: adding n to each moves it n pages. They are found
+// by assembling the decoder a page away and comparing.
+func decoderRelocs(p decoderProfile) []int {
+	p = p.placed()
+	code, _ := genDecompressor(p)
+	moved, step := p, byte(1)
+	if moved.origin += 0x100; moved.origin+len(code) > 0x10000 {
+		moved.origin, step = p.origin-0x100, 0xFF
+	}
+	other, _ := genDecompressor(moved)
+	var relocs []int
+	for i := range code {
+		if other[i] != code[i] {
+			if other[i] != code[i]+step {
+				panic(fmt.Sprintf("decoder byte at offset %d is not a relocatable high byte", i))
+			}
+			relocs = append(relocs, i)
+		}
 	}
+	return relocs
+}
 
-	patchRel := func(branchPos int, targetPos int) {
-		offset := targetPos - branchPos - 2
-		emitAt(branchPos+1, byte(offset))
+// relocate returns a copy of decoder code moved by pages pages, using its
+// relocation table.
+func relocate(code []byte, relocs []int, pages int) []byte {
+	out := append([]byte(nil), code...)
+	for _, r := range relocs {
+		out[r] += byte(pages)
 	}
+	return out
+}
 
-	label := func(name string) int {
-		p := pos()
-		labels[name] = p
-		return p
+// genDecompressor assembles the decompressor for the load address and zero
+// page in p. The backward variant mirrors every pointer step and address
+// computation, so stream and output run high to low.
+func genDecompressor(p decoderProfile) ([]byte, map[string]int) {
+	return decoderAssembler(p).MustAssemble()
+}
+
+// decoderAssembler returns the assembler holding the decompressor source for
+// p, not yet assembled.
+func decoderAssembler(p decoderProfile) *asm6502.Assembler {
+	p = p.placed()
+	if p.origin < 0x100 {
+		panic(fmt.Sprintf("decoder load address $%04X is in the zero page", p.origin))
+	}
+	if err := p.zp.check(p.crc, p.sliced); err != nil && !p.smc {
+		panic("decoder zero page: " + err.Error())
+	}
+	if p.speed && p.backward {
+		panic("the speed profile has no backward variant")
+	}
+	if p.sliced && (p.backward || p.speed) {
+		panic("the sliced variant is forward and size profile only")
+	}
+	if p.cmos && p.speed {
+		panic("the 65C02 profile has no speed variant")
+	}
+	if p.smc && (p.backward || p.speed || p.sliced || p.crc) {
+		panic("the self-modifying profile is forward and size profile only")
+	}
+	backward := p.backward
+	g := decoderRing()
+	a := asm6502.New(p.origin)
+	if p.cmos {
+		a.SetCPU(asm6502.CPU65C02)
+	}
+	slots := p.zp.slots(true, true)
+	if p.smc {
+		// The rest are operand labels
+		slots, _ = p.zpSlots()
+	}
+	for _, s := range slots {
+		a.Equ(s.name, s.addr)
 	}
 
-	base := uint16(0x0D00)
+	// readBit shifts the next stream bit into C, preserving A and X: a call in
+	// the size profile, inline in the speed profile, where only the refill
+	// every eighth bit is a call
+	bits := 0
+	readBit := func() {
+		if !p.speed {
+			a.Ins("jsr read_bit")
+			return
+		}
+		bits++
+		a.Ins("asl zp_bitbuf")
+		a.Ins("bne @bit%d", bits)
+		a.Ins("jsr refill")
+		a.Label(fmt.Sprintf("@bit%d", bits))
+	}
 
 	// ==================== ENTRY ====================
-	label("decompress")
+	a.Label("decompress")
 	// Entry: zpOutLo/zpOutHi already set to target address
-	// Compute zpOtherDelta from zpOutHi (< $70 = odd buffer, >= $70 = even buffer)
-	// zpOtherDelta used with SBC (C=1): $A0 gives +$60, $60 gives -$60
-	emit(0xA0, 0x00)         // LDY #0 (Y stays 0 throughout)
-	emit(0xA5, zpOutHi)      // LDA zpOutHi
-	emit(0xC9, 0x70)         // CMP #$70
-	emit(0xA9, 0xA0)         // LDA #$A0 (odd buffer delta)
-	emit(0x90, 0x02)         // BCC +2 (if < $70, keep $A0)
-	emit(0xA9, 0x60)         // LDA #$60 (even buffer delta)
-	label("store_delta")
-	emit(0x85, zpOtherDelta) // STA zpOtherDelta
+	if !p.cmos {
+		a.Ins("ldy #0") // Y stays 0 throughout
+	}
+	if !backward && g.count == 2 {
+		// Compute zpOtherDelta from zpOutHi (< $70 = odd buffer, >= $70 = even buffer)
+		// zpOtherDelta used with SBC (C=1): $A0 gives +$60, $60 gives -$60
+		a.Ins("lda zp_out_hi")
+		a.Ins("cmp #$%02X", g.baseHi(1)) // second buffer
+		a.Ins("lda #$%02X", -g.sizeHi()) // odd buffer delta
+		a.Ins("bcc store_delta")         // below the second buffer: keep it
+		a.Ins("lda #$%02X", g.sizeHi())  // even buffer delta
+		a.Label("store_delta")
+		a.Ins("sta zp_other_delta")
+	} else if !backward {
+		// More buffers: zpOtherDelta holds the page after the output buffer,
+		// where fwdref has to turn down to the buffer below
+		a.Ins("lda zp_out_hi")
+		for i := 1; i < g.count; i++ {
+			a.Ins("ldx #$%02X", g.baseHi(i)) // end of buffer i-1
+			a.Ins("cmp #$%02X", g.baseHi(i)) // base of buffer i
+			a.Ins("bcc store_delta")
+		}
+		a.Ins("ldx #$%02X", g.endHi()) // end of the last buffer
+		a.Label("store_delta")
+		a.Ins("stx zp_other_delta")
+	}
+	if p.sliced {
+		// Between slices the state is in zero page: the pointers, and the
+		// bytes a copy still has to go in zp_val_hi:zp_caller_x, 0 at a
+		// command boundary. Registers and flags are the caller's.
+		p.storeZero(a, "zp_caller_x")
+		p.storeZero(a, "zp_val_hi")
+		a.Label("decompress_slice")
+		a.Ins("cld")
+		if !p.cmos {
+			a.Ins("ldy #0")
+		}
+		a.Ins("ldx zp_caller_x")
+		a.Ins("txa")
+		a.Ins("ora zp_val_hi")
+		a.Ins("beq main_loop")
+		a.Ins("jmp copy_loop") // resume the copy
+		a.Label("suspend")
+		p.storeZero(a, "zp_caller_x") // nothing left to copy
+		p.storeZero(a, "zp_val_hi")
+		a.Ins("sec") // C=1: more to come
+		a.Ins("rts")
+	}
 
 	// ==================== MAIN_LOOP ====================
-	mainLoopPos := label("main_loop")
+	a.Label("main_loop")
+	if p.sliced {
+		a.Ins("lda zp_budget")
+		a.Ins("beq suspend")
+	}
 
 	// Dispatch: X holds 3-adj value for backref d*3+(3-adj) calculation
-	emit(0xA2, 0x01) // LDX #1 (base for backref adj, modified by INX chain)
-	emit(0x20)
-	jsrReadBit1 := placeholder()
-	bccBackref := pos()
-	emit(0x90, 0x00) // BCC set_x3 (backref0: X=1 → INX INX → X=3)
-
-	emit(0x20)
-	jsrReadBit2 := placeholder()
-	bcsNotLiteral := pos()
-	emit(0xB0, 0x00) // BCS @not_literal
+	if p.adjInY() {
+		a.Ins("ldy #1") // Y instead, kept through read_expgol
+	} else {
+		a.Ins("ldx #1") // base for backref adj, modified by INX chain
+	}
+	readBit()
+	if p.speed {
+		// The inline bit reads put set_x3 out of branch range
+		a.Ins("bcs @not_backref0")
+		a.Ins("jmp set_x3") // backref0: X=1 → INX INX → X=3
+		a.Label("@not_backref0")
+	} else {
+		a.Ins("bcc set_x3") // backref0: X=1 → INX INX → X=3
+	}
+	readBit()
+	a.Ins("bcs not_literal")
 
 	// ==================== LITERAL ====================
-	emit(0x8A) // TXA (X=1, sentinel for bit accumulation)
-	literalLoopPos := label("literal_loop")
-	emit(0x20)
-	jsrReadBitLit := placeholder()
-	emit(0x2A) // ROL A
-	bccLoopOffset := literalLoopPos - pos() - 2
-	emit(0x90, byte(bccLoopOffset)) // BCC @loop
+	if p.speed {
+		// All eight bits in a row
+		for i := 0; i < 8; i++ {
+			readBit()
+			a.Ins("rol a")
+		}
+	} else {
+		if p.adjInY() {
+			a.Ins("tya") // Y=1, sentinel for bit accumulation
+		} else {
+			a.Ins("txa") // X=1, sentinel for bit accumulation
+		}
+		a.Label("literal_loop")
+		readBit()
+		a.Ins("rol a")
+		a.Ins("bcc literal_loop")
+	}
 	// No terminator check needed - terminator is now backref with dist.hi >= $80
-	emit(0x91, zpOutLo) // STA (zpOutLo),Y
-	emit(0xE6, zpOutLo) // INC zpOutLo
-	bneToMain := pos()
-	emit(0xD0, 0x00)    // BNE main_loop
-	emit(0xE6, zpOutHi) // INC zpOutHi
-	toMainFromLiteral := mainLoopPos - pos() - 2
-	emit(0xD0, byte(toMainFromLiteral)) // BNE main_loop (always taken)
-	patchRel(bneToMain, mainLoopPos)
-
-	notLiteralPos := label("not_literal")
-	patchRel(bcsNotLiteral, notLiteralPos)
+	switch {
+	case p.smc:
+		// Stored as a one byte copy: X=1 from the sentinel, zp_val_hi=0 at main_loop
+		p.branchAlways(a, "jmp", "copy_store")
+	case backward:
+		a.Ins("sta %s", p.indirect("zp_out_lo"))
+		decPtr(a, "zp_out", "literal_out_lo")
+		p.toMainLoop(a, "bcs main_loop") // C=1 from sentinel shift-out
+	default:
+		a.Ins("sta %s", p.indirect("zp_out_lo"))
+		if p.sliced {
+			a.Ins("dec zp_budget")
+		}
+		a.Ins("inc zp_out_lo")
+		a.Ins("bne main_loop")
+		a.Ins("inc zp_out_hi")
+		p.toMainLoop(a, "bne main_loop") // always taken
+	}
 
+	a.Label("not_literal")
 	// X=1 already set, no manipulation needed
-	emit(0x20)
-	jsrReadBit3 := placeholder()
-	bccBackref1 := pos()
-	emit(0x90, 0x00) // BCC backref_common (backref1: X=1)
-
-	emit(0x20)
-	jsrReadBit4 := placeholder()
-	bccFwdref := pos()
-	emit(0x90, 0x00) // BCC do_fwdref
-
-	emit(0x20)
-	jsrReadBit5 := placeholder()
-	bccBackref2 := pos()
-	emit(0x90, 0x00) // BCC set_x2 (backref2: X=1 → INX → X=2)
+	readBit()
+	a.Ins("bcc backref_common") // backref1: X=1
+	readBit()
+	a.Ins("bcc fwdref")
+	readBit()
+	a.Ins("bcc set_x2") // backref2: X=1 → INX → X=2
 	// C=1 means copyother - fall through (saves BCS branch!)
 
 	// ==================== FWDREF/COPYOTHER ====================
 	// fwdref: C=0 from BCC, copyother: C=1 from fall-through
 	// Save C using PHP, restore with PLP later
-	doFwdrefPos := label("fwdref")
-	patchRel(bccFwdref, doFwdrefPos)
-	emit(0x08) // PHP (save processor status including C)
-	emit(0x20)
-	jsrExpgol3 := placeholder()
-	// Compute zpCopy = dst + dist (A=zpValLo, X=zpValHi, C=0 from read_expgol)
-	emit(0x65, zpOutLo)  // ADC zpOutLo
-	emit(0x85, zpRefLo) // STA zpRefLo
-	emit(0x8A)           // TXA (X=zpValHi from read_expgol)
-	emit(0x65, zpOutHi)  // ADC zpOutHi
-	emit(0x28)           // PLP (restore C: 0 for fwdref, 1 for copyother)
-	bccStoreAndCheck := pos()
-	emit(0x90, 0x00) // BCC @store_and_check (fwdref)
-	// Copyother: SBC zpOtherDelta (C=1 from PLP) to reach other buffer
-	emit(0xE5, zpOtherDelta) // SBC zpOtherDelta ($A0→+$60, $60→-$60)
-
-	storeAndCheckPos := label("store_and_check")
-	patchRel(bccStoreAndCheck, storeAndCheckPos)
-	emit(0xC9, 0xD0) // CMP #$D0
-	bccNoHighWrap := pos()
-	emit(0x90, 0x00) // BCC @no_high_wrap
-	emit(0xE9, 0xC0) // SBC #$C0
-	noHighWrapPos := label("no_high_wrap")
-	patchRel(bccNoHighWrap, noHighWrapPos)
-	bneFwdrefToCopy := pos()
-	emit(0xD0, 0x00) // BNE backref_no_adjust (always taken)
+	a.Label("fwdref")
+	a.Ins("php") // save processor status including C
+	a.Ins("jsr read_expgol")
+	if backward {
+		// Compute zpRef = dst - offset, wrapped into $1000-$CFFF
+		a.Ins("lda zp_out_lo")
+		a.Ins("sec")
+		a.Ins("sbc zp_val_lo")
+		a.Ins("sta zp_ref_lo")
+		a.Ins("lda zp_out_hi")
+		a.Ins("sbc zp_val_hi")
+		a.Ins("bcc fwdref_wrap") // borrow
+		a.Ins("cmp #$%02X", g.startHi())
+		a.Ins("bcs fwdref_no_wrap")
+		a.Label("fwdref_wrap")
+		a.Ins("adc #$%02X", g.ringHi()) // C=0
+		a.Label("fwdref_no_wrap")
+		a.Ins("plp")                   // restore C: 0 for fwdref, 1 for copyother
+		a.Ins("bcc backref_no_adjust") // fwdref
+		// Copyother: another buffer down the ring: second buffer and up → -size, below → +size
+		a.Label("copyother")
+		a.Ins("cmp #$%02X", g.baseHi(1))
+		a.Ins("bcc copyother_add")
+		a.Ins("sbc #$%02X", g.sizeHi()) // C=1
+		p.branchAlways(a, "bne", "backref_no_adjust")
+		a.Label("copyother_add")
+		a.Ins("adc #$%02X", g.sizeHi()) // C=0
+		p.branchAlways(a, "bne", "backref_no_adjust")
+	} else {
+		// Compute zpCopy = dst + dist (A=zpValLo, X=zpValHi, C=0 from read_expgol)
+		a.Ins("adc zp_out_lo")
+		a.Ins("sta zp_ref_lo")
+		a.Ins("txa") // X=zpValHi from read_expgol
+		a.Ins("adc zp_out_hi")
+		a.Ins("plp") // restore C: 0 for fwdref, 1 for copyother
+		if g.count == 2 {
+			a.Ins("bcc store_and_check") // fwdref
+			// Copyother: SBC zpOtherDelta (C=1 from PLP) to reach other buffer
+			p.readByte(a, "sbc", "zp_other_delta") // $A0→+$60, $60→-$60
+			a.Label("store_and_check")
+			a.Ins("cmp #$%02X", g.endHi())
+			a.Ins("bcc no_high_wrap")
+			a.Ins("sbc #$%02X", g.ringHi())
+			a.Label("no_high_wrap")
+			p.branchAlways(a, "bne", "backref_no_adjust")
+		} else {
+			// More buffers: the other buffer is the one below the output
+			// buffer. fwdref past the output buffer turns down two buffers,
+			// copyother goes one buffer down; both wrap below the ring start.
+			a.Ins("bcc fwdref_turn")
+			a.Ins("sbc #$%02X", g.sizeHi()) // C=1
+			a.Ins("bcs fwdref_wrap_low")    // no borrow
+			p.branchAlways(a, "bcc", "fwdref_add_ring")
+			a.Label("fwdref_turn")
+			p.readByte(a, "cmp", "zp_other_delta") // end of the output buffer
+			a.Ins("bcc backref_no_adjust")         // inside it
+			a.Ins("sbc #$%02X", 2*g.sizeHi())      // C=1
+			a.Ins("bcc fwdref_add_ring")           // borrow
+			a.Label("fwdref_wrap_low")
+			a.Ins("cmp #$%02X", g.startHi()) // ring start
+			a.Ins("bcs backref_no_adjust")
+			a.Label("fwdref_add_ring")
+			a.Ins("adc #$%02X", g.ringHi()) // ring size, C=0
+			p.branchAlways(a, "bne", "backref_no_adjust")
+		}
+	}
 
 	// ==================== BACKREF ====================
-	// X adjustment via fall-through INX chain (saves 1 byte vs DEX DEX INX)
-	setX3Pos := label("set_x3")
-	patchRel(bccBackref, setX3Pos) // backref0 enters here: X=1 → 2 → 3
-	emit(0xE8) // INX
-	setX2Pos := label("set_x2")
-	patchRel(bccBackref2, setX2Pos) // backref2 enters here: X=1 → 2
-	emit(0xE8) // INX
-	backrefCommonPos := label("backref_common")
-	patchRel(bccBackref1, backrefCommonPos) // backref1 enters here: X=1
-
-	// X contains adj (1,2,3) - read_expgol will STX zpCallerX at start
-	emit(0x20)
-	jsrExpgol1 := placeholder()
+	// X adjustment via fall-through INX chain (saves 1 byte vs DEX DEX INX),
+	// or INY where Y holds it
+	inc := "inx"
+	if p.adjInY() {
+		inc = "iny"
+	}
+	a.Label("set_x3") // backref0 enters here: X=1 → 2 → 3
+	a.Ins("%s", inc)
+	a.Label("set_x2") // backref2 enters here: X=1 → 2
+	a.Ins("%s", inc)
+	a.Label("backref_common") // backref1 enters here: X=1
+
+	// X contains adj (1,2,3) - read_expgol will STX zpCallerX at start;
+	// Y keeps it through the call as it is
+	a.Ins("jsr read_expgol")
 	// Compute d*3+adj: all lo ops first, then all hi ops
-	// Lo: 2*lo -> 2*lo+adj -> 3*lo+adj, saving carries on stack
-	emit(0x0A)          // ASL A (A=2*lo, C=carry_a)
-	emit(0x08)          // PHP (save carry_a)
-	emit(0x18)          // CLC
-	emit(0x65, zpCallerX) // ADC zpCallerX (A=2*lo+adj, C=carry_b)
-	emit(0x08)          // PHP (save carry_b)
-	emit(0x18)          // CLC
-	emit(0x65, zpValLo) // ADC zpValLo (A=3*lo+adj, C=carry_c)
-	emit(0x85, zpValLo) // STA zpValLo (final lo)
+	if p.adjInY() {
+		// Lo: adj+lo -> adj+lo+2*lo, doubling lo in place, saving carries on stack
+		a.Ins("tya")           // A=adj, C=0 from read_expgol
+		a.Ins("adc zp_val_lo") // A=adj+lo, C=carry_a
+		a.Ins("php")           // save carry_a
+		a.Ins("asl zp_val_lo") // 2*lo, C=carry_b
+		a.Ins("php")           // save carry_b
+		a.Ins("clc")
+		a.Ins("adc zp_val_lo") // A=3*lo+adj, C=carry_c
+	} else {
+		// Lo: 2*lo -> 2*lo+adj -> 3*lo+adj, saving carries on stack
+		a.Ins("asl a") // A=2*lo, C=carry_a
+		a.Ins("php")   // save carry_a
+		a.Ins("clc")
+		p.readByte(a, "adc", "zp_caller_x") // A=2*lo+adj, C=carry_b
+		a.Ins("php")                        // save carry_b
+		a.Ins("clc")
+		p.readByte(a, "adc", "zp_val_lo") // A=3*lo+adj, C=carry_c
+	}
+	a.Ins("sta zp_val_lo") // final lo
 	// Hi: 3*hi + carry_a + carry_b + carry_c
-	emit(0x8A)          // TXA (X=zpValHi from read_expgol, C=carry_c preserved)
-	emit(0x2A)           // ROL A (A=2*hi+carry_c, C=0 since hi<128)
-	emit(0x28)           // PLP (C=carry_b)
-	emit(0x65, zpValHi) // ADC zpValHi (A=3*hi+carry_b+carry_c)
-	emit(0x28)           // PLP (C=carry_a)
-	emit(0x69, 0x00)    // ADC #0 (A=3*hi+all carries)
-	emit(0x85, zpValHi) // STA zpValHi
-	label("compute_copy_src")
-	// Compute copy source = dst - dist
-	// When dist > dst, result is negative and needs adjustment to reach otherDict
-	emit(0xA5, zpOutLo) // LDA zpOutLo
-	emit(0x38)          // SEC
-	emit(0xE5, zpValLo) // SBC zpValLo
-	emit(0x85, zpRefLo) // STA zpRefLo
-	emit(0xA5, zpOutHi)  // LDA zpOutHi
-	emit(0xE5, zpValHi) // SBC zpValHi
-	bccNeedAdjust := pos()
-	emit(0x90, 0x00) // BCC need_adjust (borrow means dist > dst)
-	emit(0xC9, 0x10) // CMP #$10
-	bcsNoAdjust := pos()
-	emit(0xB0, 0x00) // BCS no_adjust (address >= $1000 is valid)
-	needAdjustPos := label("backref_adjust")
-	patchRel(bccNeedAdjust, needAdjustPos)
-	emit(0x69, 0xC0) // ADC #$C0 (convert to otherDict address, C=0)
-	backrefNoAdjustPos := label("backref_no_adjust")
-	patchRel(bcsNoAdjust, backrefNoAdjustPos)
-	patchRel(bneFwdrefToCopy, backrefNoAdjustPos)
-	emit(0x85, zpRefHi) // STA zpRefHi (shared by fwdref and backref)
+	a.Ins("txa")                      // X=zpValHi from read_expgol, C=carry_c preserved
+	a.Ins("rol a")                    // A=2*hi+carry_c, C=0 since hi<128
+	a.Ins("plp")                      // C=carry_b
+	p.readByte(a, "adc", "zp_val_hi") // A=3*hi+carry_b+carry_c
+	a.Ins("plp")                      // C=carry_a
+	a.Ins("adc #0")                   // A=3*hi+all carries
+	a.Ins("sta zp_val_hi")
+	a.Label("compute_copy_src")
+	if backward {
+		// Compute copy source = dst + dist
+		// Results at or above the ring end wrap around to the other end of the ring
+		a.Ins("lda zp_out_lo")
+		a.Ins("clc")
+		a.Ins("adc zp_val_lo")
+		a.Ins("sta zp_ref_lo")
+		a.Ins("lda zp_out_hi")
+		a.Ins("adc zp_val_hi")
+		a.Ins("bcs backref_overflow") // past $FFFF
+		a.Ins("cmp #$%02X", g.endHi())
+		a.Ins("bcc backref_no_adjust")  // below the ring end is valid
+		a.Ins("sbc #$%02X", g.ringHi()) // C=1, no borrow
+		p.branchAlways(a, "bcs", "backref_no_adjust")
+		a.Label("backref_overflow")
+		a.Ins("adc #$%02X", -g.ringHi()-1) // C=1: +$100-ring
+	} else {
+		// Compute copy source = dst - dist
+		// When dist > dst, result is negative and needs adjustment to reach otherDict
+		a.Ins("lda zp_out_lo")
+		a.Ins("sec")
+		a.Ins("sbc zp_val_lo")
+		a.Ins("sta zp_ref_lo")
+		a.Ins("lda zp_out_hi")
+		a.Ins("sbc zp_val_hi")
+		a.Ins("bcc backref_adjust") // borrow means dist > dst
+		a.Ins("cmp #$%02X", g.startHi())
+		a.Ins("bcs backref_no_adjust") // at or above the ring start is valid
+		a.Label("backref_adjust")
+		a.Ins("adc #$%02X", g.ringHi()) // convert to otherDict address, C=0
+	}
+	a.Label("backref_no_adjust")
+	a.Ins("sta zp_ref_hi") // shared by fwdref and backref
 
 	// ==================== COPY_WITH_LENGTH ====================
-	label("copy_with_length")
-	emit(0x20)
-	jsrExpgolLen2 := placeholder()
+	a.Label("copy_with_length")
+	a.Ins("jsr read_expgol")
 	// Add 2 to length (A=zpValLo, C=0 from read_expgol)
-	emit(0x69, 0x02) // ADC #2
-	emit(0xAA)           // TAX (low counter in X)
-	emit(0x90, 0x02)     // BCC +2
-	emit(0xE6, zpValHi) // INC zpValHi
-
-	// ==================== COPY_LOOP ====================
-	label("copy_loop")
-	copyLoopInnerPos := pos()
-	emit(0xB1, zpRefLo) // LDA (zpRefLo),Y
-	emit(0x91, zpOutLo)  // STA (zpOutLo),Y
-	emit(0xE6, zpOutLo)  // INC zpOutLo
-	emit(0xD0, 0x02)     // BNE +2
-	emit(0xE6, zpOutHi)  // INC zpOutHi
-	label("skip_out_hi_inc")
-	emit(0xE6, zpRefLo) // INC zpRefLo
-	emit(0xD0, 0x02)     // BNE +2
-	emit(0xE6, zpRefHi) // INC zpRefHi
-	label("skip_ref_hi_inc")
-	// Decrement counter with early exit (X = low byte)
-	emit(0x8A) // TXA (check X before decrement, sets Z)
-	bneNoBorrow := pos()
-	emit(0xD0, 0x02)     // BNE +2 (no borrow needed)
-	emit(0xC6, zpValHi) // DEC zpValHi (borrow)
-	patchRel(bneNoBorrow, pos())
-	label("skip_val_hi_dec")
-	emit(0xCA)          // DEX
-	emit(0x8A)          // TXA (get decremented X into A)
-	emit(0x05, zpValHi) // ORA zpValHi (A=0 only if both X and zpValHi are 0)
-	bneCopyLoop := copyLoopInnerPos - pos() - 2
-	emit(0xD0, byte(bneCopyLoop)) // BNE copy_loop (continue if counter != 0)
-	emit(0x4C)                    // JMP main_loop (done)
-	jmpMainFromCopy := placeholder()
-	patch16(jmpMainFromCopy, base+uint16(mainLoopPos))
+	a.Ins("adc #2")
+	a.Ins("tax") // low counter in X
+	if p.speed {
+		a.Ins("bcc copy_pages")
+		a.Ins("inc zp_val_hi")
+		genFastCopy(a)
+	} else {
+		a.Ins("bcc copy_loop")
+		a.Ins("inc zp_val_hi")
+		genCopyLoop(a, p, g)
+	}
 
 	// ==================== READ_EXPGOL ====================
-	readExpgolPos := label("read_expgol")
-	patch16(jsrExpgol1, base+uint16(readExpgolPos))
-	patch16(jsrExpgol3, base+uint16(readExpgolPos))
-	patch16(jsrExpgolLen2, base+uint16(readExpgolPos))
-
+	a.Label("read_expgol")
 	// Store caller's X - backref uses this for adjustment value
-	emit(0x86, zpCallerX) // STX zpCallerX
+	if !p.adjInY() {
+		a.Ins("stx zp_caller_x")
+	}
 
 	// Count leading zeros using X (inverted: count down, then INX in read loop)
-	emit(0xA2, 0x01)     // LDX #$01
-	emit(0x86, zpValLo) // STX zpValLo
-	emit(0x84, zpValHi) // STY zpValHi (Y=0)
-	countZerosPos := label("count_zeros")
-	emit(0xCA)                        // DEX
-	emit(0xE0, terminatorThreshold)   // CPX #(256-TERMINATOR_ZEROS)
-	bccTerminatorEarly := pos()
-	emit(0xF0, 0x00)    // BEQ terminator (TERMINATOR_ZEROS zeros = terminator)
-	label("do_read")
-	emit(0x20)
-	jsrReadBitGamma := placeholder()
-	bccCountZeros := countZerosPos - pos() - 2
-	emit(0x90, byte(bccCountZeros)) // BCC @count_zeros
+	a.Ins("ldx #1")
+	a.Ins("stx zp_val_lo")
+	p.storeZero(a, "zp_val_hi")
+	a.Label("count_zeros")
+	a.Ins("dex")
+	a.Ins("cpx #$%02X", terminatorThreshold) // 256-TERMINATOR_ZEROS
+	a.Ins("beq terminator")                  // TERMINATOR_ZEROS zeros = terminator
+	a.Label("do_read")
+	readBit()
+	a.Ins("bcc count_zeros")
 	// X = $00 for 0 zeros, $FF..$F5 for 1-11 zeros (12+ handled above)
-	emit(0x8A) // TXA (sets Z flag)
-	beqGammaDone := pos()
-	emit(0xF0, 0x00) // BEQ @gamma_done (0 zeros = valid)
-
-	readBitsLoopPos := label("read_gamma_bits")
-	emit(0x20)
-	jsrReadBitGamma2 := placeholder()
-	emit(0x26, zpValLo) // ROL zpValLo
-	emit(0x26, zpValHi) // ROL zpValHi
-	emit(0xE8)           // INX
-	bneReadBits := readBitsLoopPos - pos() - 2
-	emit(0xD0, byte(bneReadBits)) // BNE @read_bits
-
-	gammaDonePos := label("gamma_done")
-	patchRel(beqGammaDone, gammaDonePos)
+	a.Ins("txa")            // sets Z flag
+	a.Ins("beq gamma_done") // 0 zeros = valid
+
+	a.Label("read_gamma_bits")
+	readBit()
+	a.Ins("rol zp_val_lo")
+	a.Ins("rol zp_val_hi")
+	a.Ins("inx")
+	a.Ins("bne read_gamma_bits")
 
+	a.Label("gamma_done")
 	// Decrement gamma by 1
-	emit(0xA5, zpValLo) // LDA zpValLo
-	bneNoGammaBorrow := pos()
-	emit(0xD0, 0x00)     // BNE +2
-	emit(0xC6, zpValHi) // DEC zpValHi
-	noGammaBorrowPos := label("dec_gamma")
-	patchRel(bneNoGammaBorrow, noGammaBorrowPos)
-	emit(0xC6, zpValLo) // DEC zpValLo
+	a.Ins("lda zp_val_lo")
+	a.Ins("bne dec_gamma")
+	a.Ins("dec zp_val_hi")
+	a.Label("dec_gamma")
+	a.Ins("dec zp_val_lo")
 
 	// Shift left by 2: (gamma-1)*4
-	emit(0x06, zpValLo) // ASL zpValLo
-	emit(0x26, zpValHi) // ROL zpValHi
-	emit(0x06, zpValLo) // ASL zpValLo
-	emit(0x26, zpValHi) // ROL zpValHi
+	a.Ins("asl zp_val_lo")
+	a.Ins("rol zp_val_hi")
+	a.Ins("asl zp_val_lo")
+	a.Ins("rol zp_val_hi")
 	// Read 2 suffix bits
-	emit(0x98)           // TYA (A=0)
-	emit(0x20)
-	jsrReadBitExp1 := placeholder()
-	emit(0x2A) // ROL A
-	emit(0x20)
-	jsrReadBitExp2 := placeholder()
-	emit(0x2A)           // ROL A (C=0: A is at most 3, bit 7 always 0)
-	emit(0x05, zpValLo) // ORA zpValLo
-	emit(0x85, zpValLo) // STA zpValLo
-	emit(0xA6, zpValHi) // LDX zpValHi (return hi byte in X for callers)
-	emit(0x60)           // RTS
+	if p.cmos {
+		a.Ins("txa") // A=0: the gamma bits leave X at 0
+	} else {
+		a.Ins("tya") // A=0
+	}
+	readBit()
+	a.Ins("rol a")
+	readBit()
+	a.Ins("rol a") // C=0: A is at most 3, bit 7 always 0
+	a.Ins("ora zp_val_lo")
+	a.Ins("sta zp_val_lo")
+	a.Ins("ldx zp_val_hi") // return hi byte in X for callers
+	a.Ins("rts")
+
+	// ==================== TERMINATOR / JUMP ====================
+	// Reached after TERMINATOR_ZEROS zeros; stack holds read_expgol's return address.
+	// Next bit selects the escape: 0 = end of song, 1 = jump to 16-bit address (MSB first)
+	a.Label("terminator")
+	readBit()
+	if p.crc {
+		// Both escapes carry 16 bits (CRC or jump address): read them first
+		a.Ins("php") // escape kind in C
+	} else {
+		a.Ins("bcc stream_end")
+	}
+	// zpValLo=1, zpValHi=0 from read_expgol: the 1 is a sentinel that shifts out after 16 bits
+	a.Label("jump_addr")
+	readBit()
+	a.Ins("rol zp_val_lo")
+	a.Ins("rol zp_val_hi")
+	a.Ins("bcc jump_addr")
+	if p.crc {
+		a.Ins("plp")
+		a.Ins("bcc stream_end") // zpVal = CRC from the stream
+	}
+	a.Ins("lda zp_val_lo")
+	a.Ins("sta zp_src_lo")
+	a.Ins("lda zp_val_hi")
+	a.Ins("sta zp_src_hi")
+	if p.smc {
+		p.storeZero(a, "zp_val_hi") // zp_val_hi=0 at main_loop
+	}
+	a.Ins("lda #$80") // empty bit buffer: next read_bit fetches from new zpSrc
+	a.Ins("sta zp_bitbuf")
+	a.Ins("pla")
+	a.Ins("pla") // drop read_expgol return address
+	p.toMainLoop(a, "jmp main_loop")
+
+	if p.speed {
+		// Inline bit reads call refill when the bit buffer runs empty
+		a.Label("stream_end")
+		a.Ins("pla")
+		a.Ins("pla") // drop read_expgol's return address
+		a.Ins("rts")
+		a.Label("refill")
+		a.Ins("pha")
+		a.Ins("lda (zp_src_lo),y")
+		a.Ins("rol a") // C=1 from sentinel shift-out
+		a.Ins("sta zp_bitbuf")
+		a.Ins("inc zp_src_lo")
+		a.Ins("bne refill_done")
+		a.Ins("inc zp_src_hi")
+		a.Label("refill_done")
+		a.Ins("pla")
+		a.Ins("rts")
+		if p.crc {
+			genCRCVerify(a, p)
+		}
+		return a
+	}
 
 	// ==================== READ_BIT (moved to end) ====================
-	readBitPos := label("read_bit")
-	patch16(jsrReadBit1, base+uint16(readBitPos))
-	patch16(jsrReadBit2, base+uint16(readBitPos))
-	patch16(jsrReadBitLit, base+uint16(readBitPos))
-	patch16(jsrReadBit3, base+uint16(readBitPos))
-	patch16(jsrReadBit4, base+uint16(readBitPos))
-	patch16(jsrReadBit5, base+uint16(readBitPos))
-	patch16(jsrReadBitGamma, base+uint16(readBitPos))
-	patch16(jsrReadBitGamma2, base+uint16(readBitPos))
-	patch16(jsrReadBitExp1, base+uint16(readBitPos))
-	patch16(jsrReadBitExp2, base+uint16(readBitPos))
-
-	emit(0x06, zpBitBuf) // ASL zpBitBuf
-	bneReadBitDone := pos()
-	emit(0xD0, 0x00)     // BNE @done
-	emit(0x48)           // PHA (save original A)
-	emit(0xB1, zpSrcLo)  // LDA (zpSrcLo),Y
-	emit(0x2A)           // ROL A (C=1 from sentinel shift-out)
-	emit(0x85, zpBitBuf) // STA zpBitBuf
-	emit(0xE6, zpSrcLo)  // INC zpSrcLo
-	bneSkipSrcHiInc := pos()
-	emit(0xD0, 0x00)     // BNE skip_src_hi_inc (no page cross)
-	emit(0xE6, zpSrcHi)  // INC zpSrcHi (let it wrap naturally to $00)
-	skipSrcHiIncPos := label("skip_src_hi_inc")
-	patchRel(bneSkipSrcHiInc, skipSrcHiIncPos)
-	emit(0x48) // PHA (push again for shared PLA PLA sequence)
-
-	// ==================== TERMINATOR EXIT ====================
-	// Shared exit: normal path pops [temp][orig_A], terminator pops [ret_lo][ret_hi]
-	terminatorPos := label("terminator")
-	patchRel(bccTerminatorEarly, terminatorPos)
-	emit(0x68) // PLA
-	emit(0x68) // PLA
-	readBitDonePos := label("read_bit_done")
-	patchRel(bneReadBitDone, readBitDonePos)
-	emit(0x60) // RTS
-
-	return code, labels
+	a.Label("read_bit")
+	a.Ins("asl zp_bitbuf")
+	a.Ins("bne read_bit_done")
+	a.Ins("pha") // save original A
+	p.access(a, "lda", "zp_src_lo")
+	a.Ins("rol a") // C=1 from sentinel shift-out
+	a.Ins("sta zp_bitbuf")
+	if backward {
+		decPtr(a, "zp_src", "skip_src_hi_dec") // (original A is on the stack, C is the bit)
+	} else {
+		a.Ins("inc zp_src_lo")
+		a.Ins("bne skip_src_hi_inc") // no page cross
+		a.Ins("inc zp_src_hi")       // let it wrap naturally to $00
+		a.Label("skip_src_hi_inc")
+	}
+	a.Ins("pha") // push again for shared PLA PLA sequence
+
+	// ==================== END OF SONG EXIT ====================
+	// Shared exit: normal path pops [temp][orig_A], end of song pops [ret_lo][ret_hi]
+	a.Label("stream_end")
+	a.Ins("pla")
+	a.Ins("pla")
+	a.Label("read_bit_done")
+	a.Ins("rts")
+
+	if p.crc {
+		genCRCVerify(a, p)
+	}
+
+	return a
+}
+
+// decPtr decrements a zero page pointer (clobbers A, preserves C)
+func decPtr(a *asm6502.Assembler, zp, hiLabel string) {
+	a.Ins("lda %s_lo", zp)
+	a.Ins("bne %s", hiLabel)
+	a.Ins("dec %s_hi", zp)
+	a.Label(hiLabel)
+	a.Ins("dec %s_lo", zp)
+}
+
+// genCopyLoop appends the byte copy of the size profile: zp_val_hi:X bytes
+// from zp_ref to zp_out, moving both pointers one byte at a time. The sliced
+// variant counts each byte against zp_budget and returns when it runs out.
+func genCopyLoop(a *asm6502.Assembler, p decoderProfile, g decoderGeometry) {
+	a.Label("copy_loop")
+	p.access(a, "lda", "zp_ref_lo")
+	if p.smc {
+		a.Label("copy_store") // literals enter here
+	}
+	p.access(a, "sta", "zp_out_lo")
+	if p.backward {
+		decPtr(a, "zp_out", "skip_out_hi_dec")
+		// Decrement zpRef, wrapping below the ring start to the ring end
+		a.Ins("lda zp_ref_lo")
+		a.Ins("bne skip_ref_hi_dec")
+		a.Ins("dec zp_ref_hi")
+		a.Ins("lda zp_ref_hi")
+		a.Ins("cmp #$%02X", g.startHi()-1)
+		a.Ins("bne skip_ref_hi_dec")
+		a.Ins("lda #$%02X", g.endHi()-1)
+		a.Ins("sta zp_ref_hi")
+		a.Label("skip_ref_hi_dec")
+		a.Ins("dec zp_ref_lo")
+	} else {
+		a.Ins("inc zp_out_lo")
+		a.Ins("bne skip_out_hi_inc")
+		a.Ins("inc zp_out_hi")
+		a.Label("skip_out_hi_inc")
+		a.Ins("inc zp_ref_lo")
+		a.Ins("bne skip_ref_hi_inc")
+		a.Ins("inc zp_ref_hi")
+		a.Label("skip_ref_hi_inc")
+	}
+	// Decrement counter with early exit (X = low byte)
+	a.Ins("txa")                 // check X before decrement, sets Z
+	a.Ins("bne skip_val_hi_dec") // no borrow needed
+	a.Ins("dec zp_val_hi")       // borrow
+	a.Label("skip_val_hi_dec")
+	a.Ins("dex")
+	a.Ins("txa")           // get decremented X into A
+	a.Ins("ora zp_val_hi") // A=0 only if both X and zpValHi are 0
+	if p.sliced {
+		a.Ins("beq copy_end")
+		a.Ins("dec zp_budget")
+		a.Ins("bne copy_loop")
+		a.Ins("stx zp_caller_x") // suspended inside the copy
+		a.Ins("sec")             // C=1: more to come
+		a.Ins("rts")
+		a.Label("copy_end")
+		a.Ins("dec zp_budget")
+		p.toMainLoop(a, "jmp main_loop")
+		return
+	}
+	a.Ins("bne copy_loop")           // continue if counter != 0
+	p.toMainLoop(a, "jmp main_loop") // done
+}
+
+// genFastCopy appends the copy of the speed profile: whole pages with Y as
+// the index in a four times unrolled loop, then the X remaining bytes. Bytes
+// are copied in the same order as by genCopyLoop, so overlapping copies
+// repeat the pattern the same way.
+func genFastCopy(a *asm6502.Assembler) {
+	a.Label("copy_pages")
+	a.Ins("lda zp_val_hi")
+	a.Ins("beq copy_rest")
+	a.Label("copy_page")
+	for i := 0; i < 4; i++ {
+		a.Ins("lda (zp_ref_lo),y")
+		a.Ins("sta (zp_out_lo),y")
+		a.Ins("iny")
+	}
+	a.Ins("bne copy_page")
+	a.Ins("inc zp_ref_hi")
+	a.Ins("inc zp_out_hi")
+	a.Ins("dec zp_val_hi")
+	a.Ins("bne copy_page")
+	a.Label("copy_rest")
+	a.Ins("txa")
+	a.Ins("beq copy_done") // whole pages only: Y is back at 0
+	a.Label("copy_byte")
+	a.Ins("lda (zp_ref_lo),y")
+	a.Ins("sta (zp_out_lo),y")
+	a.Ins("iny")
+	a.Ins("dex")
+	a.Ins("bne copy_byte")
+	a.Ins("tya") // advance zp_out by the bytes copied
+	a.Ins("clc")
+	a.Ins("adc zp_out_lo")
+	a.Ins("sta zp_out_lo")
+	a.Ins("bcc copy_out_done")
+	a.Ins("inc zp_out_hi")
+	a.Label("copy_out_done")
+	a.Ins("ldy #0")
+	a.Label("copy_done")
+	a.Ins("jmp main_loop")
+}
+
+// genCRCVerify appends crc_verify: the CRC-16/CCITT-FALSE of zp_ref up to
+// zp_out compared with zp_val, C=1 on mismatch. Bitwise, to stay small.
+func genCRCVerify(a *asm6502.Assembler, p decoderProfile) {
+	a.Label("crc_verify")
+	if !p.cmos {
+		a.Ins("ldy #0")
+	}
+	a.Ins("lda #$FF")
+	a.Ins("sta zp_crc_lo")
+	a.Ins("sta zp_crc_hi")
+	a.Label("crc_byte")
+	a.Ins("lda zp_ref_lo")
+	a.Ins("cmp zp_out_lo")
+	a.Ins("lda zp_ref_hi")
+	a.Ins("sbc zp_out_hi")
+	a.Ins("bcs crc_compare") // zp_ref >= zp_out
+	a.Ins("lda %s", p.indirect("zp_ref_lo"))
+	a.Ins("eor zp_crc_hi")
+	a.Ins("sta zp_crc_hi")
+	a.Ins("ldx #8")
+	a.Label("crc_bit")
+	a.Ins("asl zp_crc_lo")
+	a.Ins("rol zp_crc_hi")
+	a.Ins("bcc crc_no_xor")
+	a.Ins("lda zp_crc_hi")
+	a.Ins("eor #$10") // polynomial $1021
+	a.Ins("sta zp_crc_hi")
+	a.Ins("lda zp_crc_lo")
+	a.Ins("eor #$21")
+	a.Ins("sta zp_crc_lo")
+	a.Label("crc_no_xor")
+	a.Ins("dex")
+	a.Ins("bne crc_bit")
+	a.Ins("inc zp_ref_lo")
+	a.Ins("bne crc_byte")
+	a.Ins("inc zp_ref_hi")
+	p.branchAlways(a, "bne", "crc_byte") // zp_ref stays below $FF00
+	a.Label("crc_compare")
+	a.Ins("lda zp_crc_lo")
+	a.Ins("eor zp_val_lo")
+	a.Ins("bne crc_done")
+	a.Ins("lda zp_crc_hi")
+	a.Ins("eor zp_val_hi")
+	a.Label("crc_done")
+	a.Ins("cmp #1") // C=1 if any bit differs
+	a.Ins("rts")
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"compress/asm6502"
+)
+
+// Disassembly of PRG files: -disasm file.prg prints a ca65 listing. A hints
+// file next to it (file.json) names addresses, marks data regions and gives
+// the header; src/soundemon_original.asm is the listing of
+// original/nin-soundemon.prg with original/nin-soundemon.json.
+
+// disasmHints is the label database of one PRG.
+type disasmHints struct {
+	Header       []string          `json:"header"`    // lines before the code, up to .segment "CODE"
+	Labels       map[string]string `json:"labels"`    // "$0812": "start"
+	Regions      []disasmRegion    `json:"regions"`   // data between the code
+	AutoLabel    string            `json:"autoLabel"` // label format of unnamed branch targets
+	LabelRule    string            `json:"labelRule"` // comment line above each code label
+	Undocumented bool              `json:"undocumented"`
+}
+
+type disasmRegion struct {
+	Start hexInt `json:"start"`
+	End   hexInt `json:"end"` // exclusive
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+}
+
+// disassemblePRG returns the listing of a PRG with the given hints, or with
+// a plain header and every jump target labelled if hints is nil.
+func disassemblePRG(prg []byte, hints *disasmHints) (string, error) {
+	if len(prg) < 3 {
+		return "", fmt.Errorf("%d bytes is too short for a PRG", len(prg))
+	}
+	origin := int(prg[0]) | int(prg[1])<<8
+	code := prg[2:]
+	l := asm6502.Listing{Origin: origin, Labels: make(map[int]string), AutoLabel: "L%04X", LabelJumps: true}
+	var sb strings.Builder
+	if hints == nil {
+		fmt.Fprintf(&sb, "; Load address: $%04X\n; Size:         %d bytes\n\n", origin, len(code))
+		fmt.Fprintf(&sb, ".setcpu \"6502\"\n\n.segment \"LOADADDR\"\n        .word   $%04X\n\n.segment \"CODE\"\n\n", origin)
+		return sb.String() + l.Write(code), nil
+	}
+
+	for key, name := range hints.Labels {
+		var addr hexInt
+		if err := addr.UnmarshalJSON([]byte(strconv.Quote(key))); err != nil {
+			return "", fmt.Errorf("label %s: %w", name, err)
+		}
+		l.Labels[int(addr)] = name
+		l.Entries = append(l.Entries, int(addr))
+	}
+	for _, r := range hints.Regions {
+		if int(r.Start) < origin || int(r.End) > origin+len(code) || r.Start >= r.End {
+			return "", fmt.Errorf("region %q $%04X-$%04X outside the file", r.Name, int(r.Start), int(r.End))
+		}
+		l.Regions = append(l.Regions, asm6502.Region{Start: int(r.Start), End: int(r.End), Type: r.Type, Name: r.Name})
+	}
+	if hints.AutoLabel != "" {
+		l.AutoLabel, l.LabelJumps = hints.AutoLabel, false
+	}
+	if hints.LabelRule != "" {
+		l.LabelRule = "\n" + hints.LabelRule + "\n"
+	}
+	l.Undocumented = hints.Undocumented
+	for _, line := range hints.Header {
+		sb.WriteString(line + "\n")
+	}
+	return sb.String() + l.Write(code), nil
+}
+
+// disasmMain prints the listing of a PRG, using the hints file given or the
+// one next to the PRG.
+func disasmMain(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: -disasm file.prg [hints.json]")
+		os.Exit(1)
+	}
+	prg, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	hintsPath := strings.TrimSuffix(args[0], ".prg") + ".json"
+	if len(args) > 1 {
+		hintsPath = args[1]
+	}
+	var hints *disasmHints
+	if data, err := os.ReadFile(hintsPath); err == nil {
+		hints = &disasmHints{}
+		if err := json.Unmarshal(data, hints); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", hintsPath, err)
+			os.Exit(1)
+		}
+	} else if len(args) > 1 {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	listing, err := disassemblePRG(prg, hints)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	fmt.Print(listing)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+
+	"compress/codec"
+)
+
+// Stream layout: the main stream ends at mainEnd and the last part's final
+// bytes go to tailAddr. A part's margin is the fewest bytes between a byte it
+// writes and the first stream byte it has not read yet above it; a negative
+// margin overwrites stream still needed. With stream.optimize the compressor
+// picks the mainEnd, tail hole and split that make the smallest margin
+// largest; otherwise it reports the margins of the manifest's layout.
+
+// partLead is a part as the decoder reads it.
+type partLead struct {
+	song  int
+	start int   // main stream bit the part starts at
+	base  int   // address of its first output byte
+	bits  []int // part bits read before each output byte is written
+	lead  []int // lead[k]: least first-unread main offset minus output address over bytes 0..k-1
+}
+
+// measureLeads decodes every part, recording how far the decoder has read
+// when it writes each byte. The 6502 decoder fetches a stream byte when it
+// needs its first bit, so after n bits the first unread byte is (n+7)/8.
+func measureLeads(songs map[int][]byte, scratch scratchMap, states map[int]bufferState, results map[int]compressResult) ([]partLead, error) {
+	playlist := project.Songs.Playlist
+	var leads []partLead
+	for part, song := range playlist {
+		self, other := songDicts(song, states)
+		opts := songOptions(song, scratch, self, other)
+		r := codec.NewBitReader(results[song].compressed)
+		d := codec.NewBitDecoder(r, codec.NewMemoryMap(opts), opts, len(songs[song]))
+		p := partLead{song: song, start: bitsBefore(playlist[:part], results), base: songBase(song)}
+		var b [1]byte
+		for {
+			n, err := d.Read(b[:])
+			if n == 0 {
+				if err == io.EOF {
+					break
+				}
+				return nil, fmt.Errorf("part %d: %w", part+1, err)
+			}
+			p.bits = append(p.bits, r.Position())
+		}
+		p.lead = make([]int, len(p.bits)+1)
+		p.lead[0] = math.MaxInt
+		for i, n := range p.bits {
+			p.lead[i+1] = min(p.lead[i], (p.start+n+7)/8-(p.base+i))
+		}
+		leads = append(leads, p)
+	}
+	return leads, nil
+}
+
+// streamSplit is the main/tail split at one command boundary of the last part.
+type streamSplit struct {
+	boundary  int // bit of the last part the tail starts at
+	mainBytes int // all parts before, the last up to boundary, and the jump
+	tailBytes int
+	inMain    int // bytes of the last part written before the jump
+}
+
+// splitBoundary returns the earliest command boundary of the last part whose
+// remainder fits tailSize bytes, or 0 if none does.
+func splitBoundary(boundaries []int, lastBits, tailSize int) int {
+	for _, boundary := range boundaries {
+		if (lastBits-boundary+7)/8 <= tailSize {
+			return boundary
+		}
+	}
+	return 0
+}
+
+// streamSplits returns the splits the compressor can make, one per tail size.
+func streamSplits(leads []partLead, results map[int]compressResult) []streamSplit {
+	playlist := project.Songs.Playlist
+	last := leads[len(leads)-1]
+	lastBits := results[last.song].bitCount
+	jump := &codec.BitWriter{}
+	codec.DefaultOptions().WriteJump(jump, 0)
+
+	var splits []streamSplit
+	for _, boundary := range codec.CommandBoundaries(results[last.song].compressed, codec.DefaultOptions()) {
+		s := streamSplit{
+			boundary:  boundary,
+			mainBytes: (bitsBefore(playlist[:len(playlist)-1], results) + boundary + jump.Bits() + 7) / 8,
+			tailBytes: (lastBits - boundary + 7) / 8,
+			inMain:    sort.Search(len(last.bits), func(i int) bool { return last.bits[i] > boundary }),
+		}
+		if len(splits) > 0 && splits[len(splits)-1].tailBytes == s.tailBytes {
+			continue
+		}
+		splits = append(splits, s)
+	}
+	return splits
+}
+
+// margins returns each part's margin with the stream pieces placed at
+// mainEnd and tailAddr, math.MaxInt for a part with no stream above it.
+func (s streamSplit) margins(leads []partLead, mainEnd, tailAddr int) []int {
+	mainStart := mainEnd + 1 - s.mainBytes
+	tailEnd := tailAddr + s.tailBytes
+	margins := make([]int, len(leads))
+	for i, p := range leads {
+		inMain := len(p.bits)
+		if i == len(leads)-1 {
+			inMain = s.inMain
+		}
+		m := math.MaxInt
+		if k := min(inMain, max(0, mainEnd+1-p.base)); k > 0 {
+			m = min(m, mainStart-1+p.lead[k])
+		}
+		// The tail stays unread until the last part jumps to it
+		if k := min(inMain, max(0, tailEnd-p.base)); k > 0 {
+			m = min(m, tailAddr-p.base-k)
+		}
+		if i == len(leads)-1 {
+			for j := inMain; j < len(p.bits) && p.base+j < tailEnd; j++ {
+				m = min(m, tailAddr+(p.bits[j]-s.boundary+7)/8-(p.base+j)-1)
+			}
+		}
+		margins[i] = m
+	}
+	return margins
+}
+
+// layoutPlan is a placement of the stream pieces and its margins.
+type layoutPlan struct {
+	streamLayout
+	split   streamSplit
+	margins []int
+}
+
+// smallest returns the smallest margin and its part (1-based).
+func (l layoutPlan) smallest() (margin, part int) {
+	margin = math.MaxInt
+	for i, m := range l.margins {
+		if m < margin {
+			margin, part = m, i+1
+		}
+	}
+	return margin, part
+}
+
+// freeRuns returns the runs of memory no region occupies.
+func freeRuns(used []memRegion) []memRegion {
+	var taken [0x10000]bool
+	for _, r := range used {
+		for addr := max(r.Start, 0); addr < min(r.End, len(taken)); addr++ {
+			taken[addr] = true
+		}
+	}
+	var runs []memRegion
+	for addr := 0; addr < len(taken); addr++ {
+		if taken[addr] {
+			continue
+		}
+		r := memRegion{addr, addr, "free"}
+		for r.End < len(taken) && !taken[r.End] {
+			r.End++
+		}
+		runs = append(runs, r)
+		addr = r.End
+	}
+	return runs
+}
+
+// within reports whether r lies inside one of the runs.
+func within(r memRegion, runs []memRegion) bool {
+	for _, run := range runs {
+		if r.Start >= run.Start && r.End <= run.End {
+			return true
+		}
+	}
+	return false
+}
+
+// optimizeLayout tries every split, the top of every free run for the main
+// stream and, for the tail, the top of every free run and of every stretch
+// below a buffer boundary: a tail sitting higher leaves the outputs below it
+// more room, and one that ends at a buffer boundary leaves the buffer above
+// unconstrained.
+func optimizeLayout(leads []partLead, splits []streamSplit, fixed []memRegion) (layoutPlan, error) {
+	free := freeRuns(fixed)
+	var tops []int
+	for _, base := range project.Buffers.Bases {
+		tops = append(tops, int(base), int(base)+project.Buffers.Size)
+	}
+
+	best := layoutPlan{}
+	bestMargin := math.MinInt
+	for _, run := range free {
+		mainEnd := run.End - 1
+		for _, s := range splits {
+			mainRegion := memRegion{mainEnd + 1 - s.mainBytes, mainEnd + 1, "main stream"}
+			if mainRegion.Start < run.Start {
+				continue
+			}
+			var tailFree []memRegion
+			for _, r := range free {
+				if x, ok := r.intersect(memRegion{0, mainRegion.Start, ""}); ok {
+					tailFree = append(tailFree, x)
+				}
+				if x, ok := r.intersect(memRegion{mainRegion.End, 0x10000, ""}); ok {
+					tailFree = append(tailFree, x)
+				}
+			}
+			candidates := append([]int{}, tops...)
+			for _, r := range tailFree {
+				candidates = append(candidates, r.End)
+			}
+			for _, top := range candidates {
+				tail := memRegion{top - s.tailBytes, top, "tail stream"}
+				if !within(tail, tailFree) {
+					continue
+				}
+				margins := s.margins(leads, mainEnd, tail.Start)
+				plan := layoutPlan{streamLayout{Optimize: true, MainEnd: hexInt(mainEnd), TailAddr: hexInt(tail.Start), TailSize: s.tailBytes}, s, margins}
+				if m, _ := plan.smallest(); m > bestMargin {
+					best, bestMargin = plan, m
+				}
+			}
+		}
+	}
+	if bestMargin < 0 {
+		return best, fmt.Errorf("no stream layout keeps the output off unread stream (best margin %d)", bestMargin)
+	}
+	return best, nil
+}
+
+// manifestLayout returns the manifest's layout with its margins.
+func manifestLayout(leads []partLead, splits []streamSplit, results map[int]compressResult) layoutPlan {
+	l := project.Stream
+	last := leads[len(leads)-1]
+	lastBits := results[last.song].bitCount
+	var boundaries []int
+	for _, s := range splits {
+		boundaries = append(boundaries, s.boundary)
+	}
+	boundary := splitBoundary(boundaries, lastBits, l.TailSize)
+	s := splits[0]
+	for _, c := range splits {
+		if c.boundary == boundary {
+			s = c
+		}
+	}
+	return layoutPlan{l, s, s.margins(leads, int(l.MainEnd), int(l.TailAddr))}
+}
+
+// planLayout chooses the stream layout, or takes the manifest's, and prints
+// it with the margin of every part.
+func planLayout(songs map[int][]byte, scratch scratchMap, states map[int]bufferState, results map[int]compressResult) (layoutPlan, error) {
+	leads, err := measureLeads(songs, scratch, states, results)
+	if err != nil {
+		return layoutPlan{}, err
+	}
+	splits := streamSplits(leads, results)
+	fixed, err := sourceRegions()
+	if err != nil {
+		return layoutPlan{}, err
+	}
+
+	var plan layoutPlan
+	if project.Stream.Optimize {
+		if plan, err = optimizeLayout(leads, splits, fixed); err != nil {
+			return plan, err
+		}
+		fmt.Println("\nStream layout (optimized for the smallest margin between output and unread stream):")
+	} else {
+		plan = manifestLayout(leads, splits, results)
+		fmt.Printf("\nStream layout (from %s):\n", project.path)
+	}
+	mainRegion := memRegion{int(plan.MainEnd) + 1 - plan.split.mainBytes, int(plan.MainEnd) + 1, "main stream"}
+	tailRegion := memRegion{int(plan.TailAddr), int(plan.TailAddr) + plan.split.tailBytes, "tail stream"}
+	fmt.Printf("  main %s %6d bytes\n", mainRegion, mainRegion.size())
+	fmt.Printf("  tail %s %6d bytes, part %d split at bit %d\n", tailRegion, tailRegion.size(), len(leads), plan.split.boundary)
+	fmt.Println("  Part  Song  Output       Margin")
+	used := append([]memRegion{}, mainRegion, tailRegion)
+	for i, p := range leads {
+		output := memRegion{p.base, p.base + len(p.bits), "output"}
+		used = append(used, output)
+		margin := "-"
+		if plan.margins[i] != math.MaxInt {
+			margin = strconv.Itoa(plan.margins[i])
+		}
+		fmt.Printf("  %4d  %4d  %s %6s\n", i+1, p.song, output, margin)
+	}
+	margin, part := plan.smallest()
+	fmt.Printf("  Smallest margin: %d bytes (part %d)\n", margin, part)
+
+	// The decoder could move to memory no step ever uses
+	decoderSize := len(GetDecompressorCode())
+	hole := memRegion{}
+	for _, r := range freeRuns(append(fixed, used...)) {
+		if r.size() >= decoderSize && r.size() > hole.size() {
+			hole = r
+		}
+	}
+	if hole.size() > 0 {
+		fmt.Printf("  Decoder (%d bytes) could move to the never-used %s (%d bytes)\n", decoderSize, hole, hole.size())
+	} else {
+		fmt.Printf("  Decoder (%d bytes): no never-used memory holds it\n", decoderSize)
+	}
+	return plan, nil
+}
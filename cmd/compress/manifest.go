@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"compress/codec"
+)
+
+// Project manifest: the tune set, the buffer geometry, the stream layout and
+// the output paths. Everything the compressor and the VM tests used to
+// hardcode for Nine Inch Ninjas comes from here, so another demo's songs can
+// be packed by pointing -manifest at its own file.
+
+const defaultManifestPath = "project.json"
+
+// project is the manifest loaded by main before any mode runs.
+var project *manifest
+
+type manifest struct {
+	Songs   songSet      `json:"songs"`
+	Player  playerEntry  `json:"player"`
+	Program programSet   `json:"program"`
+	Buffers bufferSet    `json:"buffers"`
+	Stream  streamLayout `json:"stream"`
+	Seek    seekPlan     `json:"seek"`
+	Outputs outputPaths  `json:"outputs"`
+
+	path string // file the manifest was read from
+}
+
+// songSet describes the song files and how they are prepared for compression.
+type songSet struct {
+	Count     int         `json:"count"`     // songs 1..Count
+	Playlist  []int       `json:"playlist"`  // play order, 1..Count if empty
+	Path      string      `json:"path"`      // file name pattern, %d is the song number
+	PartTimes string      `json:"partTimes"` // .word frame counts, one per song
+	DeadBytes string      `json:"deadBytes"` // written by -deadbytes
+	Normalize []fillRange `json:"normalize"` // unused bytes set before compression
+}
+
+// fillRange sets song offsets First..Last (inclusive) to Fill.
+type fillRange struct {
+	First hexInt `json:"first"`
+	Last  hexInt `json:"last"`
+	Fill  hexInt `json:"fill"`
+}
+
+// playerEntry holds the player's entry points as offsets from the buffer base.
+type playerEntry struct {
+	Init hexInt `json:"init"` // called once with A=0
+	Play hexInt `json:"play"` // called once per frame
+
+	// Frames each player runs for scratch discovery, 0 for its part length
+	// from the part times include
+	ScratchFrames int `json:"scratchFrames"`
+}
+
+// programSet names the loader program that plays the streams, for -check.
+type programSet struct {
+	Source string `json:"source"` // ca65 source, for its zero page
+	Config string `json:"config"` // ld65 config
+	PRG    string `json:"prg"`    // built program, if make has run
+}
+
+// bufferSet is the output buffer geometry: song N decodes into
+// Bases[(N-1) % len(Bases)] and copies from the buffer below it (the last
+// one for the first buffer), which holds the previous song of the playlist.
+type bufferSet struct {
+	Bases []hexInt `json:"bases"`
+	Size  int      `json:"size"`
+}
+
+// streamLayout places the concatenated stream: the main piece ends at MainEnd,
+// the last song's final bytes (at most TailSize) go to TailAddr. With
+// Optimize the compressor chooses all three and writes them to the layout
+// include, which the test modes then read.
+type streamLayout struct {
+	Optimize bool   `json:"optimize"`
+	MainEnd  hexInt `json:"mainEnd"`
+	TailAddr hexInt `json:"tailAddr"`
+	TailSize int    `json:"tailSize"`
+}
+
+// seekPlan makes parts reachable without decoding the whole chain: a keyframe
+// part is coded with no dictionary, and the parts after it only reference
+// what was decoded since, so decoding can start at any keyframe.
+type seekPlan struct {
+	Keyframes []int `json:"keyframes"` // playlist parts (1-based) besides part 1
+	Budget    int   `json:"budget"`    // cycles a direct jump may take, 0 for no limit
+}
+
+// outputPaths lists the files the compressor writes.
+type outputPaths struct {
+	Build           string `json:"build"`           // per-song streams and reports
+	StreamMain      string `json:"streamMain"`      // main stream piece
+	StreamTail      string `json:"streamTail"`      // tail stream piece
+	DecompressorAsm string `json:"decompressorAsm"` // ca65 decompressor
+	FirstSong       string `json:"firstSong"`       // first part raw, for the SID export
+	LayoutInc       string `json:"layoutInc"`       // stream addresses and sizes, buffers, part count
+	LayoutCfg       string `json:"layoutCfg"`       // the same addresses as ld65 config symbols
+	SelftestInc     string `json:"selftestInc"`     // expected sizes and checksums for the selftest
+	PartTimes       string `json:"partTimes"`       // part times in playlist order
+	SeekInc         string `json:"seekInc"`         // seek tables for the player
+}
+
+// hexInt is an integer written either as a JSON number or as a "$XXXX"
+// string, the way the assembly sources write addresses.
+type hexInt int
+
+func (h *hexInt) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("want a number or a \"$hex\" string, got %s", b)
+		}
+		*h = hexInt(n)
+		return nil
+	}
+	digits, ok := strings.CutPrefix(s, "$")
+	n, err := strconv.ParseUint(digits, 16, 32)
+	if !ok || err != nil {
+		return fmt.Errorf("want a number or a \"$hex\" string, got %q", s)
+	}
+	*h = hexInt(n)
+	return nil
+}
+
+// loadManifest reads and checks a manifest.
+func loadManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{path: path}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(m.Songs.Playlist) == 0 {
+		for song := 1; song <= m.Songs.Count; song++ {
+			m.Songs.Playlist = append(m.Songs.Playlist, song)
+		}
+	}
+	if err := m.check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Paths are relative to the manifest
+	dir := filepath.Dir(path)
+	for _, p := range []*string{&m.Songs.Path, &m.Songs.PartTimes, &m.Songs.DeadBytes,
+		&m.Program.Source, &m.Program.Config, &m.Program.PRG,
+		&m.Outputs.Build, &m.Outputs.StreamMain, &m.Outputs.StreamTail,
+		&m.Outputs.DecompressorAsm, &m.Outputs.FirstSong, &m.Outputs.LayoutInc, &m.Outputs.PartTimes,
+		&m.Outputs.SeekInc, &m.Outputs.LayoutCfg, &m.Outputs.SelftestInc} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, filepath.FromSlash(*p))
+		}
+	}
+	return m, nil
+}
+
+func (m *manifest) check() error {
+	switch {
+	case m.Songs.Count < 1:
+		return fmt.Errorf("songs.count must be at least 1")
+	case !strings.Contains(m.Songs.Path, "%d"):
+		return fmt.Errorf("songs.path %q has no %%d for the song number", m.Songs.Path)
+	case m.Buffers.Size <= 0:
+		return fmt.Errorf("buffers.size must be positive")
+	case m.Stream.Optimize && (m.Stream.MainEnd != 0 || m.Stream.TailAddr != 0 || m.Stream.TailSize != 0):
+		return fmt.Errorf("stream: give either optimize or mainEnd, tailAddr and tailSize")
+	case m.Stream.TailSize < 0 || int(m.Stream.TailAddr)+m.Stream.TailSize > 0x10000:
+		return fmt.Errorf("stream tail $%04X+%d does not fit in memory", int(m.Stream.TailAddr), m.Stream.TailSize)
+	case m.Stream.MainEnd < 0 || m.Stream.MainEnd > 0xFFFF:
+		return fmt.Errorf("stream.mainEnd $%04X is not an address", int(m.Stream.MainEnd))
+	case m.Player.ScratchFrames < 0:
+		return fmt.Errorf("player.scratchFrames must not be negative")
+	}
+	for _, r := range m.Songs.Normalize {
+		if r.First > r.Last || r.Fill < 0 || r.Fill > 0xFF {
+			return fmt.Errorf("bad normalize range $%04X-$%04X fill $%02X", int(r.First), int(r.Last), int(r.Fill))
+		}
+	}
+	// The 6502 decoder addresses the buffers as one ring of whole pages
+	b := m.Buffers
+	switch {
+	case len(b.Bases) < 2:
+		return fmt.Errorf("buffers.bases needs at least two buffers")
+	case b.Size%0x100 != 0 || b.Bases[0]%0x100 != 0 || b.Bases[0] == 0:
+		return fmt.Errorf("buffers must be page aligned and above page 0")
+	case int(b.Bases[0])+len(b.Bases)*b.Size > 0xFF00:
+		return fmt.Errorf("buffers end at $%04X, past $FF00", int(b.Bases[0])+len(b.Bases)*b.Size)
+	}
+	for i, base := range b.Bases {
+		if want := int(b.Bases[0]) + i*b.Size; int(base) != want {
+			return fmt.Errorf("buffer %d at $%04X, want $%04X: buffers must be contiguous", i, int(base), want)
+		}
+	}
+	return m.checkPlaylist()
+}
+
+// checkPlaylist checks the play order. Songs are assembled for their own
+// buffer and the player picks the buffer from the part number, so part P
+// must be a song of buffer (P-1) % len(Bases).
+func (m *manifest) checkPlaylist() error {
+	seen := make(map[int]bool)
+	for i, song := range m.Songs.Playlist {
+		switch {
+		case song < 1 || song > m.Songs.Count:
+			return fmt.Errorf("playlist part %d: no song %d", i+1, song)
+		case seen[song]:
+			return fmt.Errorf("playlist part %d: song %d plays twice", i+1, song)
+		case (song-1)%len(m.Buffers.Bases) != i%len(m.Buffers.Bases):
+			return fmt.Errorf("playlist part %d: song %d is assembled for buffer %d, the player uses buffer %d",
+				i+1, song, (song-1)%len(m.Buffers.Bases), i%len(m.Buffers.Bases))
+		}
+		seen[song] = true
+	}
+	for _, part := range m.Seek.Keyframes {
+		if part < 1 || part > len(m.Songs.Playlist) {
+			return fmt.Errorf("seek.keyframes: no part %d", part)
+		}
+	}
+	if m.Seek.Budget < 0 {
+		return fmt.Errorf("seek.budget must not be negative")
+	}
+	return nil
+}
+
+// setPlaylist overrides the manifest's play order with a comma-separated
+// list of song numbers.
+func (m *manifest) setPlaylist(list string) error {
+	var playlist []int
+	for _, field := range strings.Split(list, ",") {
+		song, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return fmt.Errorf("bad playlist %q", list)
+		}
+		playlist = append(playlist, song)
+	}
+	m.Songs.Playlist = playlist
+	return m.checkPlaylist()
+}
+
+// songBuffer returns the index of the buffer a song decompresses into.
+func songBuffer(song int) int {
+	return (song - 1) % len(project.Buffers.Bases)
+}
+
+// otherBuffer returns the index of the buffer a song copies from: the one
+// below its own, which holds the previous song.
+func otherBuffer(song int) int {
+	n := len(project.Buffers.Bases)
+	return (songBuffer(song) + n - 1) % n
+}
+
+// songBase returns the buffer a song decompresses into.
+func songBase(song int) int {
+	return int(project.Buffers.Bases[songBuffer(song)])
+}
+
+// otherBase returns the buffer a song copies from.
+func otherBase(song int) int {
+	return int(project.Buffers.Bases[otherBuffer(song)])
+}
+
+// decoderRing returns the buffer ring for the 6502 decoder.
+func decoderRing() decoderGeometry {
+	b := project.Buffers
+	return decoderGeometry{start: int(b.Bases[0]), size: b.Size, count: len(b.Bases)}
+}
+
+// isKeyframe reports whether a playlist part (1-based) is coded with no
+// dictionary. Part 1 always is.
+func isKeyframe(part int) bool {
+	return part == 1 || slices.Contains(project.Seek.Keyframes, part)
+}
+
+// seekFrom returns the keyframe a direct jump to part starts decoding at.
+func seekFrom(part int) int {
+	for !isKeyframe(part) {
+		part--
+	}
+	return part
+}
+
+// playedBefore returns the songs of the playlist that play before song since
+// the last keyframe: what a song may find in the buffers.
+func playedBefore(song int) []int {
+	playlist := project.Songs.Playlist
+	i := slices.Index(playlist, song)
+	if i < 0 {
+		return nil
+	}
+	return playlist[seekFrom(i+1)-1 : i]
+}
+
+// prevInBuffer returns the song that played from the same buffer before song,
+// or 0 if the buffer was empty.
+func prevInBuffer(song int) int {
+	prev := 0
+	for _, s := range playedBefore(song) {
+		if songBuffer(s) == songBuffer(song) {
+			prev = s
+		}
+	}
+	return prev
+}
+
+// bufferIndex returns the buffer holding addr and the offset into it.
+func bufferIndex(addr int) (index, offset int, ok bool) {
+	for i, base := range project.Buffers.Bases {
+		if addr >= int(base) && addr < int(base)+project.Buffers.Size {
+			return i, addr - int(base), true
+		}
+	}
+	return 0, 0, false
+}
+
+// bufferSpan returns the lowest buffer address and the end of the highest.
+func bufferSpan() (lo, hi int) {
+	lo = 0x10000
+	for _, base := range project.Buffers.Bases {
+		lo = min(lo, int(base))
+		hi = max(hi, int(base)+project.Buffers.Size)
+	}
+	return lo, hi
+}
+
+// songPath returns the file of a song.
+func songPath(song int) string {
+	return fmt.Sprintf(project.Songs.Path, song)
+}
+
+// mainStreamDest returns the load address of a main stream of n bytes.
+func mainStreamDest(n int) int {
+	return int(project.Stream.MainEnd) + 1 - n
+}
+
+// genLayoutInc returns the stream addresses and sizes stream.inc checks the
+// pieces against, the buffer bases, the number of parts the player plays, the
+// split and the length of the first part's stream, which the SID export skips
+// because it preloads that part, with where its decoder picks up part 2.
+func genLayoutInc(firstPartBits int, main, tail []byte, splitBit int) []byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "; Generated by ./compress from %s - do not edit\n", project.path)
+	fmt.Fprintf(&sb, "STREAM_MAIN_END   = $%04X\n", int(project.Stream.MainEnd))
+	fmt.Fprintf(&sb, "STREAM_MAIN_START = $%04X    ; without the SID export's offset\n", mainStreamDest(len(main)))
+	fmt.Fprintf(&sb, "STREAM_MAIN_BYTES = %d\n", len(main))
+	fmt.Fprintf(&sb, "STREAM_TAIL_DEST  = $%04X\n", int(project.Stream.TailAddr))
+	fmt.Fprintf(&sb, "STREAM_TAIL_BYTES = %d\n", len(tail))
+	fmt.Fprintf(&sb, "SPLIT_BIT         = %-5d    ; bit of the last part the tail starts at\n", splitBit)
+	for i, base := range project.Buffers.Bases {
+		fmt.Fprintf(&sb, "BUFFER%d_BASE      = $%04X\n", i, int(base))
+	}
+	fmt.Fprintf(&sb, "BUFFER_SIZE       = $%04X\n", project.Buffers.Size)
+	fmt.Fprintf(&sb, "PART_COUNT        = %d\n", len(project.Songs.Playlist))
+	fmt.Fprintf(&sb, "FIRST_PART_BITS   = %d\n", firstPartBits)
+	// Part 2 starts mid-byte or, if part 1 ends on a byte boundary, at the
+	// next byte with an empty bit buffer
+	offset, bitbuf := seekEntry(main, firstPartBits)
+	fmt.Fprintf(&sb, "PART2_OFFSET      = %-5d    ; next byte to fetch, from byte FIRST_PART_BITS/8\n", offset-firstPartBits/8)
+	fmt.Fprintf(&sb, "PART2_BITBUF      = $%02X      ; zp_bitbuf with the bits of that byte left for part 2\n", bitbuf)
+	return []byte(sb.String())
+}
+
+// genLayoutCfg returns the layout as an ld65 SYMBOLS section. ld65 configs
+// cannot include files, so the Makefile puts it in front of each config.
+func genLayoutCfg(main, tail []byte) []byte {
+	symbols := [][2]string{
+		{"__STREAM_MAIN_START__", fmt.Sprintf("$%04X", mainStreamDest(len(main)))},
+		{"__STREAM_MAIN_END__", fmt.Sprintf("$%04X", int(project.Stream.MainEnd))},
+		{"__STREAM_TAIL_DEST__", fmt.Sprintf("$%04X", int(project.Stream.TailAddr))},
+		{"__STREAM_TAIL_END__", fmt.Sprintf("$%04X", int(project.Stream.TailAddr)+len(tail)-1)},
+	}
+	for i, base := range project.Buffers.Bases {
+		symbols = append(symbols, [2]string{fmt.Sprintf("__BUFFER%d_BASE__", i), fmt.Sprintf("$%04X", int(base))})
+	}
+	symbols = append(symbols,
+		[2]string{"__BUFFER_SIZE__", fmt.Sprintf("$%04X", project.Buffers.Size)},
+		[2]string{"__PART1_BASE__", fmt.Sprintf("$%04X", songBase(project.Songs.Playlist[0]))})
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Generated by ./compress from %s - do not edit\n", project.path)
+	sb.WriteString("# Stream and buffer layout for ld65; the Makefile prepends it to src/*.cfg\n")
+	sb.WriteString("SYMBOLS {\n")
+	for _, sym := range symbols {
+		fmt.Fprintf(&sb, "    %-23s type = weak, value = %s;\n", sym[0]+":", sym[1])
+	}
+	sb.WriteString("}\n")
+	return []byte(sb.String())
+}
+
+// genSelftestInc returns what the selftest expects of every part, in
+// playlist order, and of the stream pieces.
+func genSelftestInc(songs map[int][]byte, main, tail []byte) []byte {
+	sum := func(data []byte) uint16 {
+		var csum uint16
+		for _, b := range data {
+			csum += uint16(b)
+		}
+		return csum
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "; Generated by ./compress from %s - do not edit\n", project.path)
+	sb.WriteString("\n; Expected checksums of the decompressed parts (16-bit additive)\nselftest_checksums:\n")
+	for part, song := range project.Songs.Playlist {
+		fmt.Fprintf(&sb, "        .word   $%04X               ; Part %d: song %d\n", sum(songs[song]), part+1, song)
+	}
+	sb.WriteString("\n; Part sizes in bytes\nselftest_sizes:\n")
+	for part, song := range project.Songs.Playlist {
+		fmt.Fprintf(&sb, "        .word   %-5d               ; Part %d: song %d\n", len(songs[song]), part+1, song)
+	}
+	sb.WriteString("\n; Part CRCs (CRC-16/CCITT, see crc_verify)\nselftest_crcs:\n")
+	for part, song := range project.Songs.Playlist {
+		fmt.Fprintf(&sb, "        .word   $%04X               ; Part %d: song %d\n", codec.CRC16(songs[song]), part+1, song)
+	}
+	sb.WriteString("\n; Expected stream checksums\n")
+	fmt.Fprintf(&sb, "selftest_stream_main_csum:  .word $%04X\n", sum(main))
+	fmt.Fprintf(&sb, "selftest_stream_tail_csum:  .word $%04X\n", sum(tail))
+	return []byte(sb.String())
+}
+
+// useGeneratedLayout takes the stream addresses the compressor chose from
+// the layout include when the manifest leaves them to the optimizer.
+func (m *manifest) useGeneratedLayout() error {
+	if !m.Stream.Optimize {
+		return nil
+	}
+	values, err := loadEquates(m.Outputs.LayoutInc)
+	if err != nil {
+		return fmt.Errorf("loading stream layout: %w\n(run compressor first: go run ./cmd/compress)", err)
+	}
+	mainEnd, ok1 := values["STREAM_MAIN_END"]
+	tailAddr, ok2 := values["STREAM_TAIL_DEST"]
+	if !ok1 || !ok2 {
+		return fmt.Errorf("%s: no stream addresses", m.Outputs.LayoutInc)
+	}
+	m.Stream.MainEnd, m.Stream.TailAddr = hexInt(mainEnd), hexInt(tailAddr)
+	return nil
+}
+
+// loadEquates reads the NAME = value lines of a generated include.
+func loadEquates(path string) (map[string]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]int)
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, ";")
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		base := 10
+		if hex, ok := strings.CutPrefix(value, "$"); ok {
+			value, base = hex, 16
+		}
+		n, err := strconv.ParseInt(value, base, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, strings.TrimSpace(name), err)
+		}
+		values[strings.TrimSpace(name)] = int(n)
+	}
+	return values, nil
+}
+
+// genPartTimes returns the part times include in playlist order, in the
+// format of the manifest's per-song one.
+func genPartTimes() ([]byte, error) {
+	frames, err := loadPartFrames()
+	if err != nil {
+		return nil, err
+	}
+	const cyclesPerFrame, cyclesPerSecond = 19656, 985248
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "; Generated by ./compress from %s - do not edit\n", project.path)
+	fmt.Fprintf(&sb, "; Part timing data (%d parts x 2 bytes, little-endian frame counts)\n", len(project.Songs.Playlist))
+	total := 0
+	for i, song := range project.Songs.Playlist {
+		n := frames[song]
+		total += n
+		fmt.Fprintf(&sb, "        .word   $%04X               ; Part %d: song %d, %s (%s)\n",
+			n, i+1, song, playTime(n*cyclesPerFrame, cyclesPerSecond), playTime(total*cyclesPerFrame, cyclesPerSecond))
+	}
+	return []byte(sb.String()), nil
+}
+
+// playTime formats a cycle count as minutes:seconds.hundredths.
+func playTime(cycles, cyclesPerSecond int) string {
+	hundredths := (cycles*100 + cyclesPerSecond/2) / cyclesPerSecond
+	return fmt.Sprintf("%2d:%02d.%02d", hundredths/6000, hundredths/100%60, hundredths%100)
+}
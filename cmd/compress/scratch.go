@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+
+	"compress/codec"
+)
+
+// scratchMap holds, per song, the buffer offsets its player writes while the
+// song plays. Those bytes no longer hold the decompressed song afterwards.
+type scratchMap map[int][]codec.Region
+
+// discoverScratch loads a song into its buffer, calls the player's init and
+// play entries for frames frames, and returns the buffer offsets it wrote.
+// Writes outside the song's own buffer are an error: the other buffer holds
+// the next song's dictionary.
+func discoverScratch(data []byte, base uint16, frames int) ([]codec.Region, error) {
+	cpu := NewCPU6502()
+	cpu.LoadAt(base, data)
+
+	size := project.Buffers.Size
+	written := make([]bool, size)
+	var stray error
+	cpu.OnWrite = func(addr uint16) {
+		if addr >= base && int(addr) < int(base)+size {
+			written[addr-base] = true
+		} else if stray == nil {
+			stray = fmt.Errorf("player writes $%04X outside its buffer (PC=$%04X)", addr, cpu.PC)
+		}
+	}
+
+	cpu.A = 0
+	if err := callRoutine(cpu, base+uint16(project.Player.Init), 10000000); err != nil {
+		return nil, fmt.Errorf("init: %w", err)
+	}
+	for frame := 0; frame < frames; frame++ {
+		if err := callRoutine(cpu, base+uint16(project.Player.Play), 1000000); err != nil {
+			return nil, fmt.Errorf("play frame %d: %w", frame, err)
+		}
+	}
+	if stray != nil {
+		return nil, stray
+	}
+
+	var regions []codec.Region
+	for offset := 0; offset < size; offset++ {
+		if written[offset] {
+			regions = addRegion(regions, codec.Region{Start: offset, End: offset + 1})
+		}
+	}
+	return regions, nil
+}
+
+// discoverScratchMap runs scratch discovery for all songs in parallel, each for
+// the manifest's player.scratchFrames or, by default, its part length from the
+// part times include. Past the part length a player may run into bytes that
+// -deadbytes proved unused.
+func discoverScratchMap(songs map[int][]byte) (scratchMap, error) {
+	frames := make(map[int]int)
+	if n := project.Player.ScratchFrames; n > 0 {
+		for song := 1; song <= project.Songs.Count; song++ {
+			frames[song] = n
+		}
+	} else {
+		var err error
+		if frames, err = loadPartFrames(); err != nil {
+			return nil, err
+		}
+	}
+	var wg sync.WaitGroup
+	regions := make([][]codec.Region, project.Songs.Count+1)
+	errs := make([]error, project.Songs.Count+1)
+	for song := 1; song <= project.Songs.Count; song++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			regions[s], errs[s] = discoverScratch(songs[s], uint16(songBase(s)), frames[s])
+		}(song)
+	}
+	wg.Wait()
+
+	m := make(scratchMap)
+	for song := 1; song <= project.Songs.Count; song++ {
+		if errs[song] != nil {
+			return nil, fmt.Errorf("song %d: %w", song, errs[song])
+		}
+		m[song] = regions[song]
+	}
+	return m, nil
+}
+
+// played returns the scratch regions of the songs before song in the playlist
+// that played from the buffer at base: the bytes of that buffer a song may not
+// reference.
+func (m scratchMap) played(song, base int) []codec.Region {
+	var regions []codec.Region
+	for _, s := range playedBefore(song) {
+		if songBase(s) == base {
+			for _, r := range m[s] {
+				regions = addRegion(regions, r)
+			}
+		}
+	}
+	return regions
+}
+
+// addRegion adds r to a sorted list of disjoint regions, merging overlapping
+// and adjacent ones.
+func addRegion(regions []codec.Region, r codec.Region) []codec.Region {
+	i, _ := slices.BinarySearchFunc(regions, r.Start, func(x codec.Region, start int) int {
+		return x.End - start // first region ending at or after r.Start
+	})
+	j := i
+	for j < len(regions) && regions[j].Start <= r.End {
+		r.Start = min(r.Start, regions[j].Start)
+		r.End = max(r.End, regions[j].End)
+		j++
+	}
+	return slices.Replace(regions, i, j, r)
+}
+
+// scratchMain prints the discovered scratch regions of every song. A frame
+// count argument overrides the manifest's.
+func scratchMain(args []string) {
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "Error: bad frame count %q\n", args[0])
+			os.Exit(1)
+		}
+		project.Player.ScratchFrames = n
+	}
+	songs, err := loadSongs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	scratch, err := discoverScratchMap(songs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	length := "full part length"
+	if n := project.Player.ScratchFrames; n > 0 {
+		length = fmt.Sprintf("%d frames", n)
+	}
+	fmt.Printf("Player scratch writes (%s, buffer offsets):\n", length)
+	for song := 1; song <= project.Songs.Count; song++ {
+		fmt.Printf("Song %d ($%04X):", song, songBase(song))
+		total := 0
+		for _, r := range scratch[song] {
+			fmt.Printf(" $%04X-$%04X", r.Start, r.End-1)
+			total += r.End - r.Start
+		}
+		fmt.Printf(" (%d bytes)\n", total)
+	}
+}
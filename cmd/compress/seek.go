@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"compress/codec"
+)
+
+// Seeking: a direct jump to part P decodes the parts from the keyframe at or
+// before P up to P. The compressor reports what the keyframes cost and writes
+// the seek tables for the player; -vmtest decodes every jump from cold
+// buffers and checks it against the cycle budget.
+
+// chainJobs returns the songs and codec options of the parts whose
+// dictionaries the keyframes change, as they would be coded without
+// keyframes. Compressing both shows what the keyframes cost.
+func chainJobs(songs map[int][]byte, scratch scratchMap, states map[int]bufferState) (map[int][]byte, map[int]codec.Options, error) {
+	keyframes := project.Seek.Keyframes
+	project.Seek.Keyframes = nil
+	defer func() { project.Seek.Keyframes = keyframes }()
+
+	chainSongs, err := loadSongs()
+	if err != nil {
+		return nil, nil, err
+	}
+	chainStates := computeBufferStates(chainSongs)
+	opts := make(map[int]codec.Options)
+	for _, song := range project.Songs.Playlist {
+		self, other := songDicts(song, chainStates)
+		keySelf, keyOther := songDicts(song, states)
+		if bytes.Equal(self, keySelf) && bytes.Equal(other, keyOther) && bytes.Equal(chainSongs[song], songs[song]) {
+			continue
+		}
+		opts[song] = songOptions(song, scratch, self, other)
+	}
+	return chainSongs, opts, nil
+}
+
+// printSeekPlan prints what the keyframes cost and the parts a direct jump
+// to each part decodes.
+func printSeekPlan(results map[int]compressResult, chainBits map[int]int) {
+	playlist := project.Songs.Playlist
+	if len(chainBits) > 0 {
+		fmt.Println("\nKeyframe cost (parts coded against the full chain instead):")
+		total := 0
+		for part, song := range playlist {
+			bits, ok := chainBits[song]
+			if !ok {
+				continue
+			}
+			cost := (results[song].bitCount+7)/8 - (bits+7)/8
+			total += cost
+			kind := "after a keyframe"
+			if isKeyframe(part + 1) {
+				kind = "keyframe"
+			}
+			fmt.Printf("  Part %d (song %d, %s): %d bytes, %d in the chain (%+d)\n",
+				part+1, song, kind, (results[song].bitCount+7)/8, (bits+7)/8, cost)
+		}
+		fmt.Printf("  Total: %+d bytes\n", total)
+	}
+
+	fmt.Println("\nSeek plan (parts decoded for a direct jump):")
+	for part := 1; part <= len(playlist); part++ {
+		from := seekFrom(part)
+		bits := 0
+		for _, song := range playlist[from-1 : part] {
+			bits += results[song].bitCount
+		}
+		span := strconv.Itoa(part)
+		if from < part {
+			span = fmt.Sprintf("%d-%d", from, part)
+		}
+		fmt.Printf("  Part %d: %-5s %6d stream bytes\n", part, span, bits/8)
+	}
+}
+
+// seekEntry returns the stream position of bit n of the main stream as the
+// decoder holds it: the offset of the next byte to fetch and the bit buffer,
+// whose sentinel sits below the bits not read yet.
+func seekEntry(main []byte, n int) (offset int, bitbuf byte) {
+	used := n % 8
+	if used == 0 {
+		return n / 8, 0x80
+	}
+	return n/8 + 1, main[n/8]<<used | 1<<(used-1)
+}
+
+// genSeekInc returns the player's seek tables: for each part the keyframe a
+// direct jump starts at, and for each part its stream position. starts holds
+// the main stream bit each part starts at.
+func genSeekInc(main []byte, starts []int) []byte {
+	var from, offset, bitbuf []string
+	for part := 1; part <= len(starts); part++ {
+		o, b := seekEntry(main, starts[part-1])
+		from = append(from, strconv.Itoa(seekFrom(part)-1))
+		offset = append(offset, strconv.Itoa(o))
+		bitbuf = append(bitbuf, fmt.Sprintf("$%02X", b))
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "; Generated by ./compress from %s - do not edit\n", project.path)
+	sb.WriteString("; A direct jump to part P decodes parts seek_from[P-1]+1..P; part N starts at\n")
+	sb.WriteString("; STREAM_MAIN_DEST + seek_offset[N-1] with zp_bitbuf = seek_bitbuf[N-1]\n")
+	fmt.Fprintf(&sb, "SEEK_BUDGET      = %d\n", project.Seek.Budget)
+	fmt.Fprintf(&sb, "seek_from:\n        .byte   %s\n", strings.Join(from, ", "))
+	fmt.Fprintf(&sb, "seek_offset:\n        .word   %s\n", strings.Join(offset, ", "))
+	fmt.Fprintf(&sb, "seek_bitbuf:\n        .byte   %s\n", strings.Join(bitbuf, ", "))
+	return []byte(sb.String())
+}
+
+// partCycles decodes the stream pieces in the VM part after part, as the
+// player does, and returns the cycles each part takes. A direct jump decodes
+// the same bits from the same addresses, so it costs the sum over its parts.
+func partCycles(streamMain, streamTail []byte) ([]uint64, error) {
+	mainStart := mainStreamDest(len(streamMain))
+	cpu := NewCPU6502()
+	cpu.LoadAt(decoderOrigin, GetDecompressorCode())
+	cpu.LoadAt(uint16(mainStart), streamMain)
+	cpu.LoadAt(uint16(project.Stream.TailAddr), streamTail)
+	cpu.Mem[zpSrcLo] = byte(mainStart)
+	cpu.Mem[zpSrcHi] = byte(mainStart >> 8)
+	cpu.Mem[zpBitBuf] = 0x80
+
+	var cycles []uint64
+	for part, song := range project.Songs.Playlist {
+		dst := songBase(song)
+		cpu.Mem[zpOutLo] = byte(dst)
+		cpu.Mem[zpOutHi] = byte(dst >> 8)
+		if err := callRoutine(cpu, decoderOrigin, 20000000); err != nil {
+			return nil, fmt.Errorf("part %d: %w", part+1, err)
+		}
+		cycles = append(cycles, cpu.Cycles)
+	}
+	return cycles, nil
+}
+
+// checkSeekBudget prints the most expensive direct jump of the seek plan and
+// fails if it takes more than seek.budget cycles.
+func checkSeekBudget(streamMain, streamTail []byte) error {
+	cycles, err := partCycles(streamMain, streamTail)
+	if err != nil {
+		return err
+	}
+	worst, worstCycles := 0, uint64(0)
+	for part := 1; part <= len(cycles); part++ {
+		var jump uint64
+		for p := seekFrom(part); p <= part; p++ {
+			jump += cycles[p-1]
+		}
+		if jump > worstCycles {
+			worst, worstCycles = part, jump
+		}
+	}
+	budget := "no budget"
+	if project.Seek.Budget > 0 {
+		budget = fmt.Sprintf("budget %d", project.Seek.Budget)
+	}
+	fmt.Printf("\nWorst direct jump: part %d (parts %d-%d), %d cycles (%s)\n",
+		worst, seekFrom(worst), worst, worstCycles, budget)
+	if project.Seek.Budget > 0 && worstCycles > uint64(project.Seek.Budget) {
+		return fmt.Errorf("a jump to part %d takes %d cycles, over the seek budget of %d", worst, worstCycles, project.Seek.Budget)
+	}
+	return nil
+}
+
+// loadSeekInc reads the tables of a seek include back, by label.
+func loadSeekInc(path string) (map[string][]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readSeekInc(f, path)
+}
+
+// readSeekInc reads the tables of the seek include r, named source in errors.
+func readSeekInc(r io.Reader, source string) (map[string][]int, error) {
+	tables := make(map[string][]int)
+	var label string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), ";")
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutSuffix(line, ":"); ok {
+			label = name
+			continue
+		}
+		values, ok := strings.CutPrefix(line, ".byte")
+		if !ok {
+			values, ok = strings.CutPrefix(line, ".word")
+		}
+		if !ok {
+			continue
+		}
+		for _, v := range strings.Split(values, ",") {
+			v = strings.TrimSpace(v)
+			base := 10
+			if hex, ok := strings.CutPrefix(v, "$"); ok {
+				v, base = hex, 16
+			}
+			n, err := strconv.ParseUint(v, base, 16)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", source, label, err)
+			}
+			tables[label] = append(tables[label], int(n))
+		}
+	}
+	return tables, scanner.Err()
+}
+
+// testSeek jumps to every part from cold buffers: it decodes the parts the
+// seek tables name, starting at the tables' stream position, and checks the
+// output, the memory accesses and the cycle budget.
+func testSeek(songs map[int][]byte, scratch scratchMap) error {
+	fmt.Println("\nSeek Test (direct jump to each part, cold buffers)")
+	fmt.Println("--------------------------------------------------")
+
+	streamMain, err := os.ReadFile(project.Outputs.StreamMain)
+	if err != nil {
+		return err
+	}
+	streamTail, err := os.ReadFile(project.Outputs.StreamTail)
+	if err != nil {
+		return err
+	}
+	tables, err := loadSeekInc(project.Outputs.SeekInc)
+	if err != nil {
+		return fmt.Errorf("loading seek tables: %w\n(run compressor first: go run ./cmd/compress)", err)
+	}
+	playlist := project.Songs.Playlist
+	for _, name := range []string{"seek_from", "seek_offset", "seek_bitbuf"} {
+		if len(tables[name]) != len(playlist) {
+			return fmt.Errorf("%s: %s has %d entries for %d parts", project.Outputs.SeekInc, name, len(tables[name]), len(playlist))
+		}
+	}
+
+	mainStart := mainStreamDest(len(streamMain))
+	lo, hi := bufferSpan()
+	rng := rand.New(rand.NewSource(1))
+	allPassed := true
+	for part := 1; part <= len(playlist); part++ {
+		cpu := NewCPU6502()
+		cpu.LoadAt(decoderOrigin, GetDecompressorCode())
+		garbage := make([]byte, hi-lo)
+		rng.Read(garbage)
+		cpu.LoadAt(uint16(lo), garbage)
+		cpu.LoadAt(uint16(mainStart), streamMain)
+		cpu.LoadAt(uint16(project.Stream.TailAddr), streamTail)
+
+		validator := NewMemoryValidator(scratch)
+		cpu.OnRead = func(addr uint16) {
+			validator.ValidateRead(addr)
+		}
+		cpu.OnWrite = func(addr uint16) {
+			validator.MarkWritten(addr)
+		}
+
+		from := tables["seek_from"][part-1] + 1
+		src := mainStart + tables["seek_offset"][from-1]
+		cpu.Mem[zpSrcLo] = byte(src)
+		cpu.Mem[zpSrcHi] = byte(src >> 8)
+		cpu.Mem[zpBitBuf] = byte(tables["seek_bitbuf"][from-1])
+
+		var cycles uint64
+		status := "OK"
+		for p := from; p <= part && status == "OK"; p++ {
+			song := playlist[p-1]
+			validator.InitForSong(song, songs)
+			dst := songBase(song)
+			cpu.Mem[zpOutLo] = byte(dst)
+			cpu.Mem[zpOutHi] = byte(dst >> 8)
+			if err := callRoutine(cpu, decoderOrigin, 20000000); err != nil {
+				status = fmt.Sprintf("part %d: %v", p, err)
+			} else if !bytes.Equal(cpu.Mem[dst:dst+len(songs[song])], songs[song]) {
+				status = fmt.Sprintf("part %d decodes wrong", p)
+			} else if validator.HasViolations() {
+				status = fmt.Sprintf("part %d: %s", p, validator.Violations()[0])
+			}
+			cycles += cpu.Cycles
+		}
+		if status == "OK" && from != seekFrom(part) {
+			status = fmt.Sprintf("tables start at part %d, the plan at %d", from, seekFrom(part))
+		}
+		if status == "OK" && project.Seek.Budget > 0 && cycles > uint64(project.Seek.Budget) {
+			status = fmt.Sprintf("over the budget of %d cycles", project.Seek.Budget)
+		}
+		if status != "OK" {
+			allPassed = false
+		}
+		fmt.Printf("Part %d: parts %d-%d, %d cycles [%s]\n", part, from, part, cycles, status)
+	}
+	if !allPassed {
+		return fmt.Errorf("seek test failed")
+	}
+	fmt.Println("\nSeek test PASSED!")
+	return nil
+}
+
+// keyframeTestBytes is how much of each song testKeyframeSeek compresses.
+const keyframeTestBytes = 0x1000
+
+// testKeyframeSeek makes the part in the middle of the playlist a keyframe,
+// codes the first keyframeTestBytes of every song for it and jumps to the part
+// after the keyframe from cold buffers. The seek tables must start the jump at
+// the keyframe, and no part decoded from there may read what the parts before
+// the keyframe left in the buffers.
+func testKeyframeSeek(songs map[int][]byte) error {
+	fmt.Println("\nKeyframe Seek Test")
+	fmt.Println("------------------")
+
+	playlist := project.Songs.Playlist
+	if len(playlist) < 3 {
+		fmt.Println("Skipped: needs a playlist of three parts")
+		return nil
+	}
+	saved := project.Seek.Keyframes
+	defer func() { project.Seek.Keyframes = saved }()
+	keyframe := len(playlist)/2 + 1
+	target := keyframe + 1
+	project.Seek.Keyframes = []int{keyframe}
+
+	cut := make(map[int][]byte)
+	for song, data := range songs {
+		cut[song] = data[:min(len(data), keyframeTestBytes)]
+	}
+	states := computeBufferStates(cut)
+	streams := make([][]byte, len(playlist))
+	bitCounts := make([]int, len(playlist))
+	var wg sync.WaitGroup
+	for i, song := range playlist {
+		wg.Add(1)
+		go func(i, s int) {
+			defer wg.Done()
+			selfDict, otherDict := songDicts(s, states)
+			streams[i], bitCounts[i], _ = codec.Compress(cut[s], songOptions(s, nil, selfDict, otherDict))
+		}(i, song)
+	}
+	wg.Wait()
+	var w codec.BitWriter
+	starts := make([]int, len(playlist))
+	for i := range playlist {
+		starts[i] = w.Bits()
+		w.CopyBits(streams[i], bitCounts[i])
+	}
+	streamMain := w.Bytes()
+
+	tables, err := readSeekInc(bytes.NewReader(genSeekInc(streamMain, starts)), "seek tables")
+	if err != nil {
+		return err
+	}
+	from := tables["seek_from"][target-1] + 1
+	if from != keyframe {
+		return fmt.Errorf("a jump to part %d starts at part %d, not at the keyframe %d", target, from, keyframe)
+	}
+
+	// The stream goes above the buffers, the buffers hold garbage
+	lo, hi := bufferSpan()
+	mainStart := 0xFFF0 - len(streamMain)
+	if mainStart < hi {
+		return fmt.Errorf("%d byte stream does not fit above the buffers", len(streamMain))
+	}
+	cpu := NewCPU6502()
+	cpu.LoadAt(decoderOrigin, GetDecompressorCode())
+	garbage := make([]byte, hi-lo)
+	rand.New(rand.NewSource(1)).Read(garbage)
+	cpu.LoadAt(uint16(lo), garbage)
+	cpu.LoadAt(uint16(mainStart), streamMain)
+
+	validator := NewMemoryValidator(nil)
+	cpu.OnRead = func(addr uint16) {
+		validator.ValidateRead(addr)
+	}
+	cpu.OnWrite = func(addr uint16) {
+		validator.MarkWritten(addr)
+	}
+	src := mainStart + tables["seek_offset"][from-1]
+	cpu.Mem[zpSrcLo] = byte(src)
+	cpu.Mem[zpSrcHi] = byte(src >> 8)
+	cpu.Mem[zpBitBuf] = byte(tables["seek_bitbuf"][from-1])
+
+	var cycles uint64
+	for p := from; p <= target; p++ {
+		song := playlist[p-1]
+		validator.InitForSong(song, cut)
+		dst := songBase(song)
+		cpu.Mem[zpOutLo] = byte(dst)
+		cpu.Mem[zpOutHi] = byte(dst >> 8)
+		if err := callRoutine(cpu, decoderOrigin, 2000000); err != nil {
+			return fmt.Errorf("part %d: %w", p, err)
+		}
+		if !bytes.Equal(cpu.Mem[dst:dst+len(cut[song])], cut[song]) {
+			return fmt.Errorf("part %d decodes wrong from the keyframe", p)
+		}
+		if validator.HasViolations() {
+			return fmt.Errorf("part %d: %s", p, validator.Violations()[0])
+		}
+		cycles += cpu.Cycles
+	}
+	fmt.Printf("Keyframe at part %d: jump to part %d decodes parts %d-%d, %d cycles: PASS\n",
+		keyframe, target, from, target, cycles)
+	return nil
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"strings"
+
+	"compress/asm6502"
+)
+
+// The superoptimizer searches for a smaller decoder by rewriting the source
+// the generator assembles: deleting instructions (the CLC and SEC the VM saw
+// never change the carry first), turning a JMP into a branch the flags always
+// take, directly or to another branch to the same place, loading a register
+// from another register, sharing the tails that end in RTS or JMP, and
+// swapping neighbours so that a deletion next to them works. A rewrite is
+// kept only if the decoder still decodes every part of the playlist exactly,
+// with every copy read passing the memory validator and the zero page outside
+// the decoder's untouched. Streams cannot prove a rewrite right for every
+// input, so the result is a report to port by hand.
+
+// rewrite is a candidate change to the decoder source.
+type rewrite struct {
+	desc  string
+	lines []string
+}
+
+// superopt holds what candidates are checked against.
+type superopt struct {
+	p                      decoderProfile
+	songs                  map[int][]byte
+	scratch                scratchMap
+	streamMain, streamTail []byte
+	limits                 []uint64 // cycles per part: twice the generated decoder's
+	candidates, decodes    int
+}
+
+// assemble assembles source lines for the profile's origin and zero page and
+// returns the code and the offset of every line.
+func (s *superopt) assemble(lines []string) ([]byte, []int, error) {
+	a := asm6502.New(s.p.origin)
+	if s.p.cmos {
+		a.SetCPU(asm6502.CPU65C02)
+	}
+	for _, slot := range s.p.zp.slots(true, true) {
+		a.Equ(slot.name, slot.addr)
+	}
+	offsets := make([]int, len(lines))
+	for i, line := range lines {
+		if name, ok := strings.CutSuffix(line, ":"); ok {
+			offsets[i] = a.Label(name)
+		} else {
+			offsets[i] = a.Ins("%s", line)
+		}
+	}
+	code, _, err := a.Assemble()
+	return code, offsets, err
+}
+
+// decode decodes the playlist with code and returns the cycles of each part
+// and the offsets of the CLC and SEC that never changed the carry. Every call
+// starts with A, X, Y and the flags other than D and I random, so a rewrite
+// cannot lean on the VM's reset state. It stops at the first output byte that
+// is wrong or outside the song, and at the first copy read the memory
+// validator rejects.
+func (s *superopt) decode(code []byte) ([]uint64, map[int]bool, error) {
+	p := s.p
+	cpu := NewCPU6502()
+	cpu.CMOS = p.cmos
+	cpu.RefZP = p.zp.ref
+	slot := make(map[int]bool)
+	for _, sl := range p.zp.slots(p.crc, p.sliced) {
+		slot[sl.addr] = true
+	}
+	for addr := 2; addr < 0x100; addr++ {
+		if !slot[addr] {
+			cpu.Mem[addr] = 0xA5
+		}
+	}
+	mainStart := mainStreamDest(len(s.streamMain))
+	cpu.LoadAt(uint16(p.origin), code)
+	cpu.LoadAt(uint16(mainStart), s.streamMain)
+	cpu.LoadAt(uint16(project.Stream.TailAddr), s.streamTail)
+	cpu.Mem[p.zp.src] = byte(mainStart)
+	cpu.Mem[p.zp.src+1] = byte(mainStart >> 8)
+	cpu.Mem[p.zp.bitbuf] = 0x80
+
+	var failed error
+	var song, dst int
+	var target []byte
+	fail := func(format string, args ...any) {
+		if failed == nil {
+			failed = fmt.Errorf("song %d: "+format, append([]any{song}, args...)...)
+		}
+		cpu.Halted = true
+	}
+	validator := NewMemoryValidator(s.scratch)
+	cpu.OnRead = func(addr uint16) {
+		if !validator.ValidateRead(addr) {
+			fail("invalid copy read from $%04X", addr)
+		}
+	}
+	cpu.OnWrite = func(addr uint16) {
+		validator.MarkWritten(addr)
+		if i := int(addr) - dst; i < 0 || i >= len(target) {
+			fail("write to $%04X outside the song", addr)
+		} else if cpu.Mem[addr] != target[i] {
+			fail("wrong byte at offset %d", i)
+		}
+	}
+
+	var cycles []uint64
+	rng := rand.New(rand.NewSource(1))
+	for part, sg := range project.Songs.Playlist {
+		song, dst, target = sg, songBase(sg), s.songs[sg]
+		cpu.A, cpu.X, cpu.Y = byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256))
+		cpu.P = FlagU | FlagI | byte(rng.Intn(256))&(FlagN|FlagV|FlagZ|FlagC)
+		validator.InitForSong(song, s.songs)
+		cpu.Mem[p.zp.out] = byte(dst)
+		cpu.Mem[p.zp.out+1] = byte(dst >> 8)
+		limit := uint64(20000000)
+		if s.limits != nil {
+			limit = s.limits[part]
+		}
+		if err := callRoutine(cpu, uint16(p.origin), limit); err != nil {
+			return nil, nil, fmt.Errorf("song %d: %w", song, err)
+		}
+		if failed != nil {
+			return nil, nil, failed
+		}
+		if !bytes.Equal(cpu.Mem[dst:dst+len(target)], target) {
+			return nil, nil, fmt.Errorf("song %d decoded short", song)
+		}
+		cycles = append(cycles, cpu.Cycles)
+	}
+	for addr := 2; addr < 0x100; addr++ {
+		if !slot[addr] && cpu.Mem[addr] != 0xA5 {
+			return nil, nil, fmt.Errorf("zero page $%02X written", addr)
+		}
+	}
+
+	redundant := make(map[int]bool)
+	for _, op := range []struct{ total, redundant map[uint16]int }{
+		{cpu.CLCTotal, cpu.CLCRedundant},
+		{cpu.SECTotal, cpu.SECRedundant},
+	} {
+		for pc, total := range op.total {
+			if op.redundant[pc] == total {
+				redundant[int(pc)-p.origin] = true
+			}
+		}
+	}
+	return cycles, redundant, nil
+}
+
+// isLabel reports whether a source line is a label.
+func isLabel(line string) bool {
+	return strings.HasSuffix(line, ":")
+}
+
+// where names the routine holding line i: the label before it.
+func where(lines []string, i int) string {
+	for ; i >= 0; i-- {
+		if isLabel(lines[i]) {
+			return strings.TrimSuffix(lines[i], ":")
+		}
+	}
+	return "decompress"
+}
+
+// rewrites returns the candidate rewrites of lines, whose code is code with
+// line offsets offsets. The deletions of flag operations in redundant come
+// first.
+func rewrites(lines []string, code []byte, offsets []int, redundant map[int]bool) []rewrite {
+	size := func(i int) int {
+		for j := i + 1; j < len(lines); j++ {
+			if !isLabel(lines[j]) {
+				return offsets[j] - offsets[i]
+			}
+		}
+		return len(code) - offsets[i]
+	}
+	replace := func(src []string, i, n int, with ...string) []string {
+		return slices.Concat(src[:i], with, src[i+n:])
+	}
+	var out []rewrite
+	for _, first := range []bool{true, false} {
+		for i, line := range lines {
+			if !isLabel(line) && redundant[offsets[i]] == first {
+				out = append(out, rewrite{fmt.Sprintf("delete %q in %s", line, where(lines, i)), replace(lines, i, 1)})
+			}
+		}
+	}
+
+	// A JMP the flags make a branch, a load another register holds
+	branches := []string{"bcc", "bcs", "beq", "bne", "bmi", "bpl", "bvc", "bvs"}
+	transfers := map[string][]string{"lda": {"txa", "tya"}, "ldx": {"tax"}, "ldy": {"tay"}}
+	for i, line := range lines {
+		mnemonic, operand, _ := strings.Cut(line, " ")
+		var with []string
+		switch {
+		case mnemonic == "jmp" && !strings.HasPrefix(operand, "("):
+			for _, b := range branches {
+				with = append(with, b+" "+operand)
+			}
+		case size(i) > 1:
+			with = transfers[mnemonic]
+		}
+		for _, w := range with {
+			out = append(out, rewrite{fmt.Sprintf("replace %q with %q in %s", line, w, where(lines, i)), replace(lines, i, 1, w)})
+		}
+	}
+
+	// A JMP as a branch to another jump to the same target, which the flags
+	// may take on from there
+	hops := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "hop") && isLabel(line) {
+			hops++
+		}
+	}
+	for i, line := range lines {
+		target, ok := strings.CutPrefix(line, "jmp ")
+		if !ok || strings.HasPrefix(target, "(") {
+			continue
+		}
+		for k, other := range lines {
+			mnemonic, operand, _ := strings.Cut(other, " ")
+			if k == i || operand != target || !slices.Contains(branches, mnemonic) {
+				continue
+			}
+			label := fmt.Sprintf("hop%d", hops+1)
+			for _, b := range branches {
+				cand := replace(lines, i, 1, b+" "+label)
+				cand = replace(cand, k, 0, label+":")
+				out = append(out, rewrite{fmt.Sprintf("replace %q in %s with %q to the %q in %s", line, where(lines, i), b, other, where(lines, k)), cand})
+			}
+		}
+	}
+
+	// Shared tails: the instructions before two equal RTS or JMP, the
+	// dropped copy replaced by a jump to the kept one
+	tails := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "tail") && isLabel(line) {
+			tails++
+		}
+	}
+	for drop, line := range lines {
+		if line != "rts" && !strings.HasPrefix(line, "jmp ") {
+			continue
+		}
+		for keep := range lines {
+			if keep == drop || lines[keep] != line {
+				continue
+			}
+			n, saved := 0, 0
+			for keep-n >= 0 && drop-n >= 0 && lines[keep-n] == lines[drop-n] && !isLabel(lines[drop-n]) &&
+				drop-n != keep && keep-n != drop {
+				saved += size(drop - n)
+				n++
+			}
+			label := fmt.Sprintf("tail%d", tails+1)
+			jumps := []string{"jmp " + label}
+			for _, b := range branches {
+				jumps = append(jumps, b+" "+label)
+			}
+			for _, jump := range jumps {
+				if saved <= asmSize(jump) {
+					continue
+				}
+				// Replace the later range first so the earlier index holds
+				start, end := keep-n+1, drop-n+1
+				var cand []string
+				if drop > keep {
+					cand = replace(lines, end, n, jump)
+					cand = replace(cand, start, 0, label+":")
+				} else {
+					cand = replace(lines, start, 0, label+":")
+					cand = replace(cand, end, n, jump)
+				}
+				out = append(out, rewrite{fmt.Sprintf("share the %d-instruction tail of %s with %s (%s)", n, where(lines, drop), where(lines, keep), jump), cand})
+			}
+		}
+	}
+
+	// Swapped neighbours that let a nearby instruction go
+	for i := 0; i+1 < len(lines); i++ {
+		if isLabel(lines[i]) || isLabel(lines[i+1]) {
+			continue
+		}
+		swapped := slices.Clone(lines)
+		swapped[i], swapped[i+1] = swapped[i+1], swapped[i]
+		for j := max(0, i-2); j <= min(len(lines)-1, i+3); j++ {
+			if j == i || j == i+1 || isLabel(lines[j]) {
+				continue
+			}
+			out = append(out, rewrite{fmt.Sprintf("swap %q and %q, delete %q in %s", lines[i], lines[i+1], lines[j], where(lines, j)), replace(swapped, j, 1)})
+		}
+	}
+	return out
+}
+
+// asmSize returns the size of a jump or branch line.
+func asmSize(line string) int {
+	if strings.HasPrefix(line, "jmp ") {
+		return 3
+	}
+	return 2
+}
+
+// search applies the first rewrite that makes the decoder smaller and still
+// passes, and repeats until none does. It returns the smallest source and the
+// rewrites applied.
+func (s *superopt) search(lines []string) ([]string, []string, error) {
+	code, offsets, err := s.assemble(lines)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, redundant, err := s.decode(code)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generated decoder: %w", err)
+	}
+	var steps []string
+	for {
+		improved := false
+		for _, r := range rewrites(lines, code, offsets, redundant) {
+			s.candidates++
+			c, o, err := s.assemble(r.lines)
+			if err != nil || len(c) >= len(code) {
+				continue
+			}
+			s.decodes++
+			_, red, err := s.decode(c)
+			if err != nil {
+				continue
+			}
+			lines, code, offsets, redundant = r.lines, c, o, red
+			step := fmt.Sprintf("%s: %d bytes", r.desc, len(c))
+			fmt.Println("  " + step)
+			steps = append(steps, step)
+			improved = true
+			break
+		}
+		if !improved {
+			return lines, steps, nil
+		}
+	}
+}
+
+// sourceDiff returns a unified diff of two sources with three lines of
+// context, instructions indented as in a listing.
+func sourceDiff(old, cur []string) string {
+	// Longest common subsequence, from the ends
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(cur)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(cur) - 1; j >= 0; j-- {
+			if old[i] == cur[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type edit struct {
+		op   byte // ' ', '-' or '+'
+		line string
+		i, j int // lines of old and cur before it
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(old) || j < len(cur) {
+		switch {
+		case i < len(old) && j < len(cur) && old[i] == cur[j]:
+			edits = append(edits, edit{' ', old[i], i, j})
+			i, j = i+1, j+1
+		case i < len(old) && (j == len(cur) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', old[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', cur[j], i, j})
+			j++
+		}
+	}
+
+	const context = 3
+	var sb strings.Builder
+	fmt.Fprintln(&sb, "--- generated")
+	fmt.Fprintln(&sb, "+++ smallest")
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		// A hunk: changes less than two contexts apart, with context around
+		start, end := max(0, k-context), k
+		for end < len(edits) {
+			next := end
+			for next < len(edits) && edits[next].op == ' ' {
+				next++
+			}
+			if next == len(edits) || next-end > 2*context {
+				break
+			}
+			end = next + 1
+		}
+		end = min(len(edits), end+context)
+		oldLines, curLines := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				oldLines++
+			}
+			if e.op != '-' {
+				curLines++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", edits[start].i+1, oldLines, edits[start].j+1, curLines)
+		for _, e := range edits[start:end] {
+			indent := "        "
+			if isLabel(e.line) {
+				indent = ""
+			}
+			fmt.Fprintf(&sb, "%c%s%s\n", e.op, indent, e.line)
+		}
+		k = end
+	}
+	return sb.String()
+}
+
+// superoptMain searches for the smallest decoder that still decodes the
+// playlist and prints it as a diff against the generated one:
+// -superopt [-65c02].
+func superoptMain(args []string) {
+	var p decoderProfile
+	for _, arg := range args {
+		if arg != "-65c02" {
+			fmt.Fprintln(os.Stderr, "Usage: -superopt [-65c02]")
+			os.Exit(1)
+		}
+		p.cmos = true
+	}
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	songs, err := loadSongs()
+	if err != nil {
+		fail(err)
+	}
+	scratch, err := discoverScratchMap(songs)
+	if err != nil {
+		fail(err)
+	}
+	streamMain, streamTail, err := loadStreamPieces()
+	if err != nil {
+		fail(err)
+	}
+	s := &superopt{p: p.placed(), songs: songs, scratch: scratch, streamMain: streamMain, streamTail: streamTail}
+
+	fmt.Println("Decoder Superoptimizer")
+	fmt.Println("======================")
+	source := decoderAssembler(s.p).Source()
+	code, _ := genDecompressor(s.p)
+	cycles, _, err := s.decode(code)
+	if err != nil {
+		fail(fmt.Errorf("generated decoder: %w", err))
+	}
+	var total uint64
+	for _, c := range cycles {
+		s.limits = append(s.limits, 2*c)
+		total += c
+	}
+	fmt.Printf("Generated decoder: %d bytes, %d cycles\n\n", len(code), total)
+
+	fmt.Println("Rewrites kept:")
+	best, steps, err := s.search(source)
+	if err != nil {
+		fail(err)
+	}
+	if len(steps) == 0 {
+		fmt.Println("  none")
+	}
+	bestCode, _, _ := s.assemble(best)
+	bestCycles, _, _ := s.decode(bestCode)
+	total = 0
+	for _, c := range bestCycles {
+		total += c
+	}
+	fmt.Printf("\n%d candidates, %d decoded\n", s.candidates, s.decodes)
+	fmt.Printf("Smallest variant: %d bytes (%d fewer), %d cycles\n", len(bestCode), len(code)-len(bestCode), total)
+	fmt.Printf("Checked on these %d parts only: port a rewrite to the generator after\n", len(project.Songs.Playlist))
+	fmt.Println("making sure it holds for every stream.")
+	if len(steps) > 0 {
+		fmt.Println()
+		fmt.Print(sourceDiff(source, best))
+	}
+}
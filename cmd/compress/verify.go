@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"compress/codec"
+)
+
+// Staleness check: -verify compresses as usual but keeps the generated files
+// in memory and compares them with the ones on disk, which the Makefile
+// consumes without regenerating. For every stale file it names the change
+// that explains it: the song input, the decoder generator, the split or the
+// layout. It writes nothing.
+
+// artifact is a generated file and its contents.
+type artifact struct {
+	path string
+	data []byte
+}
+
+// staleCheck holds what the compressor computed, to explain stale files.
+type staleCheck struct {
+	songs   map[int][]byte
+	scratch scratchMap
+	states  map[int]bufferState
+	results map[int]compressResult
+	split   int // bit of the last part the tail starts at
+
+	streams string // reason the stream pieces are stale, once computed
+}
+
+// run compares every artifact with the file on disk and reports whether all
+// are up to date.
+func (v *staleCheck) run(generated []artifact) bool {
+	fmt.Println("\nGenerated files (recomputed in memory, nothing written):")
+	stale := 0
+	for _, a := range generated {
+		old, err := os.ReadFile(a.path)
+		status := "up to date"
+		switch {
+		case err != nil:
+			status = "STALE: missing"
+		case !bytes.Equal(old, a.data):
+			status = "STALE: " + v.reason(a, old)
+		}
+		if status != "up to date" {
+			stale++
+		}
+		fmt.Printf("  %-30s %s\n", a.path, status)
+	}
+	if stale > 0 {
+		fmt.Printf("\nVerify: %d of %d generated files stale (run ./compress to regenerate)\n", stale, len(generated))
+		return false
+	}
+	fmt.Println("\nVerify: all generated files up to date")
+	return true
+}
+
+// reason explains why a generated file differs from the one on disk.
+func (v *staleCheck) reason(a artifact, old []byte) string {
+	out := project.Outputs
+	switch a.path {
+	case out.StreamMain, out.StreamTail:
+		if v.streams == "" {
+			v.streams = v.streamReason()
+		}
+		return v.streams
+	case out.DecompressorAsm:
+		return "decoder generator changed (codegen): " + firstDiff(old, a.data)
+	case out.FirstSong:
+		for song, data := range v.songs {
+			if bytes.Equal(old, data) {
+				return fmt.Sprintf("the first part changed from song %d to song %d (playlist)", song, project.Songs.Playlist[0])
+			}
+		}
+		return fmt.Sprintf("song %d input changed", project.Songs.Playlist[0])
+	case out.LayoutInc:
+		return "layout changed: " + equateDiff(old, a.data)
+	case out.LayoutCfg:
+		return "layout changed: " + firstDiff(old, a.data)
+	case out.SelftestInc:
+		return "part sizes or checksums changed (song input or playlist): " + firstDiff(old, a.data)
+	case out.PartTimes:
+		return fmt.Sprintf("part times changed (%s or playlist): %s", project.Songs.PartTimes, firstDiff(old, a.data))
+	case out.SeekInc:
+		return "seek tables changed (part stream positions or keyframes): " + firstDiff(old, a.data)
+	}
+	return firstDiff(old, a.data)
+}
+
+// streamReason decodes the stream pieces on disk, placed where the layout
+// include on disk put them, against the current songs and dictionaries. A
+// part that no longer decodes to its song means the song input changed;
+// parts that decode but are coded differently mean the compressor changed;
+// identical parts mean only the split or the placement moved.
+func (v *staleCheck) streamReason() string {
+	out := project.Outputs
+	main, err := os.ReadFile(out.StreamMain)
+	if err != nil {
+		return "main stream missing"
+	}
+	tail, err := os.ReadFile(out.StreamTail)
+	if err != nil {
+		return "stream tail missing"
+	}
+	layout, err := loadEquates(out.LayoutInc)
+	if err != nil {
+		layout = make(map[string]int)
+	}
+	mainEnd, ok := layout["STREAM_MAIN_END"]
+	if !ok {
+		mainEnd = int(project.Stream.MainEnd)
+	}
+	tailAddr, ok := layout["STREAM_TAIL_DEST"]
+	if !ok {
+		tailAddr = int(project.Stream.TailAddr)
+	}
+	oldSplit, hasSplit := layout["SPLIT_BIT"]
+
+	playlist := project.Songs.Playlist
+	last := len(playlist) - 1
+	r := codec.NewBitReader(main)
+	r.Segments = []codec.Segment{{Addr: mainEnd + 1 - len(main), Data: main}, {Addr: tailAddr, Data: tail}}
+	var recoded []string
+	for part, song := range playlist {
+		start := r.Position()
+		self, other := songDicts(song, v.states)
+		opts := songOptions(song, v.scratch, self, other)
+		got, err := io.ReadAll(codec.NewBitDecoder(r, codec.NewMemoryMap(opts), opts, len(v.songs[song])))
+		if err != nil || !bytes.Equal(got, v.songs[song]) {
+			return fmt.Sprintf("part %d (song %d) no longer decodes from it: song input changed", part+1, song)
+		}
+		res := v.results[song]
+		same := true
+		switch {
+		case part < last:
+			same = r.Position()-start == res.bitCount && sameBits(main, start, res.compressed, 0, res.bitCount)
+		case hasSplit:
+			// The last part runs from its start up to the split, then on
+			// from the start of the tail
+			same = oldSplit+r.Position() == res.bitCount &&
+				sameBits(main, start, res.compressed, 0, oldSplit) &&
+				sameBits(tail, 0, res.compressed, oldSplit, res.bitCount-oldSplit)
+		}
+		if !same {
+			recoded = append(recoded, strconv.Itoa(part+1))
+		}
+	}
+	switch {
+	case len(recoded) > 0:
+		what := "part " + recoded[0] + " is"
+		if len(recoded) > 1 {
+			what = "parts " + strings.Join(recoded, ", ") + " are"
+		}
+		return fmt.Sprintf("the songs still decode, but %s coded differently: compressor changed", what)
+	case hasSplit && oldSplit != v.split:
+		return fmt.Sprintf("same parts, split changed: the tail starts at bit %d of part %d, was %d", v.split, last+1, oldSplit)
+	}
+	return fmt.Sprintf("same parts, placement changed: main ends at $%04X, tail at $%04X (was $%04X, $%04X)",
+		int(project.Stream.MainEnd), int(project.Stream.TailAddr), mainEnd, tailAddr)
+}
+
+// sameBits reports whether n bits of a from bit i equal n bits of b from bit j.
+func sameBits(a []byte, i int, b []byte, j, n int) bool {
+	if n < 0 || (i+n+7)/8 > len(a) || (j+n+7)/8 > len(b) {
+		return false
+	}
+	ra, rb := codec.NewBitReaderAt(a, i), codec.NewBitReaderAt(b, j)
+	for k := 0; k < n; k++ {
+		if ra.ReadBit() != rb.ReadBit() {
+			return false
+		}
+	}
+	return true
+}
+
+// firstDiff describes the first line two text files differ in.
+func firstDiff(old, cur []byte) string {
+	a, b := strings.Split(string(old), "\n"), strings.Split(string(cur), "\n")
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y string
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return fmt.Sprintf("line %d %q, now %q", i+1, strings.TrimSpace(x), strings.TrimSpace(y))
+		}
+	}
+	return "contents differ"
+}
+
+// equateDiff lists the equates of a generated include that changed.
+func equateDiff(old, cur []byte) string {
+	read := func(data []byte) map[string]string {
+		values := make(map[string]string)
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, ";")
+			if name, value, ok := strings.Cut(line, "="); ok {
+				values[strings.TrimSpace(name)] = strings.TrimSpace(value)
+			}
+		}
+		return values
+	}
+	a, b := read(old), read(cur)
+	var changes []string
+	for _, line := range strings.Split(string(cur), "\n") {
+		name, _, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if ok && a[name] != b[name] {
+			was := a[name]
+			if was == "" {
+				was = "none"
+			}
+			changes = append(changes, fmt.Sprintf("%s %s, was %s", name, b[name], was))
+		}
+	}
+	if len(changes) == 0 {
+		return firstDiff(old, cur)
+	}
+	return strings.Join(changes, "; ")
+}
@@ -28,9 +28,29 @@ type CPU6502 struct {
 	SECTotal     map[uint16]int // PC -> total SEC executions
 	SECRedundant map[uint16]int // PC -> count when C already 1
 
+	// Effective address of the last instruction's memory operand (for
+	// JMP/JSR the target), valid if HasEffectiveAddr
+	EffectiveAddr    uint16
+	HasEffectiveAddr bool
+
 	// Memory access callbacks for validation
 	OnRead  func(addr uint16) // Called on memory reads from copy operations
-	OnWrite func(addr uint16) // Called on memory writes to buffers
+	OnWrite func(addr uint16) // Called on every memory write to the buffers
+
+	// The copy reads OnRead sees: LDA (zp),Y and LDA (zp) through the
+	// pointer at RefZP, and LDA abs whose operand sits at RefOperand (the
+	// self-modifying decoder's reference pointer, 0 for none). Reads
+	// through other pointers fetch the stream.
+	RefZP      byte
+	RefOperand uint16
+
+	// Tracked range [TrackStart, TrackEnd): the manifest's buffers
+	TrackStart, TrackEnd int
+
+	// CMOS selects the 65C02: its added opcodes, NOPs for the ones it leaves
+	// undefined, JMP (abs) without the page wrap, N and Z valid after decimal
+	// ADC/SBC, and D cleared by BRK
+	CMOS bool
 }
 
 // Status flag bits
@@ -53,13 +73,15 @@ func NewCPU6502() *CPU6502 {
 		CLCRedundant: make(map[uint16]int),
 		SECTotal:     make(map[uint16]int),
 		SECRedundant: make(map[uint16]int),
+		RefZP:        zpRefLo,
 	}
+	cpu.TrackStart, cpu.TrackEnd = bufferSpan()
 	return cpu
 }
 
 // trackWrite tracks writes to the monitored memory range
 func (c *CPU6502) trackWrite(addr uint16) {
-	if addr >= 0x1000 && addr < 0xD000 {
+	if int(addr) >= c.TrackStart && int(addr) < c.TrackEnd {
 		c.LastWriteAddr = addr
 		c.WriteCount++
 		if c.OnWrite != nil {
@@ -70,7 +92,7 @@ func (c *CPU6502) trackWrite(addr uint16) {
 
 // trackRead tracks reads from buffers (for copy operations)
 func (c *CPU6502) trackRead(addr uint16) {
-	if addr >= 0x1000 && addr < 0xD000 {
+	if int(addr) >= c.TrackStart && int(addr) < c.TrackEnd {
 		if c.OnRead != nil {
 			c.OnRead(addr)
 		}
@@ -125,44 +147,51 @@ func (c *CPU6502) read16(addr uint16) uint16 {
 	return hi<<8 | lo
 }
 
+// effective records addr as the current instruction's operand address.
+func (c *CPU6502) effective(addr uint16) uint16 {
+	c.EffectiveAddr = addr
+	c.HasEffectiveAddr = true
+	return addr
+}
+
 // Addressing mode helpers
 func (c *CPU6502) addrZP() uint16 {
 	addr := uint16(c.Mem[c.PC])
 	c.PC++
-	return addr
+	return c.effective(addr)
 }
 
 func (c *CPU6502) addrZPX() uint16 {
 	addr := uint16(c.Mem[c.PC] + c.X)
 	c.PC++
-	return addr
+	return c.effective(addr)
 }
 
 func (c *CPU6502) addrZPY() uint16 {
 	addr := uint16(c.Mem[c.PC] + c.Y)
 	c.PC++
-	return addr
+	return c.effective(addr)
 }
 
 func (c *CPU6502) addrAbs() uint16 {
 	lo := uint16(c.Mem[c.PC])
 	hi := uint16(c.Mem[c.PC+1])
 	c.PC += 2
-	return hi<<8 | lo
+	return c.effective(hi<<8 | lo)
 }
 
 func (c *CPU6502) addrAbsX() uint16 {
 	lo := uint16(c.Mem[c.PC])
 	hi := uint16(c.Mem[c.PC+1])
 	c.PC += 2
-	return (hi<<8 | lo) + uint16(c.X)
+	return c.effective((hi<<8 | lo) + uint16(c.X))
 }
 
 func (c *CPU6502) addrAbsY() uint16 {
 	lo := uint16(c.Mem[c.PC])
 	hi := uint16(c.Mem[c.PC+1])
 	c.PC += 2
-	return (hi<<8 | lo) + uint16(c.Y)
+	return c.effective((hi<<8 | lo) + uint16(c.Y))
 }
 
 func (c *CPU6502) addrIndX() uint16 {
@@ -170,7 +199,7 @@ func (c *CPU6502) addrIndX() uint16 {
 	c.PC++
 	lo := uint16(c.Mem[zp])
 	hi := uint16(c.Mem[zp+1])
-	return hi<<8 | lo
+	return c.effective(hi<<8 | lo)
 }
 
 func (c *CPU6502) addrIndY() uint16 {
@@ -178,7 +207,7 @@ func (c *CPU6502) addrIndY() uint16 {
 	c.PC++
 	lo := uint16(c.Mem[zp])
 	hi := uint16(c.Mem[zp+1])
-	return (hi<<8 | lo) + uint16(c.Y)
+	return c.effective((hi<<8 | lo) + uint16(c.Y))
 }
 
 func (c *CPU6502) branch(cond bool) {
@@ -210,6 +239,11 @@ func (c *CPU6502) Step() error {
 	opcode := c.Mem[c.PC]
 	c.PC++
 	c.Cycles++
+	c.HasEffectiveAddr = false
+
+	if c.CMOS && c.stepCMOS(opcode) {
+		return nil
+	}
 
 	switch opcode {
 	// LDA
@@ -224,7 +258,12 @@ func (c *CPU6502) Step() error {
 		c.A = c.Mem[c.addrZPX()]
 		c.setNZ(c.A)
 	case 0xAD: // LDA abs
-		c.A = c.Mem[c.addrAbs()]
+		operand := c.PC
+		addr := c.addrAbs()
+		if c.RefOperand != 0 && operand == c.RefOperand {
+			c.trackRead(addr)
+		}
+		c.A = c.Mem[addr]
 		c.setNZ(c.A)
 	case 0xBD: // LDA abs,X
 		c.A = c.Mem[c.addrAbsX()]
@@ -238,9 +277,9 @@ func (c *CPU6502) Step() error {
 	case 0xB1: // LDA (zp),Y
 		zpAddr := c.Mem[c.PC] // Get zero page address before addrIndY increments PC
 		addr := c.addrIndY()
-		// Only track reads from zp_ref ($09) - copy operations
-		// Don't track reads from zp_src ($02) - compressed stream reads
-		if zpAddr == 0x09 {
+		// Only track reads through zp_ref - copy operations
+		// Don't track reads through zp_src - compressed stream reads
+		if zpAddr == c.RefZP {
 			c.trackRead(addr)
 		}
 		c.A = c.Mem[addr]
@@ -314,19 +353,31 @@ func (c *CPU6502) Step() error {
 
 	// STX
 	case 0x86: // STX zp
-		c.Mem[c.addrZP()] = c.X
+		addr := c.addrZP()
+		c.Mem[addr] = c.X
+		c.trackWrite(addr)
 	case 0x96: // STX zp,Y
-		c.Mem[c.addrZPY()] = c.X
+		addr := c.addrZPY()
+		c.Mem[addr] = c.X
+		c.trackWrite(addr)
 	case 0x8E: // STX abs
-		c.Mem[c.addrAbs()] = c.X
+		addr := c.addrAbs()
+		c.Mem[addr] = c.X
+		c.trackWrite(addr)
 
 	// STY
 	case 0x84: // STY zp
-		c.Mem[c.addrZP()] = c.Y
+		addr := c.addrZP()
+		c.Mem[addr] = c.Y
+		c.trackWrite(addr)
 	case 0x94: // STY zp,X
-		c.Mem[c.addrZPX()] = c.Y
+		addr := c.addrZPX()
+		c.Mem[addr] = c.Y
+		c.trackWrite(addr)
 	case 0x8C: // STY abs
-		c.Mem[c.addrAbs()] = c.Y
+		addr := c.addrAbs()
+		c.Mem[addr] = c.Y
+		c.trackWrite(addr)
 
 	// Transfer
 	case 0xAA: // TAX
@@ -363,34 +414,42 @@ func (c *CPU6502) Step() error {
 		addr := c.addrZP()
 		c.Mem[addr]++
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0xF6: // INC zp,X
 		addr := c.addrZPX()
 		c.Mem[addr]++
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0xEE: // INC abs
 		addr := c.addrAbs()
 		c.Mem[addr]++
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0xFE: // INC abs,X
 		addr := c.addrAbsX()
 		c.Mem[addr]++
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0xC6: // DEC zp
 		addr := c.addrZP()
 		c.Mem[addr]--
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0xD6: // DEC zp,X
 		addr := c.addrZPX()
 		c.Mem[addr]--
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0xCE: // DEC abs
 		addr := c.addrAbs()
 		c.Mem[addr]--
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0xDE: // DEC abs,X
 		addr := c.addrAbsX()
 		c.Mem[addr]--
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0xE8: // INX
 		c.X++
 		c.setNZ(c.X)
@@ -503,6 +562,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] <<= 1
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x16: // ASL zp,X
 		addr := c.addrZPX()
 		if c.Mem[addr]&0x80 != 0 {
@@ -512,6 +572,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] <<= 1
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x0E: // ASL abs
 		addr := c.addrAbs()
 		if c.Mem[addr]&0x80 != 0 {
@@ -521,6 +582,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] <<= 1
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x1E: // ASL abs,X
 		addr := c.addrAbsX()
 		if c.Mem[addr]&0x80 != 0 {
@@ -530,6 +592,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] <<= 1
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 
 	// LSR
 	case 0x4A: // LSR A
@@ -549,6 +612,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] >>= 1
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x56: // LSR zp,X
 		addr := c.addrZPX()
 		if c.Mem[addr]&0x01 != 0 {
@@ -558,6 +622,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] >>= 1
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x4E: // LSR abs
 		addr := c.addrAbs()
 		if c.Mem[addr]&0x01 != 0 {
@@ -567,6 +632,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] >>= 1
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x5E: // LSR abs,X
 		addr := c.addrAbsX()
 		if c.Mem[addr]&0x01 != 0 {
@@ -576,6 +642,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] >>= 1
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 
 	// ROL
 	case 0x2A: // ROL A
@@ -597,6 +664,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] = c.Mem[addr]<<1 | carry
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x36: // ROL zp,X
 		addr := c.addrZPX()
 		carry := c.P & FlagC
@@ -607,6 +675,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] = c.Mem[addr]<<1 | carry
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x2E: // ROL abs
 		addr := c.addrAbs()
 		carry := c.P & FlagC
@@ -617,6 +686,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] = c.Mem[addr]<<1 | carry
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x3E: // ROL abs,X
 		addr := c.addrAbsX()
 		carry := c.P & FlagC
@@ -627,6 +697,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] = c.Mem[addr]<<1 | carry
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 
 	// ROR
 	case 0x6A: // ROR A
@@ -648,6 +719,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] = c.Mem[addr]>>1 | carry<<7
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x76: // ROR zp,X
 		addr := c.addrZPX()
 		carry := c.P & FlagC
@@ -658,6 +730,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] = c.Mem[addr]>>1 | carry<<7
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x6E: // ROR abs
 		addr := c.addrAbs()
 		carry := c.P & FlagC
@@ -668,6 +741,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] = c.Mem[addr]>>1 | carry<<7
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 	case 0x7E: // ROR abs,X
 		addr := c.addrAbsX()
 		carry := c.P & FlagC
@@ -678,6 +752,7 @@ func (c *CPU6502) Step() error {
 		}
 		c.Mem[addr] = c.Mem[addr]>>1 | carry<<7
 		c.setNZ(c.Mem[addr])
+		c.trackWrite(addr)
 
 	// ADC
 	case 0x69: // ADC #imm
@@ -787,9 +862,12 @@ func (c *CPU6502) Step() error {
 		c.PC = c.addrAbs()
 	case 0x6C: // JMP (abs)
 		addr := c.addrAbs()
-		// 6502 bug: wraps within page
+		// 6502 bug: wraps within page; fixed on the 65C02
 		lo := uint16(c.Mem[addr])
 		hi := uint16(c.Mem[(addr&0xFF00)|((addr+1)&0xFF)])
+		if c.CMOS {
+			hi = uint16(c.Mem[addr+1])
+		}
 		c.PC = hi<<8 | lo
 
 	// JSR/RTS
@@ -839,6 +917,9 @@ func (c *CPU6502) Step() error {
 		c.push16(c.PC)
 		c.push(c.P | FlagB | FlagU)
 		c.P |= FlagI
+		if c.CMOS {
+			c.P &^= FlagD
+		}
 		c.PC = c.read16(0xFFFE)
 		c.Halted = true // Stop on BRK for testing
 
@@ -850,6 +931,14 @@ func (c *CPU6502) Step() error {
 }
 
 func (c *CPU6502) adc(v byte) {
+	if c.P&FlagD != 0 {
+		c.adcDecimal(v)
+		return
+	}
+	c.adcBinary(v)
+}
+
+func (c *CPU6502) adcBinary(v byte) {
 	carry := uint16(c.P & FlagC)
 	sum := uint16(c.A) + uint16(v) + carry
 	if sum > 0xFF {
@@ -868,8 +957,76 @@ func (c *CPU6502) adc(v byte) {
 }
 
 func (c *CPU6502) sbc(v byte) {
+	if c.P&FlagD != 0 {
+		c.sbcDecimal(v)
+		return
+	}
 	// SBC is ADC with complement
-	c.adc(^v)
+	c.adcBinary(^v)
+}
+
+// adcDecimal is ADC in decimal mode, following Bruce Clark's "Decimal Mode"
+// tutorial, valid BCD operands or not. The NMOS 6502 takes N and V from the
+// sum before the high digit is adjusted and Z from the binary sum; the 65C02
+// takes N and Z from the result.
+func (c *CPU6502) adcDecimal(v byte) {
+	a, b, carry := int(c.A), int(v), int(c.P&FlagC)
+	lo := a&0x0F + b&0x0F + carry
+	if lo >= 0x0A {
+		lo = (lo+0x06)&0x0F + 0x10
+	}
+	sum := a&0xF0 + b&0xF0 + lo
+	signed := int(int8(c.A&0xF0)) + int(int8(v&0xF0)) + lo
+	binary := byte(a + b + carry)
+	if sum >= 0xA0 {
+		sum += 0x60
+	}
+
+	c.P &^= FlagC | FlagV
+	if sum >= 0x100 {
+		c.P |= FlagC
+	}
+	if signed < -128 || signed > 127 {
+		c.P |= FlagV
+	}
+	c.A = byte(sum)
+	if c.CMOS {
+		c.setNZ(c.A)
+	} else {
+		c.setN(byte(signed))
+		c.setZ(binary)
+	}
+}
+
+// sbcDecimal is SBC in decimal mode. C and V come from the binary
+// difference on both CPUs, and N and Z too on the NMOS 6502.
+func (c *CPU6502) sbcDecimal(v byte) {
+	a, b, borrow := int(c.A), int(v), 1-int(c.P&FlagC)
+	c.adcBinary(^v)
+
+	lo := a&0x0F - b&0x0F - borrow
+	var diff int
+	if c.CMOS {
+		diff = a - b - borrow
+		if diff < 0 {
+			diff -= 0x60
+		}
+		if lo < 0 {
+			diff -= 0x06
+		}
+	} else {
+		if lo < 0 {
+			lo = (lo-0x06)&0x0F - 0x10
+		}
+		diff = a&0xF0 - b&0xF0 + lo
+		if diff < 0 {
+			diff -= 0x60
+		}
+	}
+	c.A = byte(diff)
+	if c.CMOS {
+		c.setNZ(c.A)
+	}
 }
 
 // Run executes until halted or breakpoint
@@ -0,0 +1,146 @@
+package main
+
+// stepCMOS executes opcode if it is one the 65C02 adds or leaves undefined,
+// and reports whether it was. Opcodes the 65C02 changes are handled in Step.
+func (c *CPU6502) stepCMOS(opcode byte) bool {
+	switch opcode {
+	// (zp) addressing
+	case 0x12: // ORA (zp)
+		c.A |= c.Mem[c.addrZPInd()]
+		c.setNZ(c.A)
+	case 0x32: // AND (zp)
+		c.A &= c.Mem[c.addrZPInd()]
+		c.setNZ(c.A)
+	case 0x52: // EOR (zp)
+		c.A ^= c.Mem[c.addrZPInd()]
+		c.setNZ(c.A)
+	case 0x72: // ADC (zp)
+		c.adc(c.Mem[c.addrZPInd()])
+	case 0x92: // STA (zp)
+		addr := c.addrZPInd()
+		c.Mem[addr] = c.A
+		c.trackWrite(addr)
+	case 0xB2: // LDA (zp)
+		zpAddr := c.Mem[c.PC]
+		addr := c.addrZPInd()
+		// Only track reads through zp_ref, as for LDA (zp),Y
+		if zpAddr == c.RefZP {
+			c.trackRead(addr)
+		}
+		c.A = c.Mem[addr]
+		c.setNZ(c.A)
+	case 0xD2: // CMP (zp)
+		c.compare(c.A, c.Mem[c.addrZPInd()])
+	case 0xF2: // SBC (zp)
+		c.sbc(c.Mem[c.addrZPInd()])
+
+	// STZ
+	case 0x64: // STZ zp
+		c.stz(c.addrZP())
+	case 0x74: // STZ zp,X
+		c.stz(c.addrZPX())
+	case 0x9C: // STZ abs
+		c.stz(c.addrAbs())
+	case 0x9E: // STZ abs,X
+		c.stz(c.addrAbsX())
+
+	// Stack
+	case 0xDA: // PHX
+		c.push(c.X)
+	case 0xFA: // PLX
+		c.X = c.pop()
+		c.setNZ(c.X)
+	case 0x5A: // PHY
+		c.push(c.Y)
+	case 0x7A: // PLY
+		c.Y = c.pop()
+		c.setNZ(c.Y)
+
+	// INC/DEC A
+	case 0x1A: // INC A
+		c.A++
+		c.setNZ(c.A)
+	case 0x3A: // DEC A
+		c.A--
+		c.setNZ(c.A)
+
+	// BIT
+	case 0x89: // BIT #imm: Z only
+		c.setZ(c.A & c.Mem[c.PC])
+		c.PC++
+	case 0x34: // BIT zp,X
+		v := c.Mem[c.addrZPX()]
+		c.setZ(c.A & v)
+		c.P = c.P&^(FlagN|FlagV) | (v & (FlagN | FlagV))
+	case 0x3C: // BIT abs,X
+		v := c.Mem[c.addrAbsX()]
+		c.setZ(c.A & v)
+		c.P = c.P&^(FlagN|FlagV) | (v & (FlagN | FlagV))
+
+	// TSB/TRB: Z from A AND memory, then set or clear A's bits in memory
+	case 0x04: // TSB zp
+		c.tsb(c.addrZP(), true)
+	case 0x0C: // TSB abs
+		c.tsb(c.addrAbs(), true)
+	case 0x14: // TRB zp
+		c.tsb(c.addrZP(), false)
+	case 0x1C: // TRB abs
+		c.tsb(c.addrAbs(), false)
+
+	// BRA, JMP (abs,X)
+	case 0x80: // BRA
+		c.branch(true)
+	case 0x7C: // JMP (abs,X)
+		c.PC = c.read16(c.addrAbsX())
+
+	default:
+		n := reservedNOPSize(opcode)
+		if n == 0 {
+			return false
+		}
+		c.PC += n - 1 // operand bytes, never read
+	}
+	return true
+}
+
+// reservedNOPSize returns the length of the NOP the 65C02 executes for an
+// opcode it leaves undefined, 0 for a defined one. Undocumented NMOS opcodes
+// land here, so code relying on them runs on but goes wrong.
+func reservedNOPSize(opcode byte) uint16 {
+	switch {
+	case opcode&0x03 == 0x03: // $x3, $x7, $xB, $xF (no Rockwell bit instructions)
+		return 1
+	case opcode&0x1F == 0x02 && opcode != 0xA2: // $02-$E2 but LDX #imm
+		return 2
+	case opcode == 0x44 || opcode == 0x54 || opcode == 0xD4 || opcode == 0xF4:
+		return 2
+	case opcode == 0x5C || opcode == 0xDC || opcode == 0xFC:
+		return 3
+	}
+	return 0
+}
+
+// addrZPInd is the 65C02's (zp) mode: (zp),Y without the Y.
+func (c *CPU6502) addrZPInd() uint16 {
+	zp := c.Mem[c.PC]
+	c.PC++
+	lo := uint16(c.Mem[zp])
+	hi := uint16(c.Mem[zp+1])
+	return c.effective(hi<<8 | lo)
+}
+
+func (c *CPU6502) stz(addr uint16) {
+	c.Mem[addr] = 0
+	c.trackWrite(addr)
+}
+
+// tsb is TSB if set, TRB otherwise.
+func (c *CPU6502) tsb(addr uint16, set bool) {
+	c.setZ(c.A & c.Mem[addr])
+	if set {
+		c.Mem[addr] |= c.A
+	} else {
+		c.Mem[addr] &^= c.A
+	}
+	c.trackWrite(addr)
+}
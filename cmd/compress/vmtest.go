@@ -3,175 +3,121 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
+
+	"compress/asm6502"
+	"compress/codec"
 )
 
 // MemoryValidator tracks which memory regions are valid for reading
 // and detects invalid memory accesses during decompression.
 type MemoryValidator struct {
-	// Buffer state tracking
-	buf1000Valid [bufferSize]bool // Which bytes in $1000-$6FFF are valid
-	buf7000Valid [bufferSize]bool // Which bytes in $7000-$CFFF are valid
+	// Buffer state tracking: which bytes of each manifest buffer are valid
+	valid [][]bool
 
 	// Current decompression state
-	currentSong   int
-	selfBuffer    uint16 // $1000 or $7000
-	outputPos     uint16 // Current output position within buffer
+	currentSong int
+	selfBuffer  int    // index of the output buffer
+	outputPos   uint16 // Current output position within buffer
 
 	// Violation tracking
-	violations    []string
+	violations []string
+	reads      int // copy reads validated
+
+	// Buffer bytes each song's player writes
+	scratch scratchMap
 }
 
-func NewMemoryValidator() *MemoryValidator {
-	return &MemoryValidator{}
+func NewMemoryValidator(scratch scratchMap) *MemoryValidator {
+	v := &MemoryValidator{scratch: scratch}
+	for range project.Buffers.Bases {
+		v.valid = append(v.valid, make([]bool, project.Buffers.Size))
+	}
+	return v
 }
 
 // InitForSong sets up the validator for decompressing a specific song
 func (v *MemoryValidator) InitForSong(song int, songs map[int][]byte) {
 	v.currentSong = song
 	v.violations = nil
-
-	// Determine which buffer is self vs other
-	if song%2 == 1 {
-		v.selfBuffer = 0x1000
-	} else {
-		v.selfBuffer = 0x7000
-	}
+	v.selfBuffer, _, _ = bufferIndex(songBase(song))
 	v.outputPos = 0
 
-	// Set up buffer validity based on what's been decompressed so far
-	// Songs are decompressed in order: 1,2,3,4,5,6,7,8,9
-	// Buffer $1000: songs 1,3,5,7,9 (odd)
-	// Buffer $7000: songs 2,4,6,8 (even)
-
-	// Clear both buffers first
-	for i := range v.buf1000Valid {
-		v.buf1000Valid[i] = false
-	}
-	for i := range v.buf7000Valid {
-		v.buf7000Valid[i] = false
-	}
-
-	// Song 1: no previous data
-	if song == 1 {
-		return
-	}
-
-	// Song 2: self=$7000 (empty), other=$1000 (S1)
-	if song == 2 {
-		for i := 0; i < len(songs[1]) && i < bufferSize; i++ {
-			v.buf1000Valid[i] = true
-		}
-		// Protect scratch in other buffer (S1 was played, scratch corrupted)
-		v.protectScratch(v.buf1000Valid[:])
-		// Self buffer ($7000) is empty - no scratch to protect
-		return
-	}
-
-	// Songs 3-9: both buffers have data from previous songs
-	// Track HIGH WATER MARK (max bytes ever written to each buffer)
-	var hwm1000, hwm7000 int
-	for s := 1; s < song; s++ {
-		songLen := len(songs[s])
-		if s%2 == 1 {
-			if songLen > hwm1000 {
-				hwm1000 = songLen
-			}
-		} else {
-			if songLen > hwm7000 {
-				hwm7000 = songLen
+	// Set up buffer validity based on what's been decompressed so far:
+	// songs are decompressed in playlist order, each into its manifest
+	// buffer, and a buffer is valid up to its HIGH WATER MARK (max bytes
+	// ever written)
+	for i, valid := range v.valid {
+		base := int(project.Buffers.Bases[i])
+		hwm := 0
+		for _, s := range playedBefore(song) {
+			if songBase(s) == base {
+				hwm = max(hwm, len(songs[s]))
 			}
 		}
-	}
+		for offset := range valid {
+			valid[offset] = offset < hwm
+		}
 
-	// Set validity for $1000 buffer up to high water mark
-	for i := 0; i < hwm1000 && i < bufferSize; i++ {
-		v.buf1000Valid[i] = true
+		// Protect scratch regions in every buffer
+		// Self buffer scratch could be read via fwdref before being overwritten
+		// Other buffer scratch was corrupted by playroutine
+		v.protectScratch(valid, v.scratch.played(song, base))
 	}
+}
 
-	// Set validity for $7000 buffer up to high water mark
-	for i := 0; i < hwm7000 && i < bufferSize; i++ {
-		v.buf7000Valid[i] = true
+// protectScratch marks scratch regions (offsets relative to buffer base) as invalid
+func (v *MemoryValidator) protectScratch(valid []bool, regions []codec.Region) {
+	for _, r := range regions {
+		for i := r.Start; i < r.End && i < len(valid); i++ {
+			valid[i] = false
+		}
 	}
-
-	// Protect scratch regions in BOTH buffers
-	// Self buffer scratch could be read via fwdref before being overwritten
-	// Other buffer scratch was corrupted by playroutine
-	v.protectScratch(v.buf1000Valid[:])
-	v.protectScratch(v.buf7000Valid[:])
 }
 
-// protectScratch marks scratch regions as invalid
-func (v *MemoryValidator) protectScratch(valid []bool) {
-	// Scratch regions (offsets relative to buffer base):
-	// $0115-$0116 (2 bytes)
-	// $081E-$088C (111 bytes)
-	for i := 0x0115; i <= 0x0116 && i < len(valid); i++ {
-		valid[i] = false
-	}
-	for i := 0x081E; i <= 0x088C && i < len(valid); i++ {
-		valid[i] = false
+// ProtectRange marks buffer bytes in [lo, hi] as invalid (e.g. holding a
+// stream that was loaded over them)
+func (v *MemoryValidator) ProtectRange(lo, hi uint16) {
+	for addr := int(lo); addr <= int(hi); addr++ {
+		if i, offset, ok := bufferIndex(addr); ok {
+			v.valid[i][offset] = false
+		}
 	}
 }
 
 // MarkWritten marks a byte as written to output
 func (v *MemoryValidator) MarkWritten(addr uint16) {
-	if addr >= 0x1000 && addr < 0x1000+bufferSize {
-		v.buf1000Valid[addr-0x1000] = true
-	} else if addr >= 0x7000 && addr < 0x7000+bufferSize {
-		v.buf7000Valid[addr-0x7000] = true
+	i, offset, ok := bufferIndex(int(addr))
+	if !ok {
+		return
 	}
+	v.valid[i][offset] = true
 	// Track output position
-	if addr >= v.selfBuffer && addr < v.selfBuffer+bufferSize {
-		offset := addr - v.selfBuffer
-		if offset >= v.outputPos {
-			v.outputPos = offset + 1
-		}
+	if i == v.selfBuffer && uint16(offset) >= v.outputPos {
+		v.outputPos = uint16(offset) + 1
 	}
 }
 
 // ValidateRead checks if reading from addr is valid during copy operations
 func (v *MemoryValidator) ValidateRead(addr uint16) bool {
 	// Only validate reads from the decompression buffers
-	if addr < 0x1000 || addr >= 0xD000 {
+	i, offset, ok := bufferIndex(int(addr))
+	if !ok {
 		return true // Not a buffer read
 	}
+	v.reads++
 
-	var valid bool
+	// Self buffer: valid if already written (backref) OR initialized from
+	// prev song (fwdref). Other buffer: must be initialized and not scratch.
+	valid := v.valid[i][offset]
 	var reason string
-
-	if addr >= 0x1000 && addr < 0x1000+bufferSize {
-		offset := int(addr - 0x1000)
-		if v.selfBuffer == 0x1000 {
-			// Reading from self buffer ($1000)
-			// Valid if: already written (backref) OR initialized from prev song (fwdref)
-			valid = v.buf1000Valid[offset]
-			if !valid {
-				reason = fmt.Sprintf("self buffer offset $%04X not initialized", offset)
-			}
-		} else {
-			// Reading from other buffer ($1000) - must be initialized and not scratch
-			valid = v.buf1000Valid[offset]
-			if !valid {
-				reason = fmt.Sprintf("other buffer ($1000) offset $%04X invalid/scratch", offset)
-			}
-		}
-	} else if addr >= 0x7000 && addr < 0x7000+bufferSize {
-		offset := int(addr - 0x7000)
-		if v.selfBuffer == 0x7000 {
-			// Reading from self buffer ($7000)
-			valid = v.buf7000Valid[offset]
-			if !valid {
-				reason = fmt.Sprintf("self buffer offset $%04X not initialized", offset)
-			}
-		} else {
-			// Reading from other buffer ($7000)
-			valid = v.buf7000Valid[offset]
-			if !valid {
-				reason = fmt.Sprintf("other buffer ($7000) offset $%04X invalid/scratch", offset)
-			}
-		}
+	if !valid && i == v.selfBuffer {
+		reason = fmt.Sprintf("self buffer offset $%04X not initialized", offset)
+	} else if !valid {
+		reason = fmt.Sprintf("other buffer ($%04X) offset $%04X invalid/scratch", int(project.Buffers.Bases[i]), offset)
 	}
 
 	if !valid {
@@ -192,62 +138,54 @@ func (v *MemoryValidator) Violations() []string {
 	return v.violations
 }
 
-func testDecompressor() error {
-	fmt.Println("6502 Decompressor Test")
-	fmt.Println("======================")
-
-	// Load expected song data
-	songs := make(map[int][]byte)
-	for i := 1; i <= 9; i++ {
-		data, err := os.ReadFile(filepath.Join("uncompressed", fmt.Sprintf("d%dp.raw", i)))
-		if err != nil {
-			return fmt.Errorf("loading song %d: %w", i, err)
-		}
-		normalizeSong(data)
-		songs[i] = data
+// testDecompressor decodes the playlist with the default decoder, or with
+// the 65C02 profile on the 65C02 if cmos is set, checking every copy reads
+// only bytes a song may reference.
+func testDecompressor(songs map[int][]byte, scratch scratchMap, cmos bool) error {
+	title := "6502 Decompressor Test"
+	if cmos {
+		title = "\n65C02 Decompressor Test"
 	}
+	fmt.Println(title)
+	fmt.Println(strings.Repeat("=", len(strings.TrimSpace(title))))
 
 	// Load split stream files
-	streamMain, err := os.ReadFile(filepath.Join("generated", "stream_main.bin"))
+	streamMain, streamTail, err := loadStreamPieces()
 	if err != nil {
-		return fmt.Errorf("loading stream_main.bin: %w\n(run compressor first: go run ./cmd/compress)", err)
-	}
-	streamTail, err := os.ReadFile(filepath.Join("generated", "stream_tail.bin"))
-	if err != nil {
-		return fmt.Errorf("loading stream_tail.bin: %w\n(run compressor first: go run ./cmd/compress)", err)
+		return err
 	}
 
 	// Get decompressor code
-	decompCode := GetDecompressorCode()
+	decompCode, _ := genDecompressor(decoderProfile{cmos: cmos})
 	fmt.Printf("Decompressor size: %d bytes\n\n", len(decompCode))
 
 	fmt.Println("Split Stream Test (main + tail)")
 	fmt.Println("--------------------------------")
 	fmt.Printf("Stream main: %d bytes, tail: %d bytes\n", len(streamMain), len(streamTail))
 
-	// Memory layout:
-	// - Main stream in high memory ending at $FFFF
-	// - Tail stream at $663B-$6FFF (buffer A tail)
-	const tailAddr = 0x663B
-	mainStart := 0x10000 - len(streamMain)
+	// Memory layout (from the manifest, as in the build):
+	// - Main stream in high memory ending at mainEnd
+	// - Tail stream at tailAddr, reached via the jump at the end of main
+	mainStart := mainStreamDest(len(streamMain))
+	tailAddr := int(project.Stream.TailAddr)
 
 	fmt.Printf("Layout: main=$%04X-$%04X, tail=$%04X-$%04X\n\n",
-		mainStart, 0xFFFF, tailAddr, tailAddr+len(streamTail)-1)
+		mainStart, int(project.Stream.MainEnd), tailAddr, tailAddr+len(streamTail)-1)
 
 	cpu := NewCPU6502()
-	cpu.LoadAt(0x0D00, decompCode)
+	cpu.CMOS = cmos
+	cpu.LoadAt(decoderOrigin, decompCode)
 
 	// Load streams into memory
 	cpu.LoadAt(uint16(mainStart), streamMain)
-	cpu.LoadAt(tailAddr, streamTail)
+	cpu.LoadAt(uint16(tailAddr), streamTail)
 
 	cpu.Mem[zpSrcLo] = byte(mainStart)
 	cpu.Mem[zpSrcHi] = byte(mainStart >> 8)
 	cpu.Mem[zpBitBuf] = 0x80
-	cpu.Mem[0x0CFF] = 0x00
 
 	// Set up memory validator
-	validator := NewMemoryValidator()
+	validator := NewMemoryValidator(scratch)
 	cpu.OnRead = func(addr uint16) {
 		validator.ValidateRead(addr)
 	}
@@ -259,29 +197,19 @@ func testDecompressor() error {
 	var totalCycles uint64
 	var totalViolations []string
 
-	// Decompress songs 1-8 from main stream
-	for song := 1; song <= 8; song++ {
+	// Decompress all parts in playlist order, one call each (the last jumps
+	// from main into tail)
+	for _, song := range project.Songs.Playlist {
 		target := songs[song]
 
 		// Initialize validator for this song
 		validator.InitForSong(song, songs)
 
-		var dstAddr uint16
-		if song%2 == 1 {
-			dstAddr = 0x1000
-		} else {
-			dstAddr = 0x7000
-		}
+		dstAddr := uint16(songBase(song))
 		cpu.Mem[zpOutLo] = byte(dstAddr)
 		cpu.Mem[zpOutHi] = byte(dstAddr >> 8)
 
-		cpu.Mem[0x01FF] = 0x0C
-		cpu.Mem[0x01FE] = 0xFE
-		cpu.SP = 0xFD
-		cpu.PC = 0x0D00
-		cpu.Halted = false
-		cpu.Cycles = 0
-
+		pushReturn(cpu, decoderOrigin)
 		err := cpu.Run(2000000)
 		if err != nil {
 			fmt.Printf("Song %d: RUNTIME ERROR: %v\n", song, err)
@@ -313,132 +241,808 @@ func testDecompressor() error {
 					break
 				}
 			}
-			fmt.Printf("Song %d: FAIL at offset %d\n", song, firstDiff)
+			fmt.Printf("Song %d: FAIL at offset %d (got $%02X, want $%02X)\n",
+				song, firstDiff, output[firstDiff], target[firstDiff])
 			allPassed = false
 		}
 	}
 
-	// Song 9: First decompress partial S9 from main (until terminator)
-	// Then continue from tail stream
-	target9 := songs[9]
+	fmt.Printf("\nTotal cycles: %d\n", totalCycles)
+
+	// Report memory access violations
+	if len(totalViolations) > 0 {
+		fmt.Printf("\nMemory access violations: %d\n", len(totalViolations))
+		for i, v := range totalViolations {
+			fmt.Printf("  %s\n", v)
+			if i >= 9 {
+				fmt.Printf("  ... and %d more\n", len(totalViolations)-10)
+				break
+			}
+		}
+		allPassed = false
+	} else {
+		fmt.Println("\nMemory access validation: PASSED")
+	}
+
+	if allPassed {
+		fmt.Println("\nAll tests PASSED!")
+	}
 
-	// Initialize validator for song 9
-	validator.InitForSong(9, songs)
+	if !allPassed {
+		return fmt.Errorf("some tests failed")
+	}
+	return nil
+}
 
-	cpu.Mem[zpOutLo] = 0x00
-	cpu.Mem[zpOutHi] = 0x10 // $1000
+// returnGuard is the BRK the routines called in the VM return to: the byte
+// below the decoder's load address.
+const returnGuard = decoderOrigin - 1
 
-	cpu.Mem[0x01FF] = 0x0C
-	cpu.Mem[0x01FE] = 0xFE
+// pushReturn sets the CPU up to run the subroutine at addr, returning to the
+// BRK at returnGuard.
+func pushReturn(cpu *CPU6502, addr uint16) {
+	cpu.Mem[returnGuard] = 0x00
+	cpu.Mem[0x01FF] = byte((returnGuard - 1) >> 8)
+	cpu.Mem[0x01FE] = byte((returnGuard - 1) & 0xFF)
 	cpu.SP = 0xFD
-	cpu.PC = 0x0D00
+	cpu.PC = addr
 	cpu.Halted = false
 	cpu.Cycles = 0
+}
+
+// callRoutine runs the subroutine at addr until it returns to the BRK at
+// returnGuard.
+func callRoutine(cpu *CPU6502, addr uint16, maxCycles uint64) error {
+	pushReturn(cpu, addr)
+	if err := cpu.Run(maxCycles); err != nil {
+		return err
+	}
+	if !cpu.Halted {
+		return fmt.Errorf("timeout at $%04X", cpu.PC)
+	}
+	return nil
+}
+
+// loadStreamPieces reads the main stream and the tail the compressor wrote.
+func loadStreamPieces() (streamMain, streamTail []byte, err error) {
+	if streamMain, err = os.ReadFile(project.Outputs.StreamMain); err != nil {
+		return nil, nil, fmt.Errorf("loading main stream: %w\n(run compressor first: go run ./cmd/compress)", err)
+	}
+	if streamTail, err = os.ReadFile(project.Outputs.StreamTail); err != nil {
+		return nil, nil, fmt.Errorf("loading stream tail: %w\n(run compressor first: go run ./cmd/compress)", err)
+	}
+	return streamMain, streamTail, nil
+}
 
-	// Run until terminator in main stream
-	err = cpu.Run(2000000)
+// validateCopies checks the copy reads of every part with a MemoryValidator,
+// tracking them through the reference pointer of the decoder placed as in p:
+// a zero page pointer, or in the self-modifying profile the operand of
+// copy_loop's load. It returns the function that starts a song, which
+// returns the one that reports the violations of that song.
+func validateCopies(cpu *CPU6502, p decoderProfile, scratch scratchMap) func(song int, songs map[int][]byte) func() error {
+	p = p.placed()
+	cpu.RefZP = p.zp.ref
+	if p.smc {
+		_, labels := genDecompressor(p)
+		cpu.RefOperand = uint16(p.origin + labels["zp_ref_lo"])
+	}
+	validator := NewMemoryValidator(scratch)
+	cpu.OnRead = func(addr uint16) {
+		validator.ValidateRead(addr)
+	}
+	cpu.OnWrite = func(addr uint16) {
+		validator.MarkWritten(addr)
+	}
+	return func(song int, songs map[int][]byte) func() error {
+		validator.InitForSong(song, songs)
+		reads := validator.reads
+		return func() error {
+			switch {
+			case validator.HasViolations():
+				return fmt.Errorf("%s", validator.Violations()[0])
+			case validator.reads == reads:
+				return fmt.Errorf("song %d: no copy reads seen", song)
+			}
+			return nil
+		}
+	}
+}
+
+// packedZP is zpFrom for the fixed placements of the tests, with room for
+// every slot.
+func packedZP(first int) decoderZP {
+	z, err := zpFrom(first, true, true)
 	if err != nil {
-		fmt.Printf("Song 9 (main): RUNTIME ERROR: %v\n", err)
-		allPassed = false
-	} else if !cpu.Halted {
-		fmt.Printf("Song 9 (main): TIMEOUT\n")
-		allPassed = false
-	} else {
-		mainCycles := cpu.Cycles
-
-		// Check how much of S9 was decompressed
-		outPos := uint16(cpu.Mem[zpOutLo]) | uint16(cpu.Mem[zpOutHi])<<8
-		partialLen := int(outPos - 0x1000)
-
-		// Verify partial output matches
-		partialMatch := true
-		for i := 0; i < partialLen && i < len(target9); i++ {
-			if cpu.Mem[0x1000+uint16(i)] != target9[i] {
-				fmt.Printf("Song 9 (main): MISMATCH at offset %d\n", i)
-				partialMatch = false
+		panic(err)
+	}
+	return z
+}
+
+// guardClear reports returnGuard lying inside the decoder placed as in p,
+// size bytes long, or its zero page, where the BRK callRoutine plants would
+// overwrite it.
+func guardClear(p decoderProfile, size int) error {
+	p = p.placed()
+	if returnGuard >= p.origin && returnGuard < p.origin+size {
+		return fmt.Errorf("return guard $%04X is inside the decoder at $%04X-$%04X", returnGuard, p.origin, p.origin+size-1)
+	}
+	for _, s := range p.zp.slots(p.crc, p.sliced) {
+		if s.addr == returnGuard {
+			return fmt.Errorf("return guard $%04X is %s", returnGuard, s.name)
+		}
+	}
+	return nil
+}
+
+// runPlaylist decodes the stream pieces part by part with the decoder code
+// placed as in p, and returns the cycles of each part. It reports the first
+// part decoded wrong, a copy reading a byte the part may not reference, and
+// a write to a zero page byte outside the decoder's.
+func runPlaylist(code []byte, p decoderProfile, songs map[int][]byte, scratch scratchMap, streamMain, streamTail []byte) ([]uint64, error) {
+	p = p.placed()
+	if err := guardClear(p, len(code)); err != nil {
+		return nil, err
+	}
+	cpu := NewCPU6502()
+	cpu.CMOS = p.cmos
+	startSong := validateCopies(cpu, p, scratch)
+	slot := make(map[int]bool)
+	slots, _ := p.zpSlots()
+	for _, s := range slots {
+		slot[s.addr] = true
+	}
+	src, out := int(p.zp.src), int(p.zp.out)
+	if p.smc {
+		// The pointers are operands in the code
+		_, labels := genDecompressor(p)
+		src, out = p.origin+labels["zp_src_lo"], p.origin+labels["zp_out_lo"]
+	}
+	for addr := 2; addr < 0x100; addr++ {
+		if !slot[addr] {
+			cpu.Mem[addr] = 0xA5
+		}
+	}
+	mainStart := mainStreamDest(len(streamMain))
+	cpu.LoadAt(uint16(p.origin), code)
+	cpu.LoadAt(uint16(mainStart), streamMain)
+	cpu.LoadAt(uint16(project.Stream.TailAddr), streamTail)
+	cpu.Mem[src] = byte(mainStart)
+	cpu.Mem[src+1] = byte(mainStart >> 8)
+	cpu.Mem[p.zp.bitbuf] = 0x80
+
+	var cycles []uint64
+	for _, song := range project.Songs.Playlist {
+		dst := songBase(song)
+		cpu.Mem[out] = byte(dst)
+		cpu.Mem[out+1] = byte(dst >> 8)
+		checkReads := startSong(song, songs)
+		if err := callRoutine(cpu, uint16(p.origin), 20000000); err != nil {
+			return nil, fmt.Errorf("song %d: %w", song, err)
+		}
+		if !bytes.Equal(cpu.Mem[dst:dst+len(songs[song])], songs[song]) {
+			return nil, fmt.Errorf("song %d decoded wrong", song)
+		}
+		if err := checkReads(); err != nil {
+			return nil, err
+		}
+		cycles = append(cycles, cpu.Cycles)
+	}
+	for addr := 2; addr < 0x100; addr++ {
+		if !slot[addr] && cpu.Mem[addr] != 0xA5 {
+			return nil, fmt.Errorf("zero page $%02X written", addr)
+		}
+	}
+	return cycles, nil
+}
+
+// testPlacements decodes the playlist with the decoder assembled for other
+// load addresses and zero page assignments, and with the default decoder
+// moved by its relocation table. Copies must read only what the part may
+// reference, and zero page bytes outside the decoder's slots must come
+// through untouched.
+func testPlacements(songs map[int][]byte, scratch scratchMap) error {
+	fmt.Println("\nPlacement Test")
+	fmt.Println("--------------")
+
+	streamMain, streamTail, err := loadStreamPieces()
+	if err != nil {
+		return err
+	}
+
+	scattered := decoderZP{src: 0xFB, bitbuf: 0x02, out: 0xFD, val: 0x22, ref: 0x60, otherDelta: 0x90, callerX: 0x03, crc: 0xA0}
+	placements := []struct {
+		name string
+		p    decoderProfile
+	}{
+		{"$0200, zero page from $F0", decoderProfile{origin: 0x0200, zp: packedZP(0xF0)}},
+		{"$0833, zero page from $40", decoderProfile{origin: 0x0833, zp: packedZP(0x40)}},
+		{"$0400, scattered zero page", decoderProfile{origin: 0x0400, zp: scattered}},
+		{"$0900, relocated from $0D00", decoderProfile{origin: 0x0900}},
+		{"$0300, self-modifying, zero page $FB", decoderProfile{origin: 0x0300, smc: true, zp: decoderZP{bitbuf: 0xFB}}},
+		{"$0A00, self-modifying 65C02, zero page $80", decoderProfile{origin: 0x0A00, smc: true, cmos: true, zp: decoderZP{bitbuf: 0x80}}},
+	}
+
+	allPassed := true
+	for _, pl := range placements {
+		p := pl.p.placed()
+		code, _ := genDecompressor(p)
+		if p.zp == defaultZP {
+			// Moved by the relocation table, which must give the same code
+			moved := relocate(GetDecompressorCode(), decoderRelocs(decoderProfile{}), (p.origin-decoderOrigin)>>8)
+			if !bytes.Equal(moved, code) {
+				fmt.Printf("%s: FAIL (relocated code differs from code assembled there)\n", pl.name)
 				allPassed = false
-				break
+				continue
 			}
+			code = moved
+		}
+		cycles, err := runPlaylist(code, p, songs, scratch, streamMain, streamTail)
+		if err != nil {
+			fmt.Printf("%s: FAIL (%v)\n", pl.name, err)
+			allPassed = false
+			continue
 		}
+		var total uint64
+		for _, c := range cycles {
+			total += c
+		}
+		fmt.Printf("%s: PASS (%d parts, %d cycles)\n", pl.name, len(cycles), total)
+	}
 
-		if partialMatch {
-			// Continue from tail stream
-			cpu.Mem[zpSrcLo] = byte(tailAddr & 0xFF)
-			cpu.Mem[zpSrcHi] = byte(tailAddr >> 8)
-			cpu.Mem[zpBitBuf] = 0x80
+	if !allPassed {
+		return fmt.Errorf("placement tests failed")
+	}
+	return nil
+}
 
-			cpu.Mem[0x01FF] = 0x0C
-			cpu.Mem[0x01FE] = 0xFE
-			cpu.SP = 0xFD
-			cpu.PC = 0x0D00
-			cpu.Halted = false
-			cpu.Cycles = 0
+// testProfiles decodes the playlist with the size, the speed, the 65C02 and
+// the self-modifying profile of the decoder and reports what the speed costs
+// in bytes and saves in cycles, and the zero page each profile needs.
+func testProfiles(songs map[int][]byte, scratch scratchMap) error {
+	fmt.Println("\nProfile Test")
+	fmt.Println("------------")
 
-			err = cpu.Run(2000000)
-			if err != nil {
-				fmt.Printf("Song 9 (tail): RUNTIME ERROR: %v\n", err)
-				allPassed = false
-			} else if !cpu.Halted {
-				fmt.Printf("Song 9 (tail): TIMEOUT\n")
-				allPassed = false
-			} else {
-				// Verify complete S9
-				output9 := cpu.Mem[0x1000 : 0x1000+uint16(len(target9))]
-				if bytes.Equal(output9, target9) {
-					s9Cycles := mainCycles + cpu.Cycles
-					fmt.Printf("Song 9: PASS (%d bytes, %d cycles) [main=%d + tail=%d]\n",
-						len(target9), s9Cycles, partialLen, len(target9)-partialLen)
-					totalCycles += s9Cycles
-				} else {
-					firstDiff := -1
-					for i := range target9 {
-						if output9[i] != target9[i] {
-							firstDiff = i
-							break
-						}
-					}
-					fmt.Printf("Song 9: FAIL at offset %d (got $%02X, want $%02X)\n",
-						firstDiff, output9[firstDiff], target9[firstDiff])
-					allPassed = false
-				}
+	streamMain, streamTail, err := loadStreamPieces()
+	if err != nil {
+		return err
+	}
+	names := []string{"size", "speed", "65c02", "smc"}
+	profiles := []decoderProfile{{}, {speed: true}, {cmos: true}, {smc: true}}
+	sizes := make([]int, len(profiles))
+	cycles := make([][]uint64, len(profiles))
+	for i, p := range profiles {
+		code, _ := genDecompressor(p)
+		sizes[i] = len(code)
+		if cycles[i], err = runPlaylist(code, p, songs, scratch, streamMain, streamTail); err != nil {
+			return fmt.Errorf("%s profile: %w", names[i], err)
+		}
+	}
+
+	row := func(name string, values []uint64) {
+		fmt.Printf("%-8s", name)
+		for _, v := range values {
+			fmt.Printf(" %12d", v)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%-8s", "")
+	for _, name := range names {
+		fmt.Printf(" %12s", name)
+	}
+	fmt.Println()
+	sizeRow := make([]uint64, len(profiles))
+	for i, size := range sizes {
+		sizeRow[i] = uint64(size)
+	}
+	row("Bytes", sizeRow)
+	zpRow := make([]uint64, len(profiles))
+	for i, p := range profiles {
+		slots, _ := p.placed().zpSlots()
+		zpRow[i] = uint64(len(slots))
+	}
+	row("ZP bytes", zpRow)
+	totals := make([]uint64, len(profiles))
+	for part, song := range project.Songs.Playlist {
+		values := make([]uint64, len(profiles))
+		for i := range profiles {
+			values[i] = cycles[i][part]
+			totals[i] += values[i]
+		}
+		row(fmt.Sprintf("Song %d", song), values)
+	}
+	row("Cycles", totals)
+	fmt.Printf("Speed profile: %.2fx faster for %d more bytes\n",
+		float64(totals[0])/float64(totals[1]), sizes[1]-sizes[0])
+	fmt.Printf("65C02 profile: %d bytes smaller, %d more cycles\n",
+		sizes[0]-sizes[2], int64(totals[2])-int64(totals[0]))
+	fmt.Printf("Self-modifying profile: %d zero page byte instead of %d, %+d bytes, %+d cycles\n",
+		zpRow[3], zpRow[0], sizes[3]-sizes[0], int64(totals[3])-int64(totals[0]))
+	return nil
+}
+
+// testSelfModifying decodes a stream that jumps straight into a literal with
+// the self-modifying decoder, twice without reloading it, checking its copy
+// reads. Its literals are one byte copies, which need zp_val_hi to be 0 after
+// a jump and when a call starts; the playlist has no literal after its jump.
+func testSelfModifying(songs map[int][]byte, scratch scratchMap) error {
+	fmt.Println("\nSelf-Modifying Decoder Test")
+	fmt.Println("---------------------------")
+
+	p := decoderProfile{smc: true}.placed()
+	code, labels := genDecompressor(p)
+	target := songs[1][:2048]
+	opts := songOptions(1, nil, nil, nil)
+	body, _, _ := codec.Compress(target, opts) // starts with a literal
+	const jumpAddr, bodyAddr = 0xC000, 0xC100
+	jump := &codec.BitWriter{}
+	opts.WriteJump(jump, bodyAddr)
+
+	cpu := NewCPU6502()
+	cpu.LoadAt(uint16(p.origin), code)
+	cpu.LoadAt(jumpAddr, jump.Bytes())
+	cpu.LoadAt(bodyAddr, body)
+	startSong := validateCopies(cpu, p, scratch)
+	src, out := p.origin+labels["zp_src_lo"], p.origin+labels["zp_out_lo"]
+	dst := songBase(1)
+	for call := 1; call <= 2; call++ {
+		clear(cpu.Mem[dst : dst+len(target)])
+		cpu.Mem[src], cpu.Mem[src+1] = byte(jumpAddr&0xFF), byte(jumpAddr>>8)
+		cpu.Mem[out], cpu.Mem[out+1] = byte(dst), byte(dst>>8)
+		cpu.Mem[p.zp.bitbuf] = 0x80
+		checkReads := startSong(1, songs)
+		if err := callRoutine(cpu, uint16(p.origin), 20000000); err != nil {
+			return fmt.Errorf("call %d: %w", call, err)
+		}
+		if !bytes.Equal(cpu.Mem[dst:dst+len(target)], target) {
+			return fmt.Errorf("call %d: jump into a literal decoded wrong", call)
+		}
+		if err := checkReads(); err != nil {
+			return fmt.Errorf("call %d: %w", call, err)
+		}
+		fmt.Printf("Call %d: PASS (jump into a literal, %d bytes)\n", call, len(target))
+	}
+	return nil
+}
+
+// testSliced decodes the playlist with the sliced decoder a few output bytes
+// per call. Between the calls it runs code that clobbers the registers, the
+// flags, the decimal mode, the stack and the zero page outside the decoder's.
+func testSliced(songs map[int][]byte) error {
+	fmt.Println("\nSliced Decoder Test")
+	fmt.Println("-------------------")
+
+	streamMain, streamTail, err := loadStreamPieces()
+	if err != nil {
+		return err
+	}
+	p := decoderProfile{sliced: true}.placed()
+	code, labels := genDecompressor(p)
+	sliceAddr := uint16(p.origin + labels["decompress_slice"])
+	fmt.Printf("Sliced decompressor: %d bytes (decompress_slice at $%04X)\n", len(code), sliceAddr)
+
+	cpu := NewCPU6502()
+	cpu.LoadAt(uint16(p.origin), code)
+	mainStart := mainStreamDest(len(streamMain))
+	cpu.LoadAt(uint16(mainStart), streamMain)
+	cpu.LoadAt(uint16(project.Stream.TailAddr), streamTail)
+	cpu.Mem[p.zp.src] = byte(mainStart)
+	cpu.Mem[p.zp.src+1] = byte(mainStart >> 8)
+	cpu.Mem[p.zp.bitbuf] = 0x80
+
+	slot := make(map[int]bool)
+	for _, s := range p.zp.slots(false, true) {
+		slot[s.addr] = true
+	}
+	var free []int
+	for addr := 2; addr < 0x100; addr++ {
+		if !slot[addr] {
+			free = append(free, addr)
+		}
+	}
+
+	// clobber assembles and runs a new random routine below the decoder
+	rng := rand.New(rand.NewSource(1))
+	const clobberAt = 0x0C00
+	clobber := func() error {
+		c := asm6502.New(clobberAt)
+		for i := 0; i < 4; i++ {
+			c.Ins("lda #$%02X", rng.Intn(256))
+			c.Ins("sta $%02X", free[rng.Intn(len(free))])
+			c.Ins("pha") // junk on the stack below the return address
+		}
+		for i := 0; i < 4; i++ {
+			c.Ins("pla")
+		}
+		c.Ins("ldx #$%02X", rng.Intn(256))
+		c.Ins("ldy #$%02X", rng.Intn(256))
+		c.Ins("%s", []string{"sed", "cld"}[rng.Intn(2)])
+		c.Ins("%s", []string{"sec", "clc"}[rng.Intn(2)])
+		c.Ins("lda #$%02X", rng.Intn(256))
+		c.Ins("rts")
+		code, _ := c.MustAssemble()
+		cpu.LoadAt(clobberAt, code)
+		return callRoutine(cpu, clobberAt, 1000)
+	}
+
+	allPassed := true
+	for _, song := range project.Songs.Playlist {
+		target := songs[song]
+		dst := songBase(song)
+		cpu.Mem[p.zp.out] = byte(dst)
+		cpu.Mem[p.zp.out+1] = byte(dst >> 8)
+		entry := uint16(p.origin)
+		slices := 0
+		var longest, total uint64
+		for {
+			if err := clobber(); err != nil {
+				return err
 			}
+			cpu.Mem[p.zp.budget] = byte(1 + rng.Intn(64))
+			if err := callRoutine(cpu, entry, 2000000); err != nil {
+				return fmt.Errorf("song %d, slice %d: %w", song, slices+1, err)
+			}
+			slices++
+			longest = max(longest, cpu.Cycles)
+			total += cpu.Cycles
+			entry = sliceAddr
+			if cpu.P&FlagC == 0 {
+				break
+			}
+		}
+		if bytes.Equal(cpu.Mem[dst:dst+len(target)], target) {
+			fmt.Printf("Song %d: PASS (%d slices, %d cycles, longest slice %d cycles)\n", song, slices, total, longest)
+		} else {
+			fmt.Printf("Song %d: FAIL (output differs)\n", song)
+			allPassed = false
 		}
 	}
 
-	// Check for memory access violations from song 9
-	if validator.HasViolations() {
-		totalViolations = append(totalViolations, validator.Violations()...)
+	if !allPassed {
+		return fmt.Errorf("sliced decoder tests failed")
 	}
+	return nil
+}
 
-	fmt.Printf("\nTotal cycles: %d\n", totalCycles)
+// layoutTestBytes is how much of each song testLayouts compresses, which
+// keeps the compression quick.
+const layoutTestBytes = 0x1000
 
-	// Report memory access violations
-	if len(totalViolations) > 0 {
-		fmt.Printf("\nMemory access violations: %d\n", len(totalViolations))
-		for i, v := range totalViolations {
-			fmt.Printf("  %s\n", v)
-			if i >= 9 {
-				fmt.Printf("  ... and %d more\n", len(totalViolations)-10)
+// testLayouts compresses the playlist for buffer layouts other than the
+// manifest's and decodes it with the decoder generated for each. The full
+// songs, with the players' scratch protected, decode from the generated
+// streams into the manifest's buffers moved up a page: a stream depends on
+// the buffer size and count, not on where the ring starts. The move takes a
+// page off every part's margin against its unread stream.
+func testLayouts(songs map[int][]byte, scratch scratchMap) error {
+	fmt.Println("\nLayout Test")
+	fmt.Println("-----------")
+
+	layouts := []bufferSet{
+		{Bases: []hexInt{0x2000, 0x7400}, Size: 0x5400},
+		{Bases: []hexInt{0x1000, 0x5000, 0x9000}, Size: 0x4000},
+	}
+	saved := project.Buffers
+	defer func() { project.Buffers = saved }()
+
+	allPassed := true
+	for _, layout := range layouts {
+		project.Buffers = layout
+		g := decoderRing()
+		name := fmt.Sprintf("%d x $%04X from $%04X", g.count, g.size, g.start)
+
+		cut := make(map[int][]byte)
+		for song, data := range songs {
+			cut[song] = data[:min(len(data), g.size, layoutTestBytes)]
+		}
+		states := computeBufferStates(cut)
+		streams := make(map[int][]byte)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, song := range project.Songs.Playlist {
+			wg.Add(1)
+			go func(s int) {
+				defer wg.Done()
+				selfDict, otherDict := songDicts(s, states)
+				stream, _, _ := codec.Compress(cut[s], songOptions(s, nil, selfDict, otherDict))
+				mu.Lock()
+				streams[s] = stream
+				mu.Unlock()
+			}(song)
+		}
+		wg.Wait()
+
+		// Each part's stream goes above the ring
+		cpu := NewCPU6502()
+		cpu.LoadAt(decoderOrigin, GetDecompressorCode())
+		streamAddr := g.start + g.count*g.size
+		var cycles uint64
+		failed := ""
+		for _, song := range project.Songs.Playlist {
+			if streamAddr+len(streams[song]) > 0x10000 {
+				failed = fmt.Sprintf("song %d: %d byte stream does not fit above the buffers", song, len(streams[song]))
+				break
+			}
+			cpu.LoadAt(uint16(streamAddr), streams[song])
+			cpu.Mem[zpSrcLo] = byte(streamAddr)
+			cpu.Mem[zpSrcHi] = byte(streamAddr >> 8)
+			cpu.Mem[zpBitBuf] = 0x80
+			dst := songBase(song)
+			cpu.Mem[zpOutLo] = byte(dst)
+			cpu.Mem[zpOutHi] = byte(dst >> 8)
+			if err := callRoutine(cpu, decoderOrigin, 2000000); err != nil {
+				failed = fmt.Sprintf("song %d: %v", song, err)
+				break
+			}
+			cycles += cpu.Cycles
+			if !bytes.Equal(cpu.Mem[dst:dst+len(cut[song])], cut[song]) {
+				failed = fmt.Sprintf("song %d decoded wrong", song)
 				break
 			}
 		}
+		if failed != "" {
+			fmt.Printf("%s: FAIL (%s)\n", name, failed)
+			allPassed = false
+			continue
+		}
+		fmt.Printf("%s: PASS (%d parts, %d cycles)\n", name, len(project.Songs.Playlist), cycles)
+	}
+
+	streamMain, streamTail, err := loadStreamPieces()
+	if err != nil {
+		return err
+	}
+	moved := saved
+	moved.Bases = nil
+	for _, base := range saved.Bases {
+		moved.Bases = append(moved.Bases, base+0x100)
+	}
+	project.Buffers = moved
+	g := decoderRing()
+	name := fmt.Sprintf("%d x $%04X from $%04X, full songs", g.count, g.size, g.start)
+	code, _ := genDecompressor(decoderProfile{}.placed())
+	if cycles, err := runPlaylist(code, decoderProfile{}, songs, scratch, streamMain, streamTail); err != nil {
+		fmt.Printf("%s: FAIL (%v)\n", name, err)
 		allPassed = false
 	} else {
-		fmt.Println("\nMemory access validation: PASSED")
+		var total uint64
+		for _, c := range cycles {
+			total += c
+		}
+		fmt.Printf("%s: PASS (%d parts, %d cycles)\n", name, len(cycles), total)
 	}
 
-	if allPassed {
-		fmt.Println("\nAll tests PASSED!")
+	if !allPassed {
+		return fmt.Errorf("layout tests failed")
+	}
+	return nil
+}
+
+// testSyntaxes reads the decoder include of every profile back from each
+// assembler syntax with the built-in assembler and compares the bytes with
+// the generated decoder.
+func testSyntaxes() error {
+	fmt.Println("\nSyntax Test")
+	fmt.Println("-----------")
+
+	profiles := []struct {
+		name string
+		p    decoderProfile
+	}{
+		{"size", decoderProfile{}},
+		{"backward", decoderProfile{backward: true}},
+		{"crc", decoderProfile{crc: true}},
+		{"speed", decoderProfile{speed: true}},
+		{"sliced", decoderProfile{sliced: true}},
+		{"65c02", decoderProfile{cmos: true}},
+		{"smc", decoderProfile{smc: true}},
+		{"$C000/$F0", decoderProfile{origin: 0xC000, zp: packedZP(0xF0)}},
+	}
+
+	allPassed := true
+	for _, s := range asmSyntaxes {
+		var failed []string
+		for _, pr := range profiles {
+			want, _ := genDecompressor(pr.p.placed())
+			got, err := assembleInclude(decoderInclude(pr.p, s), pr.p, s)
+			switch {
+			case err != nil:
+				failed = append(failed, fmt.Sprintf("%s: %v", pr.name, err))
+			case !bytes.Equal(got, want):
+				failed = append(failed, pr.name+": bytes differ")
+			}
+		}
+		if len(failed) > 0 {
+			fmt.Printf("%s: FAIL (%s)\n", s.name, strings.Join(failed, "; "))
+			allPassed = false
+			continue
+		}
+		fmt.Printf("%s: PASS (%d profiles)\n", s.name, len(profiles))
 	}
 
 	if !allPassed {
-		return fmt.Errorf("some tests failed")
+		return fmt.Errorf("syntax tests failed")
+	}
+	return nil
+}
+
+// testCRC checks the generated crc_verify routine against codec.CRC16, then
+// decodes a stream with a CRC trailer and verifies it, intact and with two
+// output bytes swapped (which an additive checksum cannot see).
+func testCRC() error {
+	fmt.Println("\nCRC-16 Test")
+	fmt.Println("-----------")
+
+	songs, err := loadSongs()
+	if err != nil {
+		return err
+	}
+	code, labels := GetCRCDecompressorCode()
+	verifyAddr := uint16(decoderOrigin + labels["crc_verify"])
+	fmt.Printf("CRC decompressor: %d bytes (crc_verify at $%04X)\n", len(code), verifyAddr)
+
+	cpu := NewCPU6502()
+	cpu.LoadAt(decoderOrigin, code)
+
+	// verify runs crc_verify over [start, end) against want; it returns
+	// whether the routine reported a match.
+	verify := func(start, end uint16, want uint16) (bool, error) {
+		cpu.Mem[zpRefLo] = byte(start)
+		cpu.Mem[zpRefHi] = byte(start >> 8)
+		cpu.Mem[zpOutLo] = byte(end)
+		cpu.Mem[zpOutHi] = byte(end >> 8)
+		cpu.Mem[zpValLo] = byte(want)
+		cpu.Mem[zpValHi] = byte(want >> 8)
+		if err := callRoutine(cpu, verifyAddr, 100000000); err != nil {
+			return false, err
+		}
+		got := uint16(cpu.Mem[zpCrcLo]) | uint16(cpu.Mem[zpCrcHi])<<8
+		if got != want {
+			return false, nil
+		}
+		return cpu.P&FlagC == 0, nil
+	}
+
+	base := uint16(songBase(1))
+	allPassed := true
+	rng := rand.New(rand.NewSource(1))
+	var buffers [][]byte
+	for song := 1; song <= project.Songs.Count; song++ {
+		buffers = append(buffers, songs[song])
+	}
+	for _, n := range []int{0, 1, 255, 256, 257, 4099} {
+		data := make([]byte, n)
+		rng.Read(data)
+		buffers = append(buffers, data)
+	}
+	for i, data := range buffers {
+		cpu.LoadAt(base, data)
+		end := base + uint16(len(data))
+		want := codec.CRC16(data)
+		ok, err := verify(base, end, want)
+		if err != nil {
+			return err
+		}
+		cycles := cpu.Cycles
+		// A wrong expected value must be reported
+		bad, err := verify(base, end, want^0x0100)
+		if err != nil {
+			return err
+		}
+		if !ok || bad {
+			fmt.Printf("Buffer %d (%d bytes): FAIL (CRC $%04X)\n", i, len(data), want)
+			allPassed = false
+		} else if i < project.Songs.Count {
+			fmt.Printf("Song %d: CRC $%04X matches (%d cycles)\n", i+1, want, cycles)
+		}
+	}
+
+	// End to end: a stream with a CRC trailer decoded by the CRC decompressor
+	target := songs[1][:2048]
+	opts := songOptions(1, nil, nil, nil)
+	opts.CRC = true
+	stream, _, _ := codec.Compress(target, opts)
+	streamAddr := uint16(0xC000)
+	cpu.LoadAt(streamAddr, stream)
+	cpu.Mem[zpSrcLo] = byte(streamAddr)
+	cpu.Mem[zpSrcHi] = byte(streamAddr >> 8)
+	cpu.Mem[zpBitBuf] = 0x80
+	dst := base
+	cpu.Mem[zpOutLo] = byte(dst)
+	cpu.Mem[zpOutHi] = byte(dst >> 8)
+	for i := range target {
+		cpu.Mem[int(base)+i] = 0
+	}
+	if err := callRoutine(cpu, decoderOrigin, 2000000); err != nil {
+		return err
+	}
+	end := uint16(cpu.Mem[zpOutLo]) | uint16(cpu.Mem[zpOutHi])<<8
+	streamCRC := uint16(cpu.Mem[zpValLo]) | uint16(cpu.Mem[zpValHi])<<8
+	output := cpu.Mem[base : int(base)+len(target)]
+	if !bytes.Equal(output, target) || int(end) != int(base)+len(target) {
+		fmt.Println("CRC stream: FAIL (decoded output differs)")
+		allPassed = false
+	} else if ok, err := verify(base, end, streamCRC); err != nil {
+		return err
+	} else if !ok {
+		fmt.Println("CRC stream: FAIL (crc_verify rejected a correct song)")
+		allPassed = false
+	} else {
+		fmt.Printf("CRC stream: PASS (%d bytes, CRC $%04X verified)\n", len(target), streamCRC)
+	}
+
+	// Swap two differing bytes: the additive sum is unchanged, the CRC is not
+	i := 0
+	for output[i] == output[i+1] {
+		i++
+	}
+	output[i], output[i+1] = output[i+1], output[i]
+	if ok, err := verify(base, end, streamCRC); err != nil {
+		return err
+	} else if ok {
+		fmt.Printf("CRC swap: FAIL (bytes %d/%d swapped, not flagged)\n", i, i+1)
+		allPassed = false
+	} else {
+		fmt.Printf("CRC swap: PASS (bytes %d/%d swapped, flagged)\n", i, i+1)
+	}
+
+	if !allPassed {
+		return fmt.Errorf("CRC tests failed")
 	}
 	return nil
 }
 
 func vmTestMain() {
-	if err := testDecompressor(); err != nil {
+	songs, err := loadSongs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	scratch, err := discoverScratchMap(songs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testDecompressor(songs, scratch, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testDecompressor(songs, scratch, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testPlacements(songs, scratch); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testProfiles(songs, scratch); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testSelfModifying(songs, scratch); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testSyntaxes(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testSliced(songs); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testLayouts(songs, scratch); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testSeek(songs, scratch); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testKeyframeSeek(songs); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := testCRC(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
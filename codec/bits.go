@@ -0,0 +1,186 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/bits"
+)
+
+// BitWriter appends bits MSB first.
+type BitWriter struct {
+	data   []byte
+	bitPos int
+}
+
+func (w *BitWriter) WriteBits(val, count int) {
+	for i := count - 1; i >= 0; i-- {
+		if w.bitPos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if (val>>i)&1 == 1 {
+			w.data[len(w.data)-1] |= 1 << (7 - w.bitPos%8)
+		}
+		w.bitPos++
+	}
+}
+
+func (w *BitWriter) WriteGamma(n int) {
+	b := bits.Len(uint(n + 1))
+	for i := 0; i < b-1; i++ {
+		w.WriteBits(0, 1)
+	}
+	w.WriteBits(n+1, b)
+}
+
+func (w *BitWriter) WriteExpGolomb(n, k int) {
+	w.WriteGamma(n >> k)
+	w.WriteBits(n&((1<<k)-1), k)
+}
+
+// CopyBits appends the first bitCount bits of src.
+func (w *BitWriter) CopyBits(src []byte, bitCount int) {
+	for i := 0; i < bitCount; i++ {
+		bit := (src[i/8] >> (7 - i%8)) & 1
+		w.WriteBits(int(bit), 1)
+	}
+}
+
+func (w *BitWriter) PadToByte() {
+	for w.bitPos%8 != 0 {
+		w.WriteBits(0, 1)
+	}
+}
+
+// Bits returns the number of bits written.
+func (w *BitWriter) Bits() int {
+	return w.bitPos
+}
+
+// Bytes returns the written data; a partial last byte is zero-padded.
+func (w *BitWriter) Bytes() []byte {
+	return w.data
+}
+
+// Segment is a piece of a compressed stream at its load address.
+type Segment struct {
+	Addr int
+	Data []byte
+}
+
+// BitReader reads bits MSB first from a byte slice or an io.Reader. Bits past
+// the end read as 0 and set Exhausted, as the 6502 decoder would read on into
+// whatever follows the stream.
+type BitReader struct {
+	src  io.ByteReader
+	cur  byte
+	left int // bits left in cur
+	pos  int // bits consumed from the current segment
+
+	// Segments reachable via jump commands (nil for a self-contained stream)
+	Segments []Segment
+
+	exhausted bool
+	err       error // first read error other than io.EOF
+}
+
+// NewBitReader reads data from its first bit.
+func NewBitReader(data []byte) *BitReader {
+	return &BitReader{src: bytes.NewReader(data)}
+}
+
+// NewBitReaderAt reads data starting at bit offset bit.
+func NewBitReaderAt(data []byte, bit int) *BitReader {
+	r := &BitReader{src: bytes.NewReader(data[bit/8:]), pos: bit / 8 * 8}
+	r.ReadBits(bit % 8)
+	return r
+}
+
+// NewStreamBitReader reads an io.Reader.
+func NewStreamBitReader(rd io.Reader) *BitReader {
+	br, ok := rd.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(rd)
+	}
+	return &BitReader{src: br}
+}
+
+// Jump continues reading at address addr, like the 6502 decoder re-pointing
+// zp_src and resetting zp_bitbuf to $80. It reports whether addr lies in one
+// of the reader's segments.
+func (r *BitReader) Jump(addr int) bool {
+	for _, seg := range r.Segments {
+		if addr >= seg.Addr && addr < seg.Addr+len(seg.Data) {
+			r.src = bytes.NewReader(seg.Data[addr-seg.Addr:])
+			r.left = 0
+			r.pos = (addr - seg.Addr) * 8
+			return true
+		}
+	}
+	return false
+}
+
+// Position returns the number of bits consumed from the current segment.
+func (r *BitReader) Position() int {
+	return r.pos
+}
+
+// Exhausted reports whether a bit past the end was requested.
+func (r *BitReader) Exhausted() bool {
+	return r.exhausted
+}
+
+// Err returns the first error of the underlying reader other than io.EOF.
+func (r *BitReader) Err() error {
+	return r.err
+}
+
+func (r *BitReader) ReadBit() int {
+	if r.left == 0 {
+		b, err := r.src.ReadByte()
+		if err != nil {
+			if err != io.EOF && r.err == nil {
+				r.err = err
+			}
+			r.exhausted = true
+			return 0
+		}
+		r.cur = b
+		r.left = 8
+	}
+	r.left--
+	r.pos++
+	return int(r.cur>>r.left) & 1
+}
+
+func (r *BitReader) ReadBits(n int) int {
+	val := 0
+	for i := 0; i < n; i++ {
+		val = (val << 1) | r.ReadBit()
+	}
+	return val
+}
+
+func (r *BitReader) ReadExpGolomb(k int) int {
+	zeros := 0
+	for r.ReadBit() == 0 && !r.exhausted {
+		zeros++
+	}
+	q := (1 << zeros) + r.ReadBits(zeros) - 1
+	return (q << k) + r.ReadBits(k)
+}
+
+// ReadExpGolombOrEscape reads an Exp-Golomb value, but stops after
+// terminatorZeros leading zeros and reports an escape instead (the 6502
+// decoder makes the same early exit in read_expgol).
+func (r *BitReader) ReadExpGolombOrEscape(k, terminatorZeros int) (int, bool) {
+	zeros := 0
+	for r.ReadBit() == 0 {
+		zeros++
+		if zeros == terminatorZeros {
+			return 0, true
+		}
+	}
+	q := (1 << zeros) + r.ReadBits(zeros) - 1
+	return (q << k) + r.ReadBits(k), false
+}
@@ -0,0 +1,147 @@
+// Package codec implements the V23 delta format: an Exp-Golomb coded LZ stream
+// that decodes a song into its output buffer, referencing the song's own output,
+// the previous contents of that buffer and one other buffer, usually the one
+// the previous song was decoded into. However many buffers the caller rotates
+// through, a song is coded against these two only.
+//
+// The output and other buffer form a ring: virtual addresses [0, BufferSize)
+// are the output (self) buffer, [BufferSize, 2*BufferSize) the other buffer.
+//
+// Command encoding (expgol(n) = gamma(n>>k) + k low bits):
+//
+//	0     + expgol(d) + expgol(len)   backref0   dist = 3*(d+1)
+//	10    + 8 bits                    literal
+//	110   + expgol(d) + expgol(len)   backref1   dist = 3*(d+1) - 2
+//	1110  + expgol(o) + expgol(len)   fwdref     copy from self buffer at pos+o
+//	11110 + expgol(d) + expgol(len)   backref2   dist = 3*(d+1) - 1
+//	11111 + expgol(o) + expgol(len)   copyother  copy from other buffer at pos+o
+//
+// A backref0 distance with TerminatorZeros leading zeros is an escape; the bit
+// that follows ends the song (EscapeEnd) or continues reading at a 16-bit
+// address (EscapeJump). With Options.CRC the end escape is followed by the
+// CRC-16 of the song's output (16 bits, MSB first).
+package codec
+
+import "math/bits"
+
+// V23 defaults, matching the 6502 decoder.
+const (
+	DefaultBufferSize      = 0x6000 // 24KB per buffer ($1000-$6FFF, $7000-$CFFF)
+	DefaultK               = 2      // Exp-Golomb k for lengths, distances and offsets
+	DefaultTerminatorZeros = 12     // leading zeros that mark an escape
+)
+
+// Escape kinds, the bit after the terminator prefix.
+const (
+	EscapeEnd  = 0 // end of song
+	EscapeJump = 1 // continue reading at the 16-bit address that follows (MSB first)
+)
+
+// Region is a half-open range [Start, End) of buffer offsets.
+type Region struct {
+	Start, End int
+}
+
+// DefaultScratch lists the buffer offsets the playroutine uses as working memory.
+// They hold undefined data once a song has played from that buffer.
+// cmd/compress discovers the per-song equivalent by running each player.
+var DefaultScratch = []Region{
+	{0x0115, 0x0117}, // $0115-$0116 (2 bytes)
+	{0x081E, 0x088D}, // $081E-$088C (111 bytes)
+}
+
+// Options describes the buffer geometry, the dictionaries a song is coded
+// against and the format parameters.
+type Options struct {
+	BufferSize int // bytes per buffer; the ring is 2*BufferSize
+
+	// Previous contents of the output buffer and of the other buffer
+	SelfDict  []byte
+	OtherDict []byte
+
+	// Buffer offsets that must not be referenced while they hold a previous
+	// song: written by the playroutines that ran from the output buffer and
+	// from the other buffer (protected only where that buffer has a dictionary)
+	SelfScratch  []Region
+	OtherScratch []Region
+
+	KLen, KDist, KOffset int // Exp-Golomb k per field
+	TerminatorZeros      int // leading zeros that mark an escape
+
+	// Follow the end escape with the CRC-16 of the output (in decode order);
+	// the decoder checks it
+	CRC bool
+}
+
+// DefaultOptions returns the V23 format without dictionaries.
+func DefaultOptions() Options {
+	return Options{
+		BufferSize:      DefaultBufferSize,
+		SelfScratch:     DefaultScratch,
+		OtherScratch:    DefaultScratch,
+		KLen:            DefaultK,
+		KDist:           DefaultK,
+		KOffset:         DefaultK,
+		TerminatorZeros: DefaultTerminatorZeros,
+	}
+}
+
+// WithDicts returns a copy of o with the given dictionaries.
+func (o Options) WithDicts(selfDict, otherDict []byte) Options {
+	o.SelfDict = selfDict
+	o.OtherDict = otherDict
+	return o
+}
+
+func (o Options) ringSize() int {
+	return 2 * o.BufferSize
+}
+
+// MaxOffset is the largest fwdref/copyother offset that encodes with fewer
+// than TerminatorZeros leading zeros. The 6502 gamma reader stops at
+// TerminatorZeros zeros in every field, so larger offsets would read as escapes.
+func (o Options) MaxOffset() int {
+	return (1<<o.TerminatorZeros-1)<<o.KOffset - 1
+}
+
+// WriteEnd emits the end-of-song escape.
+func (o Options) WriteEnd(w *BitWriter) {
+	o.writeEscape(w, EscapeEnd)
+}
+
+// WriteJump emits a command that makes the decoder continue reading at addr.
+func (o Options) WriteJump(w *BitWriter, addr int) {
+	o.writeEscape(w, EscapeJump)
+	w.WriteBits(addr, 16)
+}
+
+// writeEscape emits the terminator prefix (backref0 + TerminatorZeros zeros)
+// followed by the escape kind.
+func (o Options) writeEscape(w *BitWriter, kind int) {
+	w.WriteBits(0b0, 1)
+	w.WriteBits(0, o.TerminatorZeros)
+	w.WriteBits(kind, 1)
+}
+
+func gammaBits(n int) int {
+	return 2*bits.Len(uint(n+1)) - 1
+}
+
+// ExpGolombBits returns the encoded size of n with parameter k.
+func ExpGolombBits(n, k int) int {
+	return gammaBits(n>>k) + k
+}
+
+// gammaZeros returns the leading zeros in the Exp-Golomb code of n.
+func gammaZeros(n, k int) int {
+	return bits.Len(uint(n>>k+1)) - 1
+}
+
+// Reversed returns data with its bytes in reverse order.
+func Reversed(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[len(data)-1-i] = b
+	}
+	return out
+}
@@ -0,0 +1,193 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// FuzzRoundTrip compresses random targets against random dictionaries and
+// checks the decoder reproduces them, and rejects the stream with a typed
+// error once its last byte is cut off.
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("abcabcabcabcabc"), []byte{}, []byte{}, false)
+	f.Add([]byte("the quick brown fox jumps over the lazy dog"), []byte("the lazy dog"), []byte("quick brown"), true)
+	f.Add(bytes.Repeat([]byte{0x60}, 300), []byte{}, bytes.Repeat([]byte{0x60, 0x00}, 200), false)
+	f.Add([]byte{0x00}, []byte{0x01, 0x02}, []byte{0x03}, true)
+
+	f.Fuzz(func(t *testing.T, target, selfDict, otherDict []byte, crc bool) {
+		// Dictionaries long enough to cover both scratch regions; the parser is
+		// quadratic on repetitive input, so targets stay short
+		if len(target) == 0 || len(target) > 256 || len(selfDict) > 2560 || len(otherDict) > 2560 {
+			t.Skip()
+		}
+
+		opts := DefaultOptions().WithDicts(selfDict, otherDict)
+		opts.CRC = crc
+		compressed, _, _ := Compress(target, opts)
+		got, err := Decompress(compressed, opts, len(target))
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if !bytes.Equal(got, target) {
+			t.Fatalf("round trip mismatch: got %x, want %x", got, target)
+		}
+
+		_, err = Decompress(compressed[:len(compressed)-1], opts, len(target))
+		var decErr *DecodeError
+		if !errors.As(err, &decErr) {
+			t.Fatalf("truncated stream: got %v, want *DecodeError", err)
+		}
+	})
+}
+
+// TestDecodeErrors feeds the decoder hand-written streams that break one rule
+// each and checks the kind of *DecodeError and where it was found.
+func TestDecodeErrors(t *testing.T) {
+	literal := func(w *BitWriter, b int) {
+		w.WriteBits(0b10, 2)
+		w.WriteBits(b, 8)
+	}
+	crcOpts := DefaultOptions()
+	crcOpts.CRC = true
+
+	tests := []struct {
+		name        string
+		opts        Options
+		expectedLen int
+		stream      func(w *BitWriter, o Options)
+		want        error
+		outPos      int
+		addr        int
+	}{
+		{"truncated literal", DefaultOptions(), 0, func(w *BitWriter, o Options) {
+			w.WriteBits(0b10, 2)
+		}, ErrTruncated, 0, -1},
+		{"backref past the other buffer", DefaultOptions(), 0, func(w *BitWriter, o Options) {
+			w.WriteBits(0b0, 1)
+			w.WriteExpGolomb(0x2000, o.KDist)
+			w.WriteExpGolomb(0, o.KLen)
+			o.WriteEnd(w)
+		}, ErrDistance, 0, -1},
+		{"backref into an empty other buffer", DefaultOptions(), 0, func(w *BitWriter, o Options) {
+			literal(w, 0x42)
+			w.WriteBits(0b0, 1)
+			w.WriteExpGolomb(0, o.KDist)
+			w.WriteExpGolomb(0, o.KLen)
+			o.WriteEnd(w)
+		}, ErrProtected, 1, 2*DefaultBufferSize - 2},
+		{"literal past the expected length", DefaultOptions(), 1, func(w *BitWriter, o Options) {
+			literal(w, 1)
+			literal(w, 2)
+			o.WriteEnd(w)
+		}, ErrOverrun, 1, -1},
+		{"end before the expected length", DefaultOptions(), 2, func(w *BitWriter, o Options) {
+			literal(w, 1)
+			o.WriteEnd(w)
+		}, ErrShortOutput, 1, -1},
+		{"escape in a backref1 distance", DefaultOptions(), 0, func(w *BitWriter, o Options) {
+			literal(w, 1)
+			w.WriteBits(0b110, 3)
+			w.WriteBits(0, o.TerminatorZeros)
+			w.WriteBits(0b1, 1)
+			w.WriteExpGolomb(0, o.KLen)
+			o.WriteEnd(w)
+		}, ErrEscape, 1, -1},
+		{"jump without segments", DefaultOptions(), 0, func(w *BitWriter, o Options) {
+			o.WriteJump(w, 0x1234)
+		}, ErrBadJump, 0, 0x1234},
+		{"wrong CRC", crcOpts, 0, func(w *BitWriter, o Options) {
+			literal(w, 1)
+			o.WriteEnd(w)
+			w.WriteBits(int(CRC16([]byte{1})^0xFFFF), 16)
+		}, ErrCRC, 1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w BitWriter
+			tt.stream(&w, tt.opts)
+			_, err := Decompress(w.Bytes(), tt.opts, tt.expectedLen)
+			var decErr *DecodeError
+			if !errors.As(err, &decErr) {
+				t.Fatalf("got %v, want *DecodeError", err)
+			}
+			if !errors.Is(err, tt.want) || decErr.OutPos != tt.outPos || decErr.Addr != tt.addr {
+				t.Fatalf("got %v (output %d, addr %d), want %v (output %d, addr %d)",
+					decErr.Err, decErr.OutPos, decErr.Addr, tt.want, tt.outPos, tt.addr)
+			}
+		})
+	}
+}
+
+// TestDecodeReadError checks that a reader failing mid-stream is reported
+// with its error, not as a truncated stream.
+func TestDecodeReadError(t *testing.T) {
+	opts := DefaultOptions()
+	compressed, _, _ := Compress([]byte("abcabcabcabcabc"), opts)
+	failure := errors.New("device not ready")
+	r := io.MultiReader(bytes.NewReader(compressed[:len(compressed)/2]), iotest.ErrReader(failure))
+	_, err := io.ReadAll(NewDecoder(r, opts, 0))
+	var decErr *DecodeError
+	if !errors.As(err, &decErr) || !errors.Is(err, ErrRead) || !errors.Is(err, failure) {
+		t.Fatalf("got %v, want a *DecodeError wrapping ErrRead and %v", err, failure)
+	}
+	if errors.Is(err, ErrTruncated) {
+		t.Fatalf("got %v, reported as truncated", err)
+	}
+}
+
+// TestEncoderRoundTrip writes a song to an Encoder in several pieces and checks
+// that nothing reaches the writer before Close, and that the stream Close
+// writes ends in the terminator (and CRC) and decodes to the song.
+func TestEncoderRoundTrip(t *testing.T) {
+	song := []byte("the quick brown fox jumps over the lazy dog; the lazy dog sleeps")
+	for _, crc := range []bool{false, true} {
+		t.Run(fmt.Sprintf("crc=%v", crc), func(t *testing.T) {
+			opts := DefaultOptions().WithDicts([]byte("the lazy dog"), []byte("quick brown"))
+			opts.CRC = crc
+
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf, opts)
+			for _, piece := range [][]byte{song[:10], song[10:11], nil, song[11:40], song[40:]} {
+				if n, err := enc.Write(piece); n != len(piece) || err != nil {
+					t.Fatalf("Write: got (%d, %v), want (%d, nil)", n, err, len(piece))
+				}
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("%d bytes written before Close", buf.Len())
+			}
+			if err := enc.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			want, bits, _ := Compress(song, opts)
+			if !bytes.Equal(buf.Bytes(), want) || enc.Bits() != bits {
+				t.Fatalf("got %x (%d bits), want %x (%d bits) as from Compress", buf.Bytes(), enc.Bits(), want, bits)
+			}
+			// Decoding up to the terminator rather than to a known length only
+			// succeeds if Close flushed the end escape (and a matching CRC)
+			got, err := io.ReadAll(NewDecoder(bytes.NewReader(buf.Bytes()), opts, 0))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !bytes.Equal(got, song) {
+				t.Fatalf("round trip mismatch: got %q, want %q", got, song)
+			}
+
+			if !crc {
+				return
+			}
+			// The CRC is the stream's last 16 bits
+			stream := bytes.Clone(buf.Bytes())
+			last := bits - 1
+			stream[last/8] ^= 0x80 >> (last % 8)
+			_, err = io.ReadAll(NewDecoder(bytes.NewReader(stream), opts, 0))
+			if !errors.Is(err, ErrCRC) {
+				t.Fatalf("flipped CRC bit: got %v, want %v", err, ErrCRC)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package codec
+
+// CRC16 returns the CRC-16/CCITT-FALSE of data (polynomial $1021, initial
+// value $FFFF, MSB first), the checksum an optional stream trailer carries.
+func CRC16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// appendCRC inserts the CRC-16 of output after the end escape of a stream
+// of bitCount bits.
+func appendCRC(data []byte, bitCount int, output []byte) ([]byte, int) {
+	w := &BitWriter{}
+	w.CopyBits(data, bitCount)
+	w.WriteBits(int(CRC16(output)), 16)
+	bitCount = w.Bits()
+	w.PadToByte()
+	return w.Bytes(), bitCount
+}
@@ -0,0 +1,223 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The decoder is strict: it decodes up to the terminator and rejects any stream
+// the 6502 decoder would misread or that reads memory it must not, instead of
+// reading zeros past the end or trusting the expected length.
+
+var (
+	ErrTruncated   = errors.New("stream truncated")
+	ErrDistance    = errors.New("reference beyond available history")
+	ErrProtected   = errors.New("read from protected scratch or uninitialised memory")
+	ErrOverrun     = errors.New("output overrun")
+	ErrShortOutput = errors.New("stream ends before expected length")
+	ErrEscape      = errors.New("escape-length gamma inside a command field")
+	ErrBadJump     = errors.New("jump outside the stream segments")
+	ErrCRC         = errors.New("CRC mismatch")
+	ErrRead        = errors.New("stream read failed")
+)
+
+// DecodeError reports why and where a decode failed.
+type DecodeError struct {
+	Err    error // one of the Err* values above; ErrRead wraps the reader's error
+	BitPos int   // bit offset of the failing command in the segment being read
+	OutPos int   // output bytes produced before the failing command
+	Addr   int   // virtual (or jump target) address involved, -1 if none
+}
+
+func (e *DecodeError) Error() string {
+	if e.Addr >= 0 {
+		return fmt.Sprintf("bit %d, output %d: %v ($%04X)", e.BitPos, e.OutPos, e.Err, e.Addr)
+	}
+	return fmt.Sprintf("bit %d, output %d: %v", e.BitPos, e.OutPos, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Decoder decodes one song as an io.Reader. Output goes to virtual address 0
+// of its memory map; reads see the map as the 6502 decoder sees RAM, so
+// self-buffer bytes ahead of the output still hold the previous song until
+// overwritten.
+type Decoder struct {
+	r           *BitReader
+	mem         *MemoryMap
+	opts        Options
+	expectedLen int // 0: up to the terminator
+
+	pos     int // output bytes produced
+	src     int // virtual address of the pending copy
+	pending int // bytes left in the pending copy
+	copyErr DecodeError
+	done    bool
+	err     error
+}
+
+// NewDecoder decodes the stream read from r against the dictionaries of opts.
+// If expectedLen > 0, a stream that produces a different length fails.
+func NewDecoder(r io.Reader, opts Options, expectedLen int) *Decoder {
+	return NewBitDecoder(NewStreamBitReader(r), NewMemoryMap(opts), opts, expectedLen)
+}
+
+// NewBitDecoder decodes from the reader's current position into mem,
+// following jump commands into the reader's segments.
+func NewBitDecoder(r *BitReader, mem *MemoryMap, opts Options, expectedLen int) *Decoder {
+	return &Decoder{r: r, mem: mem, opts: opts, expectedLen: expectedLen}
+}
+
+func (d *Decoder) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if d.pending > 0 {
+			addr := d.mem.ringOffset(d.src)
+			b, ok := d.mem.Read(addr)
+			if !ok {
+				d.copyErr.Addr = addr
+				d.err = &d.copyErr
+				d.pending = 0
+				return n, d.err
+			}
+			d.mem.Write(d.pos, b)
+			p[n] = b
+			n++
+			d.pos++
+			d.src++
+			d.pending--
+			continue
+		}
+		if d.err != nil {
+			return n, d.err
+		}
+		if d.done {
+			return n, io.EOF
+		}
+		if b, ok := d.next(); ok {
+			d.mem.Write(d.pos, b)
+			p[n] = b
+			n++
+			d.pos++
+		}
+	}
+	return n, nil
+}
+
+// next decodes one command. A literal is returned; a copy is left pending.
+// Errors and the end of the song are recorded in d.
+func (d *Decoder) next() (byte, bool) {
+	o := d.opts
+	r := d.r
+	start := r.Position()
+	pos := d.pos
+	limit := o.BufferSize
+	if d.expectedLen > 0 {
+		limit = min(d.expectedLen, limit)
+	}
+	fail := func(err error, addr int) (byte, bool) {
+		// The stream ran out because the reader failed, not because it ended
+		if err == ErrTruncated && r.Err() != nil {
+			err = fmt.Errorf("%w: %w", ErrRead, r.Err())
+		}
+		d.err = &DecodeError{Err: err, BitPos: start, OutPos: pos, Addr: addr}
+		return 0, false
+	}
+
+	// Every field goes through read_expgol on the 6502, which takes
+	// TerminatorZeros zeros as an escape wherever it occurs
+	escaped := false
+	field := func(k int) int {
+		v, escape := r.ReadExpGolombOrEscape(k, o.TerminatorZeros)
+		escaped = escaped || escape
+		return v
+	}
+
+	var src, length int
+	if r.ReadBit() == 0 {
+		dist, escape := r.ReadExpGolombOrEscape(o.KDist, o.TerminatorZeros)
+		if escape {
+			kind := r.ReadBit()
+			var value int // jump address or CRC
+			if kind == EscapeJump || o.CRC {
+				value = r.ReadBits(16)
+			}
+			switch {
+			case r.Exhausted():
+				return fail(ErrTruncated, -1)
+			case kind == EscapeEnd:
+				d.done = true
+				if pos < d.expectedLen {
+					return fail(ErrShortOutput, -1)
+				}
+				if o.CRC && uint16(value) != CRC16(d.mem.data[:pos]) {
+					return fail(ErrCRC, -1)
+				}
+			case !r.Jump(value):
+				return fail(ErrBadJump, value)
+			}
+			return 0, false
+		}
+		length = field(o.KLen) + 2
+		src = pos - 3*(dist+1)
+	} else if r.ReadBit() == 0 {
+		b := r.ReadBits(8)
+		if r.Exhausted() {
+			return fail(ErrTruncated, -1)
+		}
+		if pos >= limit {
+			return fail(ErrOverrun, -1)
+		}
+		return byte(b), true
+	} else if r.ReadBit() == 0 {
+		dist := field(o.KDist)
+		length = field(o.KLen) + 2
+		src = pos - (3*(dist+1) - 2)
+	} else if r.ReadBit() == 0 {
+		offset := field(o.KOffset)
+		length = field(o.KLen) + 2
+		src = pos + offset
+	} else if r.ReadBit() == 0 {
+		dist := field(o.KDist)
+		length = field(o.KLen) + 2
+		src = pos - (3*(dist+1) - 1)
+	} else {
+		encoded := field(o.KOffset)
+		length = field(o.KLen) + 2
+		src = pos + encoded + o.BufferSize
+	}
+
+	switch {
+	case r.Exhausted():
+		return fail(ErrTruncated, -1)
+	case escaped:
+		return fail(ErrEscape, -1)
+	case src < -o.BufferSize || src+length > o.ringSize():
+		// Backrefs reach at most a whole buffer behind the output (the
+		// previous song's buffer); forward refs must stay on the ring
+		return fail(ErrDistance, -1)
+	case pos+length > limit:
+		return fail(ErrOverrun, -1)
+	}
+	d.src = src
+	d.pending = length
+	d.copyErr = DecodeError{Err: ErrProtected, BitPos: start, OutPos: pos}
+	return 0, false
+}
+
+// Decompress decodes a whole song.
+func Decompress(compressed []byte, opts Options, expectedLen int) ([]byte, error) {
+	return io.ReadAll(NewDecoder(bytes.NewReader(compressed), opts, expectedLen))
+}
+
+// DecompressBackward decodes a stream from CompressBackward (in reading order)
+// and returns the song in memory order.
+func DecompressBackward(compressed []byte, opts Options, expectedLen int) ([]byte, error) {
+	mem := NewMemoryMap(opts).Mirrored(expectedLen)
+	out, err := io.ReadAll(NewBitDecoder(NewBitReader(compressed), mem, opts, expectedLen))
+	return Reversed(out), err
+}
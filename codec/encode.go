@@ -0,0 +1,554 @@
+package codec
+
+import (
+	"io"
+	"math"
+	"math/bits"
+)
+
+type choice struct {
+	typ     byte // 0=literal, 1=self-ref, 2=dict-self, 3=dict-other
+	dist    int
+	dictPos int
+	length  int
+}
+
+// Stats counts the commands and bits of one compressed song.
+type Stats struct {
+	Literals      int
+	LiteralBits   int
+	LiteralUsed   [256]bool
+	SelfRef0      int // dist ≡ 0 (mod 3)
+	SelfRef0Bits  int
+	SelfRef1      int // dist ≡ 1 (mod 3)
+	SelfRef1Bits  int
+	SelfRef2      int // dist ≡ 2 (mod 3)
+	SelfRef2Bits  int
+	DictSelf      int
+	DictSelfBits  int
+	DictOther     int
+	DictOtherBits int
+	MaxGammaZeros int // max leading zeros in any gamma encoding
+	MaxLength     int // max copy length used
+	InPlaceLead   int // max (output index - stream bytes loaded) over written bytes
+}
+
+// Add accumulates s into t (counts summed, maxima kept).
+func (t *Stats) Add(s Stats) {
+	t.Literals += s.Literals
+	t.LiteralBits += s.LiteralBits
+	t.SelfRef0 += s.SelfRef0
+	t.SelfRef0Bits += s.SelfRef0Bits
+	t.SelfRef1 += s.SelfRef1
+	t.SelfRef1Bits += s.SelfRef1Bits
+	t.SelfRef2 += s.SelfRef2
+	t.SelfRef2Bits += s.SelfRef2Bits
+	t.DictSelf += s.DictSelf
+	t.DictSelfBits += s.DictSelfBits
+	t.DictOther += s.DictOther
+	t.DictOtherBits += s.DictOtherBits
+	for i := range s.LiteralUsed {
+		if s.LiteralUsed[i] {
+			t.LiteralUsed[i] = true
+		}
+	}
+	t.MaxGammaZeros = max(t.MaxGammaZeros, s.MaxGammaZeros)
+	t.MaxLength = max(t.MaxLength, s.MaxLength)
+	t.InPlaceLead = max(t.InPlaceLead, s.InPlaceLead)
+}
+
+// golombTable caches ExpGolombBits for small values of one k.
+type golombTable struct {
+	k   int
+	lut []uint8
+}
+
+func newGolombTable(k, size int) golombTable {
+	t := golombTable{k, make([]uint8, size)}
+	for i := range t.lut {
+		t.lut[i] = uint8(ExpGolombBits(i, k))
+	}
+	return t
+}
+
+func (t golombTable) of(n int) int {
+	if n < len(t.lut) {
+		return int(t.lut[n])
+	}
+	return ExpGolombBits(n, t.k)
+}
+
+// Compress encodes target as the output of a song decoded against the
+// dictionaries of opts. It returns the byte-padded stream, its length in bits
+// (up to and including the terminator and CRC) and statistics.
+func Compress(target []byte, opts Options) ([]byte, int, Stats) {
+	data, bitCount, stats := compressMem(target, NewMemoryMap(opts), opts)
+	if opts.CRC {
+		data, bitCount = appendCRC(data, bitCount, target)
+	}
+	return data, bitCount, stats
+}
+
+// CompressBackward compresses target for the backward decompressor, which writes
+// the song from its last byte down to its first. The forward encoder runs on the
+// mirrored memory map. Self-buffer offsets [-gap, reserved-gap) hold the song's
+// own compressed data while it decompresses, so they cannot be referenced.
+// The stream is returned in reading order; it is stored byte-reversed.
+func CompressBackward(target []byte, opts Options, reserved, gap int) ([]byte, int, Stats) {
+	mem := NewMemoryMap(opts)
+	mem.ProtectRange(-gap, reserved-gap)
+	reversed := Reversed(target)
+	data, bitCount, stats := compressMem(reversed, mem.Mirrored(len(target)), opts)
+	if opts.CRC {
+		data, bitCount = appendCRC(data, bitCount, reversed)
+	}
+	return data, bitCount, stats
+}
+
+// InPlaceGap returns how many bytes below the output's first byte a backward
+// stream must start so the write pointer never reaches an unread stream byte.
+func InPlaceGap(compressedLen, outputLen int, stats Stats) int {
+	return max(0, stats.InPlaceLead+compressedLen-outputLen+1)
+}
+
+// Encoder compresses everything written to it as one song and writes the
+// stream to the underlying writer on Close.
+type Encoder struct {
+	w      io.Writer
+	opts   Options
+	target []byte
+	bits   int
+	stats  Stats
+}
+
+// NewEncoder returns an encoder that writes the song coded against the
+// dictionaries of opts to w.
+func NewEncoder(w io.Writer, opts Options) *Encoder {
+	return &Encoder{w: w, opts: opts}
+}
+
+// Write appends p to the song. Nothing is compressed until Close, which needs
+// the whole song to choose its commands; Write never fails.
+func (e *Encoder) Write(p []byte) (int, error) {
+	e.target = append(e.target, p...)
+	return len(p), nil
+}
+
+// Close compresses the song and writes the stream.
+func (e *Encoder) Close() error {
+	var data []byte
+	data, e.bits, e.stats = Compress(e.target, e.opts)
+	_, err := e.w.Write(data)
+	return err
+}
+
+// Bits returns the stream length in bits once closed.
+func (e *Encoder) Bits() int {
+	return e.bits
+}
+
+// Stats returns the statistics of the song once closed.
+func (e *Encoder) Stats() Stats {
+	return e.stats
+}
+
+// CommandBoundaries returns the bit offsets at which the commands of a
+// compressed song start, ending with the offset of its terminator.
+func CommandBoundaries(data []byte, opts Options) []int {
+	r := NewBitReader(data)
+	boundaries := []int{0}
+	for !r.Exhausted() {
+		if r.ReadBit() == 0 {
+			if _, escape := r.ReadExpGolombOrEscape(opts.KDist, opts.TerminatorZeros); escape {
+				break
+			}
+			r.ReadExpGolomb(opts.KLen)
+		} else if r.ReadBit() == 0 {
+			r.ReadBits(8)
+		} else if r.ReadBit() == 0 {
+			r.ReadExpGolomb(opts.KDist)
+			r.ReadExpGolomb(opts.KLen)
+		} else if r.ReadBit() == 0 {
+			r.ReadExpGolomb(opts.KOffset)
+			r.ReadExpGolomb(opts.KLen)
+		} else if r.ReadBit() == 0 {
+			r.ReadExpGolomb(opts.KDist)
+			r.ReadExpGolomb(opts.KLen)
+		} else {
+			r.ReadExpGolomb(opts.KOffset)
+			r.ReadExpGolomb(opts.KLen)
+		}
+		boundaries = append(boundaries, r.Position())
+	}
+	return boundaries
+}
+
+// compressMem compresses target as output starting at virtual address 0 of mem.
+func compressMem(target []byte, mem *MemoryMap, opts Options) ([]byte, int, Stats) {
+	bufferSize := opts.BufferSize
+	maxOffset := opts.MaxOffset()
+	lenCost := newGolombTable(opts.KLen, 2048)
+	distCost := newGolombTable(opts.KDist, 16384)
+	offsetCost := newGolombTable(opts.KOffset, 65536)
+
+	var stats Stats
+	stats.InPlaceLead = math.MinInt
+	n := len(target)
+
+	// Backref byte access: at position pos, going backward with distance d
+	//   d ∈ [1, pos]: already-written output (target[pos-d])
+	//   d ∈ (pos, pos+bufferSize]: otherDict via memory map
+	getBackrefByte := func(pos, d int) int {
+		if d <= 0 {
+			return -1
+		}
+		if d <= pos {
+			return int(target[pos-d])
+		}
+		// Distance reaches into other buffer
+		addr := bufferSize + pos - d + bufferSize
+		if b, ok := mem.Read(addr); ok {
+			return int(b)
+		}
+		return -1
+	}
+
+	hashKey2 := func(b0, b1 byte) int { return int(b0)<<8 | int(b1) }
+
+	// Build hash tables
+	targetHash := make(map[int][]int)
+	dictHash := make(map[int][]int) // unified hash for both buffers
+
+	// Index target positions (for self-ref to already-written output)
+	for i := 0; i < n-1; i++ {
+		key := hashKey2(target[i], target[i+1])
+		targetHash[key] = append(targetHash[key], i)
+	}
+
+	// Index dictionary positions from memory map (both buffers)
+	for addr := 0; addr < 2*bufferSize-1; addr++ {
+		b0, ok0 := mem.Read(addr)
+		b1, ok1 := mem.Read(addr + 1)
+		if ok0 && ok1 {
+			key := hashKey2(b0, b1)
+			dictHash[key] = append(dictHash[key], addr)
+		}
+	}
+
+	// DP
+	cost := make([]float64, n+1)
+	choices := make([]choice, n)
+
+	for pos := n - 1; pos >= 0; pos-- {
+		bestCost := 10.0 + cost[pos+1]
+		choices[pos] = choice{typ: 0}
+
+		if pos < n-1 {
+			key := hashKey2(target[pos], target[pos+1])
+			seenDists := make(map[int]bool)
+
+			// Backref from already-written output (target[0..pos-1])
+			if positions, ok := targetHash[key]; ok {
+				for _, srcPos := range positions {
+					if srcPos >= pos {
+						continue
+					}
+					dist := pos - srcPos
+					if dist > 65535 || seenDists[dist] {
+						continue
+					}
+					seenDists[dist] = true
+
+					maxLen := 0
+					for pos+maxLen < n {
+						var srcByte int
+						if maxLen < dist {
+							srcByte = int(target[srcPos+maxLen])
+						} else {
+							srcByte = int(target[srcPos+(maxLen%dist)])
+						}
+						if srcByte != int(target[pos+maxLen]) {
+							break
+						}
+						maxLen++
+					}
+					if maxLen < 2 {
+						continue
+					}
+
+					rem := dist % 3
+					d := dist / 3
+					if rem == 0 {
+						d--
+					}
+					prefixBits := []int{1, 3, 5}[rem]
+					baseCost := float64(prefixBits + distCost.of(d))
+
+					for length := 2; length <= maxLen; length++ {
+						c := baseCost + float64(lenCost.of(length-2)) + cost[pos+length]
+						if c < bestCost {
+							bestCost = c
+							choices[pos] = choice{typ: 1, dist: dist, length: length}
+						}
+					}
+				}
+			}
+
+			// Backref from other buffer via memory map
+			// Distance = pos + bufferSize - (addr - bufferSize) = pos + 2*bufferSize - addr
+			if positions, ok := dictHash[key]; ok {
+				for _, addr := range positions {
+					if addr < bufferSize {
+						continue // only other buffer for backref
+					}
+					dist := pos + 2*bufferSize - addr
+					if dist <= 0 || dist > 65535 || seenDists[dist] {
+						continue
+					}
+					seenDists[dist] = true
+
+					maxLen := mem.MatchLengthAt(addr, pos, target, pos)
+					if maxLen < 2 {
+						continue
+					}
+
+					rem := dist % 3
+					d := dist / 3
+					if rem == 0 {
+						d--
+					}
+					prefixBits := []int{1, 3, 5}[rem]
+					baseCost := float64(prefixBits + distCost.of(d))
+
+					for length := 2; length <= maxLen; length++ {
+						c := baseCost + float64(lenCost.of(length-2)) + cost[pos+length]
+						if c < bestCost {
+							bestCost = c
+							choices[pos] = choice{typ: 1, dist: dist, length: length}
+						}
+					}
+				}
+			}
+
+			// Fwdref (1110): forward copy from 48K ring buffer
+			// Uses memory map to check readability at current output position
+			if positions, ok := dictHash[key]; ok {
+				for _, addr := range positions {
+					if !mem.CanReadAt(addr, pos) {
+						continue
+					}
+					maxLen := mem.MatchLengthAt(addr, pos, target, pos)
+					if maxLen < 2 {
+						continue
+					}
+					offset := addr - pos
+					if offset < 0 || offset > maxOffset {
+						continue // can't encode negative or escape-length offset
+					}
+					baseCost := float64(4 + offsetCost.of(offset))
+					for length := 2; length <= maxLen; length++ {
+						c := baseCost + float64(lenCost.of(length-2)) + cost[pos+length]
+						if c < bestCost {
+							bestCost = c
+							choices[pos] = choice{typ: 2, dictPos: addr, length: length}
+						}
+					}
+				}
+			}
+
+			// Copyother (11111): copy from other buffer with $6000 bias
+			// encoded = addr - pos - bufferSize (for other buffer addresses)
+			if positions, ok := dictHash[key]; ok {
+				for _, addr := range positions {
+					if addr < bufferSize {
+						continue // copyother only from other buffer
+					}
+					if !mem.CanReadAt(addr, pos) {
+						continue
+					}
+					maxLen := mem.MatchLengthAt(addr, pos, target, pos)
+					if maxLen < 2 {
+						continue
+					}
+					encoded := addr - pos - bufferSize
+					if encoded < 0 || encoded > maxOffset {
+						continue // can't encode negative or escape-length offset
+					}
+					baseCost := float64(5 + offsetCost.of(encoded))
+					for length := 2; length <= maxLen; length++ {
+						c := baseCost + float64(lenCost.of(length-2)) + cost[pos+length]
+						if c < bestCost {
+							bestCost = c
+							choices[pos] = choice{typ: 3, dictPos: addr, length: length}
+						}
+					}
+				}
+			}
+		}
+
+		// RLE check (dist 1-2)
+		for dist := 1; dist <= 2; dist++ {
+			if getBackrefByte(pos, dist) == -1 {
+				continue
+			}
+			maxLen := 0
+			for pos+maxLen < n {
+				srcByte := getBackrefByte(pos, dist-(maxLen%dist))
+				if srcByte == -1 || srcByte != int(target[pos+maxLen]) {
+					break
+				}
+				maxLen++
+			}
+			if maxLen < 2 {
+				continue
+			}
+			rem := dist % 3
+			d := dist / 3
+			if rem == 0 {
+				d--
+			}
+			var prefixBits int
+			switch rem {
+			case 0:
+				prefixBits = 1
+			case 1:
+				prefixBits = 3
+			case 2:
+				prefixBits = 5
+			}
+			baseCost := float64(prefixBits + distCost.of(d))
+			for length := 2; length <= maxLen; length++ {
+				c := baseCost + float64(lenCost.of(length-2)) + cost[pos+length]
+				if c < bestCost {
+					bestCost = c
+					choices[pos] = choice{typ: 1, dist: dist, length: length}
+				}
+			}
+		}
+
+		cost[pos] = bestCost
+	}
+
+	// Encode
+	var outBits []byte
+	bitPos := 0
+
+	writeBits := func(val, count int) {
+		for i := count - 1; i >= 0; i-- {
+			if bitPos%8 == 0 {
+				outBits = append(outBits, 0)
+			}
+			if (val>>i)&1 == 1 {
+				outBits[len(outBits)-1] |= 1 << (7 - bitPos%8)
+			}
+			bitPos++
+		}
+	}
+
+	writeGamma := func(n int) {
+		b := bits.Len(uint(n + 1))
+		for i := 0; i < b-1; i++ {
+			writeBits(0, 1)
+		}
+		writeBits(n+1, b)
+	}
+
+	writeExpGolomb := func(n, k int) {
+		q := n >> k
+		zeros := bits.Len(uint(q+1)) - 1
+		if zeros > stats.MaxGammaZeros {
+			stats.MaxGammaZeros = zeros
+		}
+		writeGamma(q)
+		writeBits(n&((1<<k)-1), k)
+	}
+
+	pos := 0
+	for pos < n {
+		ch := choices[pos]
+		switch ch.typ {
+		case 0: // literal
+			stats.Literals++
+			stats.LiteralBits += 10
+			stats.LiteralUsed[target[pos]] = true
+			writeBits(0b10, 2)
+			writeBits(int(target[pos]), 8)
+			pos++
+		case 1: // self-ref
+			if ch.length > stats.MaxLength {
+				stats.MaxLength = ch.length
+			}
+			rem := ch.dist % 3
+			d := ch.dist / 3
+			if rem == 0 {
+				d--
+			}
+			distBits := ExpGolombBits(d, opts.KDist)
+			lenBits := ExpGolombBits(ch.length-2, opts.KLen)
+			cmdBits := 0
+			switch rem {
+			case 0:
+				stats.SelfRef0++
+				cmdBits = 1 + distBits + lenBits
+				stats.SelfRef0Bits += cmdBits
+				writeBits(0b0, 1)
+			case 1:
+				stats.SelfRef1++
+				cmdBits = 3 + distBits + lenBits
+				stats.SelfRef1Bits += cmdBits
+				writeBits(0b110, 3)
+			case 2:
+				stats.SelfRef2++
+				cmdBits = 5 + distBits + lenBits
+				stats.SelfRef2Bits += cmdBits
+				writeBits(0b11110, 5)
+			}
+			writeExpGolomb(d, opts.KDist)
+			writeExpGolomb(ch.length-2, opts.KLen)
+			pos += ch.length
+		case 2: // dict-self (no bias): offset = ringPos - pos
+			if ch.length > stats.MaxLength {
+				stats.MaxLength = ch.length
+			}
+			stats.DictSelf++
+			offset := ch.dictPos - pos
+			stats.DictSelfBits += 4 + ExpGolombBits(offset, opts.KOffset) + ExpGolombBits(ch.length-2, opts.KLen)
+			writeBits(0b1110, 4)
+			writeExpGolomb(offset, opts.KOffset)
+			writeExpGolomb(ch.length-2, opts.KLen)
+			pos += ch.length
+		case 3: // dict-other ($6000 bias): encoded = addr - pos - bufferSize
+			if ch.length > stats.MaxLength {
+				stats.MaxLength = ch.length
+			}
+			stats.DictOther++
+			encoded := ch.dictPos - pos - bufferSize
+			stats.DictOtherBits += 5 + ExpGolombBits(encoded, opts.KOffset) + ExpGolombBits(ch.length-2, opts.KLen)
+			writeBits(0b11111, 5)
+			writeExpGolomb(encoded, opts.KOffset)
+			writeExpGolomb(ch.length-2, opts.KLen)
+			pos += ch.length
+		}
+		// Bytes up to pos-1 are written once the stream is loaded up to the current bit
+		if lead := pos - 1 - (bitPos+7)/8; lead > stats.InPlaceLead {
+			stats.InPlaceLead = lead
+		}
+	}
+
+	// Emit terminator: backref0 prefix + TerminatorZeros zeros + end bit
+	// Data uses fewer zeros, so TerminatorZeros zeros trigger the early exit.
+	// Decoder checks for the zeros BEFORE reading another bit, then reads the escape kind.
+	writeBits(0b0, 1)                  // backref0 prefix
+	writeBits(0, opts.TerminatorZeros) // escape signal
+	writeBits(EscapeEnd, 1)            // end of song
+
+	// Record bit count before padding
+	totalBits := bitPos
+
+	// Pad to byte boundary
+	for bitPos%8 != 0 {
+		writeBits(0, 1)
+	}
+
+	return outBits, totalBits, stats
+}
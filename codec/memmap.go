@@ -0,0 +1,125 @@
+package codec
+
+// MemoryMap tracks readable regions of the virtual address space.
+// Self buffer: addresses 0 to BufferSize-1
+// Other buffer: addresses BufferSize to 2*BufferSize-1
+// Initially all memory is protected. Regions become readable when initialized
+// with dictionary data or when bytes are written during decompression.
+type MemoryMap struct {
+	bufferSize int
+	readable   []bool
+	data       []byte
+}
+
+// NewMemoryMap returns the memory a song is coded against: the dictionaries of
+// opts, with each buffer's scratch regions protected if it holds a dictionary.
+func NewMemoryMap(opts Options) *MemoryMap {
+	m := &MemoryMap{
+		bufferSize: opts.BufferSize,
+		readable:   make([]bool, opts.ringSize()),
+		data:       make([]byte, opts.ringSize()),
+	}
+	for i, b := range opts.SelfDict {
+		m.Write(i, b)
+	}
+	for i, b := range opts.OtherDict {
+		m.Write(m.bufferSize+i, b)
+	}
+	if len(opts.SelfDict) > 0 {
+		m.protectRegions(0, opts.SelfScratch)
+	}
+	if len(opts.OtherDict) > 0 {
+		m.protectRegions(m.bufferSize, opts.OtherScratch)
+	}
+	return m
+}
+
+func (m *MemoryMap) protectRegions(base int, regions []Region) {
+	for _, region := range regions {
+		for offset := region.Start; offset < region.End; offset++ {
+			m.readable[base+offset] = false
+		}
+	}
+}
+
+// ProtectRange marks self-buffer offsets [lo, hi) as unreadable.
+// Offsets wrap around the ring, so negative ones land at the end of the other buffer.
+func (m *MemoryMap) ProtectRange(lo, hi int) {
+	for offset := lo; offset < hi; offset++ {
+		m.readable[m.ringOffset(offset)] = false
+	}
+}
+
+// Mirrored returns the memory map as seen by the backward decompressor for an
+// output of n bytes: virtual address v is buffer offset n-1-v on the ring,
+// so the forward encoder's "not yet overwritten" and backref rules carry over.
+func (m *MemoryMap) Mirrored(n int) *MemoryMap {
+	r := &MemoryMap{
+		bufferSize: m.bufferSize,
+		readable:   make([]bool, len(m.data)),
+		data:       make([]byte, len(m.data)),
+	}
+	for v := range r.data {
+		a := m.ringOffset(n - 1 - v)
+		r.data[v] = m.data[a]
+		r.readable[v] = m.readable[a]
+	}
+	return r
+}
+
+func (m *MemoryMap) ringOffset(offset int) int {
+	size := len(m.data)
+	return ((offset % size) + size) % size
+}
+
+func (m *MemoryMap) Write(addr int, b byte) {
+	if addr >= 0 && addr < len(m.data) {
+		m.data[addr] = b
+		m.readable[addr] = true
+	}
+}
+
+func (m *MemoryMap) CanRead(addr int) bool {
+	return addr >= 0 && addr < len(m.readable) && m.readable[addr]
+}
+
+func (m *MemoryMap) Read(addr int) (byte, bool) {
+	if !m.CanRead(addr) {
+		return 0, false
+	}
+	return m.data[addr], true
+}
+
+// CanReadAt returns whether addr is readable when output is at position pos.
+// For self buffer (addr < BufferSize): readable only if addr >= pos (not yet overwritten)
+// For other buffer (addr >= BufferSize): readable if initialized
+func (m *MemoryMap) CanReadAt(addr, pos int) bool {
+	if !m.CanRead(addr) {
+		return false
+	}
+	if addr < m.bufferSize {
+		return addr >= pos
+	}
+	return true
+}
+
+// ReadAt reads a byte if readable at the given output position.
+func (m *MemoryMap) ReadAt(addr, pos int) (byte, bool) {
+	if !m.CanReadAt(addr, pos) {
+		return 0, false
+	}
+	return m.data[addr], true
+}
+
+// MatchLengthAt returns how many bytes match starting at addr when output is at pos.
+func (m *MemoryMap) MatchLengthAt(addr, pos int, target []byte, targetPos int) int {
+	maxLen := 0
+	for targetPos+maxLen < len(target) {
+		b, ok := m.ReadAt(addr+maxLen, pos)
+		if !ok || b != target[targetPos+maxLen] {
+			break
+		}
+		maxLen++
+	}
+	return maxLen
+}
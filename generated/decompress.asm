@@ -1,4 +1,4 @@
-; Size: 252 bytes
+; Size: 283 bytes
 ; External zero page variables (must be defined by caller)
 ; zp_src_lo       = $02   ; Source pointer (compressed data)
 ; zp_src_hi       = $03
@@ -32,7 +32,7 @@ main_loop:
         txa
 literal_loop:
         jsr     read_bit
-        rol a
+        rol     a
         bcc     literal_loop
         sta     (zp_out_lo),y
         inc     zp_out_lo
@@ -68,7 +68,7 @@ set_x2:
         inx
 backref_common:
         jsr     read_expgol
-        asl a
+        asl     a
         php
         clc
         adc     zp_caller_x
@@ -77,7 +77,7 @@ backref_common:
         adc     zp_val_lo
         sta     zp_val_lo
         txa
-        rol a
+        rol     a
         plp
         adc     zp_val_hi
         plp
@@ -152,26 +152,43 @@ dec_gamma:
         rol     zp_val_hi
         tya
         jsr     read_bit
-        rol a
+        rol     a
         jsr     read_bit
-        rol a
+        rol     a
         ora     zp_val_lo
         sta     zp_val_lo
         ldx     zp_val_hi
         rts
+terminator:
+        jsr     read_bit
+        bcc     stream_end
+jump_addr:
+        jsr     read_bit
+        rol     zp_val_lo
+        rol     zp_val_hi
+        bcc     jump_addr
+        lda     zp_val_lo
+        sta     zp_src_lo
+        lda     zp_val_hi
+        sta     zp_src_hi
+        lda     #$80
+        sta     zp_bitbuf
+        pla
+        pla
+        jmp     main_loop
 read_bit:
         asl     zp_bitbuf
         bne     read_bit_done
         pha
         lda     (zp_src_lo),y
-        rol a
+        rol     a
         sta     zp_bitbuf
         inc     zp_src_lo
         bne     skip_src_hi_inc
         inc     zp_src_hi
 skip_src_hi_inc:
         pha
-terminator:
+stream_end:
         pla
         pla
 read_bit_done:
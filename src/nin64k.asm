@@ -20,7 +20,7 @@
 ; Key variables:
 ;   $78 - Selected part from menu
 ;   $79 - Load next part flag (non-zero = load)
-;   $7B - Current part number (1-9)
+;   $7B - Current part number (1-PART_COUNT)
 ;
 ; Tune buffers:
 ;   $1000 - Buffer 1 (odd parts: 1,3,5,7,9)
@@ -113,7 +113,7 @@ main_loop:
         bpl     @sid
         ; Advance to next song
         lda     zp_part_num
-        cmp     #$09                ; Stop at song 9
+        cmp     #PART_COUNT         ; Stop after the last part
         beq     main_loop
         lda     #$FF
         sta     zp_load_flag
@@ -226,7 +226,7 @@ L8E8:
         lda     part_times+1,x
         bne     play_done
         lda     zp_part_num
-        cmp     #$09                ; Stop at song 9
+        cmp     #PART_COUNT         ; Stop after the last part
         beq     play_done
         lda     #$FF
         sta     zp_load_flag
@@ -377,7 +377,7 @@ print_done:
 ; ----------------------------------------------------------------------------
 load_and_init:
         lda     zp_part_num
-        cmp     #$09                ; Stop at song 9
+        cmp     #PART_COUNT         ; Stop after the last part
         bne     L9BC
         rts
 
@@ -476,6 +476,7 @@ part_times:
         .word   $7BF0
         .word   $0100
         brk
+.assert PART_COUNT <= 9, error, "part_times holds 9 parts"
 
 ; ----------------------------------------------------------------------------
 load_d0:
@@ -487,16 +488,44 @@ load_tune:
 
 ; ----------------------------------------------------------------------------
 ; Initialize stream pointer for in-memory decompression
+; Seeks to the selected part: starts at its keyframe and decodes the parts in
+; between, so load_and_init decodes part zp_selected+1 next
 ; ----------------------------------------------------------------------------
 load_d0_impl:
-        lda     #<STREAM_MAIN_DEST
+        ldx     zp_selected
+        ldy     seek_from,x         ; Keyframe part - 1
+        tya
+        asl     a
+        tax
+        clc
+        lda     seek_offset,x
+        adc     #<STREAM_MAIN_DEST
         sta     zp_src_lo
-        lda     #>STREAM_MAIN_DEST
+        lda     seek_offset+1,x
+        adc     #>STREAM_MAIN_DEST
         sta     zp_src_hi
-        lda     #$80
+        lda     seek_bitbuf,y
         sta     zp_bitbuf
+        lda     zp_part_num
+        pha
+        sty     zp_part_num         ; load_tune decodes part zp_part_num+1
+        php
+        sei                         ; No playing while parts are skipped
+@skip:
+        lda     zp_part_num
+        cmp     zp_selected
+        beq     @done
+        jsr     load_tune
+        inc     zp_part_num
+        bne     @skip
+@done:
+        plp
+        pla
+        sta     zp_part_num
         rts
 
+.include "../generated/seek.inc"
+
 ; ----------------------------------------------------------------------------
 ; Load tune from memory using in-place decompression
 ; X, Y = ignored (were filename chars for disk load)
@@ -518,19 +547,7 @@ load_tune_impl:
         ; Call decompressor in all-RAM mode (stream spans I/O region)
         lda     #$30                ; All RAM
         sta     $01
-        jsr     decompress
-        ; Song 9 is split: stream_main has first part, stream_tail has rest
-        lda     zp_part_num
-        cmp     #$08                ; Song 9 = part 8
-        bne     @load_done
-        lda     #<STREAM_TAIL_DEST
-        sta     zp_src_lo
-        lda     #>STREAM_TAIL_DEST
-        sta     zp_src_hi
-        lda     #$80
-        sta     zp_bitbuf
-        jsr     decompress
-@load_done:
+        jsr     decompress          ; The last part jumps from stream_main to stream_tail
         lda     #$35                ; Back to I/O mode
         sta     $01
         clc                         ; Success
@@ -557,7 +574,7 @@ LFCD:
         lda     init_timing_data,x
         sta     part_times,x
         inx
-        cpx     #$12
+        cpx     #PART_COUNT*2
         bne     LFCD
         lda     #$FF
         sta     zp_load_flag
@@ -565,9 +582,9 @@ LFCD:
         rts
 
 ; ----------------------------------------------------------------------
-; Initial part timing data
+; Initial part timing data, in playlist order
 ; ----------------------------------------------------------------------
 init_timing_data:
-.include "part_times.inc"
+.include "../generated/part_times.inc"
 
 .include "stream.inc"
@@ -20,7 +20,7 @@
 ; Key variables:
 ;   $78 - Selected part from menu
 ;   $79 - Load next part flag (non-zero = load)
-;   zp_part_num - Current part number (1-9)
+;   zp_part_num - Current part number (1-PART_COUNT)
 ;
 ; Tune buffers:
 ;   $1000 - Buffer 1 (odd parts: 1,3,5,7,9)
@@ -297,10 +297,10 @@ selftest_output_checksum:
         lda     zp_song_idx
         and     #$01
         bne     @out_odd
-        lda     #$10
+        lda     #>BUFFER0_BASE
         bne     @out_set
 @out_odd:
-        lda     #$70
+        lda     #>BUFFER1_BASE
 @out_set:
         sta     zp_ptr_hi
         lda     #$00
@@ -658,6 +658,7 @@ part_times:
         .word   $7BF0
         .word   $0100
         brk
+.assert PART_COUNT <= 9, error, "part_times holds 9 parts"
 
 ; ----------------------------------------------------------------------------
 load_tune:
@@ -719,7 +720,7 @@ LFCD:
         lda     init_timing_data,x
         sta     part_times,x
         inx
-        cpx     #$12
+        cpx     #PART_COUNT*2
         bne     LFCD
         lda     #$FF
         sta     zp_load_flag
@@ -730,39 +731,14 @@ LFCD:
 ; Initial part timing data
 ; ----------------------------------------------------------------------
 init_timing_data:
-.include "part_times.inc"
+.include "../generated/part_times.inc"
 
 ; ============================================================================
 ; SELFTEST - Decompress all songs and verify checksums
 ; ============================================================================
 
-; Expected checksums for decompressed songs 1-9 (16-bit additive)
-selftest_checksums:
-        .word   $4541               ; Song 1
-        .word   $A9C7               ; Song 2
-        .word   $656A               ; Song 3
-        .word   $01F5               ; Song 4
-        .word   $D543               ; Song 5
-        .word   $8757               ; Song 6
-        .word   $8831               ; Song 7
-        .word   $D3DB               ; Song 8
-        .word   $4724               ; Song 9
-
-; Song sizes in bytes (songs 1-9)
-selftest_sizes:
-        .word   21085               ; Song 1
-        .word   21375               ; Song 2
-        .word   19464               ; Song 3
-        .word   22889               ; Song 4
-        .word   22075               ; Song 5
-        .word   20300               ; Song 6
-        .word   14423               ; Song 7
-        .word   20707               ; Song 8
-        .word   21620               ; Song 9
-
-; Expected stream checksums
-selftest_stream_main_csum:  .word $FFE8
-selftest_stream_tail_csum:  .word $4D99
+; Expected part sizes and checksums, and stream checksums
+.include "../generated/selftest.inc"
 
 ; Screen codes for display
 char_0          = $30
@@ -835,7 +811,7 @@ selftest:
         lda     #>($0400 + 160)
         sta     zp_screen_hi
 
-        ; Test all 9 songs
+        ; Test all parts
         lda     #0
         sta     zp_song_idx
 
@@ -871,20 +847,8 @@ selftest:
         sta     zp_out_hi
 
         ; Decompress (stream spans $D000, need all-RAM mode)
+        ; The last part is split: the stream jumps from stream_main to stream_tail
         jsr     decompress
-        ; S9 is split: stream_main has first part, stream_tail has rest
-        lda     zp_song_idx
-        cmp     #8                  ; Song 9 = index 8
-        bne     @not_s9
-        ; Switch to stream_tail and continue decompressing
-        lda     #<STREAM_TAIL_DEST
-        sta     zp_src_lo
-        lda     #>STREAM_TAIL_DEST
-        sta     zp_src_hi
-        lda     #$80
-        sta     zp_bitbuf
-        jsr     decompress
-@not_s9:
 
         ; Calculate checksum of output
         jsr     selftest_output_checksum
@@ -949,7 +913,7 @@ selftest:
 @no_carry:
         inc     zp_song_idx
         lda     zp_song_idx
-        cmp     #9
+        cmp     #PART_COUNT
         beq     @done
         jmp     @song_loop
 
@@ -144,8 +144,8 @@ do_play:
 ; ----------------------------------------------------------------------------
 do_preload:
         ldx     zp_part_num
-        cpx     #9
-        bcs     @done               ; No preload after song 9
+        cpx     #PART_COUNT
+        bcs     @done               ; No preload after the last part
         inx                         ; Next song number
         txa
         pha                         ; Save next song number
@@ -190,16 +190,16 @@ check_countdown:
         lda     part_times+1,x
         bne     @done
         lda     zp_part_num
-        cmp     #$09
-        bcs     @done               ; Don't advance past song 9
+        cmp     #PART_COUNT
+        bcs     @done               ; Don't advance past the last part
         ; Song ended - switch to preloaded song (preload happens next frame)
         inc     zp_part_num
 @done:
         rts
 
 ; ----------------------------------------------------------------------------
-; decompress_one - Decompress song X (1-9)
-; Song 9 is split: first part in stream_main, rest in stream_tail
+; decompress_one - Decompress part X (1-PART_COUNT)
+; The last part is split: the stream jumps from stream_main to stream_tail
 ; ----------------------------------------------------------------------------
 decompress_one:
         txa
@@ -217,18 +217,6 @@ decompress_one:
         sta     zp_out_hi
         jsr     decompress
         pla                         ; Get song number
-        cmp     #9
-        bne     @done
-        pha                         ; Save for return
-        lda     #<STREAM_TAIL_DEST
-        sta     zp_src_lo
-        lda     #>STREAM_TAIL_DEST
-        sta     zp_src_hi
-        lda     #$80
-        sta     zp_bitbuf
-        jsr     decompress
-        pla
-@done:
         tax                         ; Restore X
         rts
 
@@ -236,26 +224,22 @@ decompress_one:
 ; Part timing data (decremented in place during playback)
 ; ----------------------------------------------------------------------
 part_times:
-.include "part_times.inc"
+.include "../generated/part_times.inc"
 
 ; ----------------------------------------------------------------------------
-; init_stream - Initialize stream pointer to song 2 (song 1 is preloaded)
-; Song 1 = 39981 bits = 4997 bytes + 5 bits, so song 2 starts mid-byte
+; init_stream - Initialize stream pointer to part 2 (part 1 is preloaded)
+; Part 1 = FIRST_PART_BITS bits (from layout.inc); part 2 starts in the byte
+; they end in, or at the next byte if they end on a byte boundary. layout.inc
+; gives the decoder state for either: the next byte and the bit buffer.
 ; ----------------------------------------------------------------------------
-STREAM_OFFSET = 4997                    ; Byte offset where song 2 starts
+STREAM_OFFSET = FIRST_PART_BITS / 8     ; Byte offset where part 2 starts
 
 init_stream:
-        lda     #<(STREAM_MAIN_DEST + 1)
+        lda     #<(STREAM_MAIN_DEST + PART2_OFFSET)
         sta     zp_src_lo
-        lda     #>(STREAM_MAIN_DEST + 1)
+        lda     #>(STREAM_MAIN_DEST + PART2_OFFSET)
         sta     zp_src_hi
-        lda     STREAM_MAIN_DEST        ; Load partial byte
-        asl     a                       ; Shift out 5 bits consumed by song 1
-        asl     a
-        asl     a
-        asl     a
-        asl     a
-        ora     #$10                    ; Add sentinel (3 bits remain at 7,6,5)
+        lda     #PART2_BITBUF           ; Bits left of the partial byte, or $80
         sta     zp_bitbuf
         rts
 